@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdminConfig enables the admin API on its own port. Every request must
+// carry Token as a bearer token.
+type AdminConfig struct {
+	Port  string `yaml:"port"`
+	Token string `yaml:"token"`
+}
+
+// throughputWindow is the interval over which per-topic rates are computed.
+const throughputWindow = 10 * time.Second
+
+type topicThroughput struct {
+	Total   uint64  `json:"total"`
+	PerSec  float64 `json:"per_second"`
+	current uint64
+}
+
+// throughputTracker counts produced messages per Pulsar topic and derives a
+// rate from the last complete window.
+type throughputTracker struct {
+	mu     sync.Mutex
+	topics map[string]*topicThroughput
+}
+
+var throughput = &throughputTracker{topics: make(map[string]*topicThroughput)}
+
+func (t *throughputTracker) record(topic string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tp, ok := t.topics[topic]
+	if !ok {
+		tp = &topicThroughput{}
+		t.topics[topic] = tp
+	}
+	tp.Total++
+	tp.current++
+}
+
+// run closes a window every throughputWindow until ctx is cancelled.
+func (t *throughputTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(throughputWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.mu.Lock()
+			for _, tp := range t.topics {
+				tp.PerSec = float64(tp.current) / throughputWindow.Seconds()
+				tp.current = 0
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+func (t *throughputTracker) snapshot() map[string]topicThroughput {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]topicThroughput, len(t.topics))
+	for topic, tp := range t.topics {
+		out[topic] = *tp
+	}
+	return out
+}
+
+// serveAdmin runs the admin API. It exposes:
+//
+//	POST /admin/pause                 stop processing; messages queue up
+//	POST /admin/resume                continue processing
+//	GET  /admin/subscriptions         current MQTT subscriptions
+//	GET  /admin/producers             cached Pulsar producers
+//	GET  /admin/producers/namespaces  cached producers per namespace
+//	GET  /admin/throughput            produced messages per Pulsar topic
+func serveAdmin(c AdminConfig) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/pause", func(w http.ResponseWriter, _ *http.Request) {
+		pool.Pause()
+		slog.Info("Processing paused through the admin API")
+		writeJSON(w, map[string]bool{"paused": true})
+	})
+	mux.HandleFunc("POST /admin/resume", func(w http.ResponseWriter, _ *http.Request) {
+		pool.Resume()
+		slog.Info("Processing resumed through the admin API")
+		writeJSON(w, map[string]bool{"paused": false})
+	})
+	mux.HandleFunc("GET /admin/subscriptions", subscriptionsHandler)
+	mux.HandleFunc("GET /admin/producers", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, producers.snapshot())
+	})
+	mux.HandleFunc("GET /admin/producers/namespaces", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, producers.namespaceCounts())
+	})
+	mux.HandleFunc("GET /admin/throughput", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, throughput.snapshot())
+	})
+
+	slog.Info("Starting admin API", "port", c.Port)
+	if err := http.ListenAndServe(fmt.Sprintf(":%s", c.Port), requireToken(c.Token, mux)); err != nil {
+		fatal("Admin server failed", "error", err)
+	}
+}
+
+type subscriptionInfo struct {
+	Filter string `json:"filter"`
+	QoS    byte   `json:"qos"`
+	Topic  string `json:"topic,omitempty"`
+}
+
+func subscriptionsHandler(w http.ResponseWriter, _ *http.Request) {
+	configMu.RLock()
+	subs := make([]subscriptionInfo, 0, len(cfg.MQTT.Subscriptions))
+	for _, s := range cfg.MQTT.Subscriptions {
+		subs = append(subs, subscriptionInfo{Filter: s.Filter, QoS: s.qos(cfg.MQTT.QoS), Topic: s.Topic})
+	}
+	configMu.RUnlock()
+	writeJSON(w, subs)
+}
+
+// requireToken rejects requests without the expected bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireBasicAuth rejects requests without the expected credentials.
+func requireBasicAuth(username, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mqtt-pulsar-connector"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// AMQPConfig configures an AMQP 0.9.1 (RabbitMQ) source consuming Queue.
+// When Exchange is set the queue is bound to it with each of RoutingKeys.
+// Routing keys become MQTT style topics, with dots replaced by slashes, so
+// mapping rules and filters apply to them like to MQTT topics. Deliveries
+// are acked once produced, at most Prefetch (default 100) at a time. The
+// source reconnects on its own when the connection is lost.
+type AMQPConfig struct {
+	// URL is an amqp:// or amqps:// URL, including credentials and vhost.
+	URL         string    `yaml:"url"`
+	Queue       string    `yaml:"queue"`
+	Exchange    string    `yaml:"exchange"`
+	RoutingKeys []string  `yaml:"routing_keys"`
+	Prefetch    int       `yaml:"prefetch"`
+	TLS         TLSConfig `yaml:"tls"`
+}
+
+func (c AMQPConfig) validate() error {
+	if c.URL == "" || c.Queue == "" {
+		return errors.New("amqp.url and amqp.queue are required")
+	}
+	if len(c.RoutingKeys) > 0 && c.Exchange == "" {
+		return errors.New("amqp.routing_keys require amqp.exchange")
+	}
+	if c.Prefetch < 0 {
+		return fmt.Errorf("amqp.prefetch must not be negative, got %d", c.Prefetch)
+	}
+	return nil
+}
+
+type amqpSource struct {
+	c      AMQPConfig
+	closed chan struct{}
+	once   sync.Once
+
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	notify chan *amqp.Error
+	// ch is opened once per connection and outlives stopped consumers, so
+	// their deliveries can still be acked until the source is closed.
+	ch *amqp.Channel
+	// tag is the consumer tag while consuming, "" otherwise.
+	tag     string
+	handler func(*Message)
+	// consumers numbers the consumer tags.
+	consumers int
+}
+
+func newAMQPSource(c AMQPConfig) (*amqpSource, error) {
+	if c.Prefetch == 0 {
+		c.Prefetch = 100
+	}
+	s := &amqpSource{c: c, closed: make(chan struct{})}
+	s.mu.Lock()
+	err := s.connect()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	go s.watch()
+	return s, nil
+}
+
+// connect dials the broker and resumes consuming if the source is started.
+// s.mu must be held.
+func (s *amqpSource) connect() error {
+	var conn *amqp.Connection
+	var err error
+	if s.c.TLS.enabled() {
+		tlsConfig, tlsErr := newTLSConfig(s.c.TLS)
+		if tlsErr != nil {
+			return tlsErr
+		}
+		conn, err = amqp.DialTLS(s.c.URL, tlsConfig)
+	} else {
+		conn, err = amqp.Dial(s.c.URL)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.notify = conn.NotifyClose(make(chan *amqp.Error, 1))
+	// The channel of the previous connection is gone with it
+	s.ch, s.tag = nil, ""
+	if s.handler != nil {
+		return s.consume()
+	}
+	return nil
+}
+
+// watch reconnects whenever the connection is lost, until the source is
+// closed.
+func (s *amqpSource) watch() {
+	for {
+		s.mu.Lock()
+		notify := s.notify
+		s.mu.Unlock()
+		select {
+		case <-s.closed:
+			return
+		case err := <-notify:
+			slog.Warn("Lost connection to AMQP broker", "queue", s.c.Queue, "error", err)
+		}
+
+		for delay := time.Second; ; delay = min(2*delay, 30*time.Second) {
+			select {
+			case <-s.closed:
+				return
+			case <-time.After(delay):
+			}
+			s.mu.Lock()
+			err := s.connect()
+			s.mu.Unlock()
+			if err == nil {
+				slog.Info("Reconnected to AMQP broker", "queue", s.c.Queue)
+				break
+			}
+			slog.Warn("AMQP connection attempt failed", "queue", s.c.Queue, "error", err)
+		}
+	}
+}
+
+func (s *amqpSource) Start(handler func(*Message)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = handler
+	return s.consume()
+}
+
+// consume starts delivering to s.handler, opening the channel if the
+// connection has none yet. s.mu must be held.
+func (s *amqpSource) consume() error {
+	if s.ch == nil || s.ch.IsClosed() {
+		ch, err := s.openChannel()
+		if err != nil {
+			return err
+		}
+		s.ch = ch
+	}
+	s.consumers++
+	tag := fmt.Sprintf("mqtt-pulsar-connector-%d", s.consumers)
+	deliveries, err := s.ch.Consume(s.c.Queue, tag, false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	s.tag = tag
+
+	handler := s.handler
+	go func() {
+		for d := range deliveries {
+			handler(s.message(d))
+		}
+	}()
+	return nil
+}
+
+// openChannel opens a channel with the prefetch and bindings configured.
+// s.mu must be held.
+func (s *amqpSource) openChannel() (*amqp.Channel, error) {
+	ch, err := s.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Qos(s.c.Prefetch, 0, false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	for _, key := range s.c.RoutingKeys {
+		if err := ch.QueueBind(s.c.Queue, key, s.c.Exchange, false, nil); err != nil {
+			ch.Close()
+			return nil, fmt.Errorf("binding %s to %s: %w", key, s.c.Exchange, err)
+		}
+	}
+	return ch, nil
+}
+
+func (s *amqpSource) message(d amqp.Delivery) *Message {
+	topic := s.c.Queue
+	if d.RoutingKey != "" {
+		topic = strings.ReplaceAll(d.RoutingKey, ".", "/")
+	}
+	msg := &Message{
+		Topic:       topic,
+		Payload:     d.Body,
+		QoS:         1,
+		ReceivedAt:  time.Now(),
+		ContentType: d.ContentType,
+		ack: func() {
+			if err := d.Ack(false); err != nil {
+				slog.Warn("Failed to ack AMQP delivery", "queue", s.c.Queue, "error", err)
+			}
+		},
+	}
+	if d.CorrelationId != "" {
+		msg.CorrelationData = []byte(d.CorrelationId)
+	}
+	if len(d.Headers) > 0 {
+		msg.UserProperties = make(map[string]string, len(d.Headers))
+		for k, v := range d.Headers {
+			msg.UserProperties[k] = fmt.Sprint(v)
+		}
+	}
+	return msg
+}
+
+// Stop cancels the consumer. Its channel stays open, so deliveries still
+// being processed can be acked, and the next Start consumes on it again;
+// Close closes it, after which the broker requeues whatever wasn't acked
+// yet.
+func (s *amqpSource) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = nil
+	if s.ch != nil && s.tag != "" {
+		if err := s.ch.Cancel(s.tag, false); err != nil && !errors.Is(err, amqp.ErrClosed) {
+			slog.Warn("Failed to cancel AMQP consumer", "queue", s.c.Queue, "error", err)
+		}
+		s.tag = ""
+	}
+}
+
+func (s *amqpSource) IsConnected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn != nil && !s.conn.IsClosed()
+}
+
+func (s *amqpSource) Close() {
+	s.once.Do(func() { close(s.closed) })
+	s.Stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch != nil {
+		s.ch.Close()
+		s.ch = nil
+	}
+	if err := s.conn.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		slog.Warn("Failed to close AMQP connection", "queue", s.c.Queue, "error", err)
+	}
+}
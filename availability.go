@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// AvailabilityConfig announces whether the connector is online on an MQTT
+// topic. The connector publishes Online (its birth message) after every
+// connect and Offline when shutting down, and registers Offline as its last
+// will so the broker publishes it when the connector dies. PulsarTopic,
+// when set, additionally receives a JSON status event whenever the
+// connector starts or stops. Announcements are disabled without a Topic.
+type AvailabilityConfig struct {
+	Topic       string `yaml:"topic"`
+	Online      string `yaml:"online"`
+	Offline     string `yaml:"offline"`
+	QoS         byte   `yaml:"qos"`
+	Retain      bool   `yaml:"retain"`
+	PulsarTopic string `yaml:"pulsar_topic"`
+}
+
+func (c AvailabilityConfig) enabled() bool {
+	return c.Topic != ""
+}
+
+// announceAvailability publishes the connector's status at startup and
+// shutdown. Birth messages on the MQTT topic are sent by the MQTT clients
+// on every connect, so only going offline is published there.
+func announceAvailability(online bool) {
+	a := cfg.MQTT.Availability
+	if !a.enabled() {
+		return
+	}
+
+	status := a.Online
+	if !online {
+		status = a.Offline
+		if err := client.Publish(a.Topic, a.QoS, a.Retain, []byte(status)); err != nil {
+			slog.Warn("Failed to publish availability", "mqtt_topic", a.Topic, "error", err)
+		}
+	}
+
+	if a.PulsarTopic == "" || dryRun {
+		return
+	}
+	producer, ok := getOrCreateProducer(a.PulsarTopic, cfg.Pulsar.Producer, nil)
+	if !ok {
+		slog.Warn("Failed to get availability producer", "pulsar_topic", a.PulsarTopic)
+		return
+	}
+	payload, _ := json.Marshal(map[string]string{
+		"client_id": cfg.MQTT.ClientID,
+		"status":    status,
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := producer.Send(ctx, &pulsar.ProducerMessage{Payload: payload, Key: cfg.MQTT.ClientID}); err != nil {
+		slog.Warn("Failed to publish availability", "pulsar_topic", a.PulsarTopic, "error", err)
+	}
+}
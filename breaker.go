@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("pulsar circuit breaker open")
+
+// CircuitBreakerConfig stops sending to Pulsar after FailureThreshold
+// consecutive send failures. While open, messages go straight to the disk
+// buffer or dead-letter topic. After OpenTimeout a single probe message is
+// let through; the breaker closes if it succeeds and opens again otherwise.
+// A FailureThreshold of zero disables the breaker.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `yaml:"failure_threshold"`
+	OpenTimeout      time.Duration `yaml:"open_timeout"`
+}
+
+type breakerState int
+
+// The values are exported as the pulsar_circuit_breaker_state gauge.
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+type circuitBreaker struct {
+	cfg CircuitBreakerConfig
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(c CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{cfg: c}
+}
+
+// Allow reports whether a message may be sent to Pulsar. Once the open
+// timeout has passed, the first caller becomes the probe.
+func (b *circuitBreaker) Allow() bool {
+	if b.cfg.FailureThreshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cfg.OpenTimeout {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// Success records a successful send and closes the breaker.
+func (b *circuitBreaker) Success() {
+	if b.cfg.FailureThreshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	if b.state != breakerClosed {
+		b.setState(breakerClosed)
+	}
+}
+
+// Failure records a failed send, opening the breaker once the threshold is
+// reached or when the probe failed.
+func (b *circuitBreaker) Failure() {
+	if b.cfg.FailureThreshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.cfg.FailureThreshold) {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState changes the state. Callers must hold mu.
+func (b *circuitBreaker) setState(s breakerState) {
+	slog.Info("Pulsar circuit breaker changed state", "from", b.state, "to", s)
+	b.state = s
+	circuitBreakerState.Set(float64(s))
+}
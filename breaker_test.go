@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// Steps: allow and deny check Allow, fail and succeed record sends,
+	// expire lets the open timeout pass.
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []string
+		want      breakerState
+	}{
+		{"disabled", 0, []string{"fail", "fail", "fail", "allow"}, breakerClosed},
+		{"below threshold", 3, []string{"fail", "fail", "allow"}, breakerClosed},
+		{"success resets failures", 3, []string{"fail", "fail", "succeed", "fail", "fail", "allow"}, breakerClosed},
+		{"opens at threshold", 3, []string{"fail", "fail", "fail", "deny"}, breakerOpen},
+		{"probe after timeout", 2, []string{"fail", "fail", "expire", "allow", "deny"}, breakerHalfOpen},
+		{"probe success closes", 2, []string{"fail", "fail", "expire", "allow", "succeed", "allow", "allow"}, breakerClosed},
+		{"probe failure reopens", 2, []string{"fail", "fail", "expire", "allow", "fail", "deny"}, breakerOpen},
+		{"reopened waits again", 2, []string{"fail", "fail", "expire", "allow", "fail", "expire", "allow"}, breakerHalfOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(CircuitBreakerConfig{FailureThreshold: tt.threshold, OpenTimeout: time.Minute})
+			for i, step := range tt.steps {
+				switch step {
+				case "allow", "deny":
+					if got := b.Allow(); got != (step == "allow") {
+						t.Fatalf("step %d: Allow() = %v, want %v", i, got, !got)
+					}
+				case "fail":
+					b.Failure()
+				case "succeed":
+					b.Success()
+				case "expire":
+					b.openedAt = b.openedAt.Add(-time.Hour)
+				}
+			}
+			if b.state != tt.want {
+				t.Errorf("state = %s, want %s", b.state, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultBridge is the name of the bridge formed by the top-level
+// subscriptions, transforms and mapping.
+const defaultBridge = "default"
+
+// BridgeConfig defines a named bridge: a source with its own transform
+// chain, topic mapping and sink, processed independently of the default
+// bridge and counted separately in bridge_messages.
+//
+// Source is the bridge's subscriptions on the primary broker unless set to
+// an AMQP queue. Sink is Pulsar unless set; the default bridge always
+// produces to Pulsar. The mapping takes its default template, tenant,
+// namespace and segment names from the top-level mapping unless it sets
+// them. Filters, validation and producer settings are shared by all
+// bridges. A reload can change a bridge's transforms, mapping and sink,
+// but not the set of bridges or their sources; such a reload is rejected.
+type BridgeConfig struct {
+	Name          string          `yaml:"name"`
+	Subscriptions []Subscription  `yaml:"subscriptions"`
+	Transforms    []TransformRule `yaml:"transforms"`
+	Mapping       MappingConfig   `yaml:"mapping"`
+	Source        SourceConfig    `yaml:"source"`
+	Sink          SinkConfig      `yaml:"sink"`
+}
+
+// mapping returns the bridge's mapping config with the settings it leaves
+// empty taken from top. Only bridges producing to Pulsar inherit the
+// default template, since it names Pulsar topics.
+func (b BridgeConfig) mapping(top MappingConfig) MappingConfig {
+	m := b.Mapping
+	if m.Default == "" && b.Sink.pulsar() {
+		m.Default = top.Default
+	}
+	if m.Tenant == "" {
+		m.Tenant = top.Tenant
+	}
+	if m.Namespace == "" {
+		m.Namespace = top.Namespace
+	}
+	if m.Segments == nil {
+		m.Segments = top.Segments
+	}
+	return m
+}
+
+func validateBridges(c *Config) error {
+	filters := make(map[string]bool)
+	for _, s := range c.MQTT.Subscriptions {
+		filters[s.Filter] = true
+	}
+	names := make(map[string]bool)
+	for i, b := range c.Bridges {
+		switch {
+		case b.Name == "":
+			return fmt.Errorf("bridge %d: name is required", i)
+		case b.Name == defaultBridge:
+			return fmt.Errorf("bridge %d: name %q is reserved", i, defaultBridge)
+		case names[b.Name]:
+			return fmt.Errorf("bridge %s: duplicate name", b.Name)
+		case b.Source.Type == sourceAMQP && len(b.Subscriptions) > 0:
+			return fmt.Errorf("bridge %s: subscriptions can't be combined with an amqp source", b.Name)
+		case b.Source.Type != sourceAMQP && len(b.Subscriptions) == 0:
+			return fmt.Errorf("bridge %s: subscriptions are required", b.Name)
+		}
+		names[b.Name] = true
+		if err := b.Source.validate(); err != nil {
+			return fmt.Errorf("bridge %s: source: %w", b.Name, err)
+		}
+		if err := b.Sink.validate(); err != nil {
+			return fmt.Errorf("bridge %s: sink: %w", b.Name, err)
+		}
+		m := b.mapping(c.Mapping)
+		if m.Default != "" {
+			if err := b.Sink.validateTopic(m.Default); err != nil {
+				return fmt.Errorf("bridge %s: mapping.default: %w", b.Name, err)
+			}
+		}
+		for j, r := range m.Rules {
+			if err := b.Sink.validateTopic(r.Topic); err != nil {
+				return fmt.Errorf("bridge %s: mapping rule %d: %w", b.Name, j, err)
+			}
+		}
+		for _, s := range b.Subscriptions {
+			if s.Filter == "" || s.qos(c.MQTT.QoS) > 2 {
+				return fmt.Errorf("bridge %s: invalid subscription %q", b.Name, s.Filter)
+			}
+			// Connections track subscriptions by filter, so a filter can
+			// only feed one bridge
+			if filters[s.Filter] {
+				return fmt.Errorf("bridge %s: filter %s is already subscribed", b.Name, s.Filter)
+			}
+			filters[s.Filter] = true
+		}
+	}
+	return nil
+}
+
+// checkBridgeSet fails when next adds, removes or renames bridges, or
+// changes where one receives from, which a reload can't apply.
+func checkBridgeSet(old, next []BridgeConfig) error {
+	if len(old) != len(next) {
+		return errors.New("bridges can't be added or removed by a reload")
+	}
+	for i := range old {
+		switch {
+		case old[i].Name != next[i].Name:
+			return fmt.Errorf("bridge %s: bridges can't be renamed or reordered by a reload", old[i].Name)
+		case !reflect.DeepEqual(old[i].Subscriptions, next[i].Subscriptions) || !reflect.DeepEqual(old[i].Source, next[i].Source):
+			return fmt.Errorf("bridge %s: subscriptions and source can't be changed by a reload", old[i].Name)
+		}
+	}
+	return nil
+}
+
+// bridgePipeline is the per-bridge part of the processing pipeline.
+type bridgePipeline struct {
+	mapper     *topicMapper
+	transforms *transformPipeline
+	sink       *sharedSink
+}
+
+// sharedSink is a bridge's sink. A reload that leaves its config alone
+// hands it to the new pipeline, so it is closed, flushing what it holds,
+// once the last pipeline holding it is closed.
+type sharedSink struct {
+	Sink
+	config  SinkConfig
+	holders atomic.Int32
+}
+
+// defaultSink is the sink of the default bridge, which is never closed.
+var defaultSink = &sharedSink{Sink: pulsarSink{}}
+
+func newSharedSink(c SinkConfig) (*sharedSink, error) {
+	s, err := newSink(c)
+	if err != nil {
+		return nil, err
+	}
+	shared := &sharedSink{Sink: s, config: c}
+	shared.holders.Store(1)
+	return shared, nil
+}
+
+func (s *sharedSink) release() {
+	if s.holders.Add(-1) == 0 {
+		s.Sink.Close()
+	}
+}
+
+// newBridgePipelines builds the pipelines of c's bridges, keeping the
+// sinks of prev whose config is unchanged.
+func newBridgePipelines(c *Config, prev map[string]bridgePipeline) (map[string]bridgePipeline, error) {
+	pipelines := make(map[string]bridgePipeline, len(c.Bridges))
+	for _, b := range c.Bridges {
+		m, err := newTopicMapper(b.mapping(c.Mapping), b.Subscriptions)
+		if err != nil {
+			closeSinks(pipelines)
+			return nil, fmt.Errorf("bridge %s: invalid topic mapping: %w", b.Name, err)
+		}
+		t, err := newTransformPipeline(b.Transforms)
+		if err != nil {
+			closeSinks(pipelines)
+			return nil, fmt.Errorf("bridge %s: invalid transform configuration: %w", b.Name, err)
+		}
+		var s *sharedSink
+		if old, ok := prev[b.Name]; ok && reflect.DeepEqual(old.sink.config, b.Sink) {
+			s = old.sink
+			s.holders.Add(1)
+		} else if s, err = newSharedSink(b.Sink); err != nil {
+			t.Close()
+			closeSinks(pipelines)
+			return nil, fmt.Errorf("bridge %s: sink: %w", b.Name, err)
+		}
+		pipelines[b.Name] = bridgePipeline{mapper: m, transforms: t, sink: s}
+	}
+	return pipelines, nil
+}
+
+// closeSinks releases the sinks of pipelines, closing those no other
+// pipeline holds, and closes their transforms.
+func closeSinks(pipelines map[string]bridgePipeline) {
+	for _, p := range pipelines {
+		p.sink.release()
+		p.transforms.Close()
+	}
+}
+
+// bridge returns the pipeline of the bridge msg arrived on.
+func (p *pipeline) bridge(msg *Message) bridgePipeline {
+	if msg.bridge != "" {
+		if b, ok := p.bridges[msg.bridge]; ok {
+			return b
+		}
+	}
+	return bridgePipeline{mapper: p.mapper, transforms: p.transforms, sink: defaultSink}
+}
+
+// bridgeHandler returns the subscription callback for a named bridge.
+func bridgeHandler(name string) func(*Message) {
+	return func(msg *Message) {
+		msg.bridge = name
+		receiveMessage(msg)
+	}
+}
+
+// receiveSessionMessage handles a message that matches none of a
+// connection's subscriptions, which happens when a persistent session
+// delivers queued messages before the connector has subscribed again. It
+// is attributed to the bridge whose filter it matches.
+func receiveSessionMessage(msg *Message) {
+	if pool == nil {
+		// Not bridging, e.g. checking connectivity
+		return
+	}
+	configMu.RLock()
+	msg.bridge = bridgeFor(msg.Topic)
+	configMu.RUnlock()
+	receiveMessage(msg)
+}
+
+// bridgeFor returns the named bridge subscribed to topic, or "".
+func bridgeFor(topic string) string {
+	for _, b := range cfg.Bridges {
+		for _, s := range b.Subscriptions {
+			if topicMatches(s.Filter, topic) {
+				return b.Name
+			}
+		}
+	}
+	return ""
+}
+
+// subscribeBridges subscribes the named bridges on the primary broker.
+func subscribeBridges(client mqttConn) error {
+	var errs []error
+	for _, b := range cfg.Bridges {
+		for _, s := range b.Subscriptions {
+			qos := s.qos(cfg.MQTT.QoS)
+			if err := client.Subscribe(s.Filter, qos, bridgeHandler(b.Name)); err != nil {
+				errs = append(errs, fmt.Errorf("bridge %s: %s: %w", b.Name, s.Filter, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func unsubscribeBridges(client mqttConn) error {
+	var errs []error
+	for _, b := range cfg.Bridges {
+		for _, s := range b.Subscriptions {
+			if err := client.Unsubscribe(s.Filter); err != nil {
+				errs = append(errs, fmt.Errorf("bridge %s: %s: %w", b.Name, s.Filter, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// countBridge records a message outcome for the bridge msg arrived on.
+func countBridge(msg *Message, outcome string) {
+	name := msg.bridge
+	if name == "" {
+		name = defaultBridge
+	}
+	bridgeMessages.With(prometheus.Labels{"bridge": name, "outcome": outcome}).Inc()
+}
@@ -0,0 +1,44 @@
+package main
+
+// brokerConfigs returns the config of each additional broker with the
+// protocol version, QoS and client ID it leaves empty taken from c.
+func (c MQTTConfig) brokerConfigs() []MQTTConfig {
+	configs := make([]MQTTConfig, len(c.Brokers))
+	for i, b := range c.Brokers {
+		if b.ProtocolVersion == 0 {
+			b.ProtocolVersion = c.ProtocolVersion
+		}
+		if b.QoS == 0 {
+			b.QoS = c.QoS
+		}
+		if b.ClientID == "" {
+			b.ClientID = c.ClientID
+		}
+		configs[i] = b
+	}
+	return configs
+}
+
+// allSubscriptions returns the subscriptions of the primary broker followed
+// by those of every additional broker.
+func (c MQTTConfig) allSubscriptions() []Subscription {
+	subs := c.Subscriptions
+	for _, b := range c.Brokers {
+		subs = append(subs[:len(subs):len(subs)], b.Subscriptions...)
+	}
+	return subs
+}
+
+// anyMQTTConnected reports whether at least one broker connection is up,
+// so losing one of a pair of redundant brokers doesn't fail health checks.
+func anyMQTTConnected() bool {
+	if client != nil && client.IsConnected() {
+		return true
+	}
+	for _, s := range runningSources() {
+		if m, ok := s.Source.(*mqttSource); ok && m.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
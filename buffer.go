@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix  = ".seg"
+	maxSegmentSize = 4 << 20
+)
+
+var errBufferFull = errors.New("disk buffer is full")
+
+// BufferConfig configures the optional on-disk buffer that holds messages
+// while Pulsar is unavailable. Buffering is disabled when Dir is empty.
+type BufferConfig struct {
+	Dir            string        `yaml:"dir"`
+	MaxBytes       int64         `yaml:"max_bytes"`
+	Retention      time.Duration `yaml:"retention"`
+	ReplayInterval time.Duration `yaml:"replay_interval"`
+}
+
+// bufferedRecord is a message that could not be sent to Pulsar yet.
+type bufferedRecord struct {
+	MQTTTopic   string            `json:"mqtt_topic"`
+	PulsarTopic string            `json:"pulsar_topic"`
+	Payload     []byte            `json:"payload"`
+	Properties  map[string]string `json:"properties,omitempty"`
+	StoredAt    time.Time         `json:"stored_at"`
+}
+
+// diskBuffer is an append-only queue of length-prefixed JSON records split
+// into segment files. Segments are replayed oldest first and removed once
+// every record in them has been delivered, so delivery is at-least-once.
+type diskBuffer struct {
+	cfg BufferConfig
+
+	mu          sync.Mutex
+	current     *os.File
+	currentSize int64
+	totalSize   int64
+}
+
+func newDiskBuffer(c BufferConfig) (*diskBuffer, error) {
+	if err := os.MkdirAll(c.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("creating buffer dir %s: %w", c.Dir, err)
+	}
+
+	b := &diskBuffer{cfg: c}
+	segments, err := b.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range segments {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		b.totalSize += info.Size()
+	}
+	return b, nil
+}
+
+// Store appends a record to the current segment.
+func (b *diskBuffer) Store(r *bufferedRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	// Replay treats longer records as corruption
+	if len(data) > maxSegmentSize {
+		return fmt.Errorf("record of %d bytes exceeds the buffer segment size", len(data))
+	}
+	recordSize := int64(len(data) + 4)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cfg.MaxBytes > 0 && b.totalSize+recordSize > b.cfg.MaxBytes {
+		return errBufferFull
+	}
+	if b.current == nil || b.currentSize >= maxSegmentSize {
+		if err := b.rotate(); err != nil {
+			return err
+		}
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := b.current.Write(append(header[:], data...)); err != nil {
+		return err
+	}
+	b.currentSize += recordSize
+	b.totalSize += recordSize
+	return nil
+}
+
+// rotate closes the current segment and opens a new one. Callers must hold mu.
+func (b *diskBuffer) rotate() error {
+	if err := b.seal(); err != nil {
+		return err
+	}
+	name := filepath.Join(b.cfg.Dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), segmentSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	b.current = f
+	b.currentSize = 0
+	return nil
+}
+
+// seal closes the current segment so it becomes eligible for replay.
+// Callers must hold mu.
+func (b *diskBuffer) seal() error {
+	if b.current == nil {
+		return nil
+	}
+	err := b.current.Close()
+	b.current = nil
+	return err
+}
+
+func (b *diskBuffer) segments() ([]string, error) {
+	entries, err := os.ReadDir(b.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), segmentSuffix) {
+			names = append(names, filepath.Join(b.cfg.Dir, e.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Replay sends every buffered record through send, oldest first. It stops
+// at the first failure and leaves the remaining segments for a later run.
+func (b *diskBuffer) Replay(send func(*bufferedRecord) error) error {
+	// Seal and list under the lock so segments created afterwards, which
+	// may still be written to, are left alone.
+	b.mu.Lock()
+	err := b.seal()
+	var segments []string
+	if err == nil {
+		segments, err = b.segments()
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, name := range segments {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if err := b.replaySegment(name, send); err != nil {
+			return err
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		b.mu.Lock()
+		b.totalSize -= info.Size()
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+func (b *diskBuffer) replaySegment(name string, send func(*bufferedRecord) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			// A truncated trailing record is left behind by a crash
+			// mid-write; everything before it has been replayed.
+			slog.Warn("Truncated record in buffer segment", "segment", name, "error", err)
+			return nil
+		}
+		// A length beyond any segment is a torn or corrupt header, not a
+		// record to allocate for
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxSegmentSize {
+			slog.Warn("Truncated record in buffer segment", "segment", name, "error", fmt.Errorf("record length %d exceeds the segment size", size))
+			return nil
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			slog.Warn("Truncated record in buffer segment", "segment", name, "error", err)
+			return nil
+		}
+
+		var rec bufferedRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			slog.Error("Skipping corrupt buffered record", "segment", name, "error", err)
+			continue
+		}
+		if b.cfg.Retention > 0 && time.Since(rec.StoredAt) > b.cfg.Retention {
+			messagesBufferExpired.Inc()
+			continue
+		}
+		if err := send(&rec); err != nil {
+			return err
+		}
+	}
+}
+
+// run periodically replays the buffer while Pulsar is reachable.
+func (b *diskBuffer) run(ctx context.Context, send func(*bufferedRecord) error) {
+	ticker := time.NewTicker(b.cfg.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !pulsarHealthy.Load() {
+				continue
+			}
+			if err := b.Replay(send); err != nil {
+				slog.Warn("Buffer replay interrupted", "error", err)
+			}
+		}
+	}
+}
+
+// Size returns the number of bytes currently buffered on disk.
+func (b *diskBuffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.totalSize
+}
+
+func (b *diskBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.seal()
+}
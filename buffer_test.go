@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// frame returns data as a length-prefixed record.
+func frame(data []byte) []byte {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	return append(header[:], data...)
+}
+
+func TestDiskBufferReplayFraming(t *testing.T) {
+	tests := []struct {
+		name string
+		tail []byte
+		want []string
+	}{
+		{"clean", nil, []string{"a", "b"}},
+		{"truncated header", []byte{0, 0}, []string{"a", "b"}},
+		{"truncated record", frame([]byte(`{"mqtt_topic":"c"}`))[:10], []string{"a", "b"}},
+		{"length beyond segment size", []byte{0xff, 0xff, 0xff, 0xff, '{', '}'}, []string{"a", "b"}},
+		{"corrupt record is skipped", append(frame([]byte("not json")), frame([]byte(`{"mqtt_topic":"c"}`))...), []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newDiskBuffer(BufferConfig{Dir: t.TempDir()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, topic := range []string{"a", "b"} {
+				if err := b.Store(&bufferedRecord{MQTTTopic: topic, StoredAt: time.Now()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := b.current.Write(tt.tail); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			err = b.Replay(func(r *bufferedRecord) error {
+				got = append(got, r.MQTTTopic)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("replayed %v, want %v", got, tt.want)
+			}
+			if segments, _ := b.segments(); len(segments) != 0 {
+				t.Errorf("%d segments left after replay", len(segments))
+			}
+		})
+	}
+}
+
+func TestDiskBufferReplayStopsAtFailure(t *testing.T) {
+	b, err := newDiskBuffer(BufferConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Store(&bufferedRecord{MQTTTopic: "a", StoredAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	errSend := errors.New("send failed")
+	if err := b.Replay(func(*bufferedRecord) error { return errSend }); !errors.Is(err, errSend) {
+		t.Fatalf("Replay() = %v, want %v", err, errSend)
+	}
+
+	// The record is kept for the next replay
+	var got []string
+	if err := b.Replay(func(r *bufferedRecord) error { got = append(got, r.MQTTTopic); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{"a"}) {
+		t.Errorf("replayed %v, want [a]", got)
+	}
+}
+
+func TestDiskBufferLimits(t *testing.T) {
+	b, err := newDiskBuffer(BufferConfig{Dir: t.TempDir(), MaxBytes: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := b.Store(&bufferedRecord{MQTTTopic: "a", Payload: make([]byte, 150)}); !errors.Is(err, errBufferFull) {
+		t.Errorf("Store() over max_bytes = %v, want %v", err, errBufferFull)
+	}
+
+	b.cfg.MaxBytes = 0
+	if err := b.Store(&bufferedRecord{MQTTTopic: "a", Payload: make([]byte, maxSegmentSize)}); err == nil {
+		t.Error("Store() accepted a record larger than a segment")
+	}
+	if size := b.Size(); size != 0 {
+		t.Errorf("Size() = %d after rejected records, want 0", size)
+	}
+}
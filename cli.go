@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+func newRootCommand() *cobra.Command {
+	var configPath string
+
+	runCmd := &cobra.Command{
+		Use:   "run",
+		Short: "Bridge messages between MQTT and Pulsar",
+		Args:  cobra.NoArgs,
+		Run: func(*cobra.Command, []string) {
+			run(configPath)
+		},
+	}
+
+	root := &cobra.Command{
+		Use:          "mqtt-pulsar-connector",
+		Short:        "Bridge MQTT messages to Apache Pulsar",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		// Without a subcommand the connector runs, as it always has
+		Run: runCmd.Run,
+	}
+	_, defaultConfigPath, _ := lookupEnv("CONFIG_FILE")
+	root.PersistentFlags().StringVar(&configPath, "config", defaultConfigPath, "path to the YAML config file")
+	for _, cmd := range []*cobra.Command{root, runCmd} {
+		cmd.Flags().BoolVar(&dryRun, "dry-run", false, "log what would be produced to Pulsar without creating producers")
+	}
+
+	replay := replayOptions{}
+	replayCmd := &cobra.Command{
+		Use:   "replay-dead-letters",
+		Short: "Send dead-lettered messages through the pipeline again",
+		Args:  cobra.NoArgs,
+		RunE: func(*cobra.Command, []string) error {
+			if err := initConfig(configPath); err != nil {
+				return err
+			}
+			return replayDeadLetters(replay)
+		},
+	}
+	replayCmd.Flags().StringVar(&replay.Topic, "topic", "", "dead-letter topic to read (default dead_letter.topic)")
+	replayCmd.Flags().StringVar(&replay.Subscription, "subscription", "mqtt-pulsar-connector-replay", "subscription used to read the dead-letter topic")
+	replayCmd.Flags().Float64Var(&replay.Rate, "rate", 0, "maximum messages replayed per second, 0 for no limit")
+	replayCmd.Flags().DurationVar(&replay.IdleTimeout, "idle-timeout", 10*time.Second, "stop after no message has arrived for this long")
+	replayCmd.Flags().BoolVar(&replay.SkipTransforms, "skip-transforms", false, "skip the transform chain, for payloads dead-lettered after transformation")
+	replayCmd.Flags().BoolVar(&dryRun, "dry-run", false, "log where messages would be produced without producing or acking them")
+
+	root.AddCommand(
+		runCmd,
+		replayCmd,
+		&cobra.Command{
+			Use:     "validate",
+			Aliases: []string{"validate-config"},
+			Short:   "Check the config and routing rules without connecting to MQTT or Pulsar",
+			Long: "Check every setting the connector would check on startup, such as URLs, " +
+				"topic templates, regexes and schema files, and list all problems at once. " +
+				"With remote config enabled, it is fetched from Consul or etcd and checked too.",
+			Args: cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, _ []string) error {
+				return validateConfig(cmd, configPath)
+			},
+		},
+		&cobra.Command{
+			Use:   "version",
+			Short: "Print the version",
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, _ []string) {
+				cmd.Println(versionString())
+			},
+		},
+		newHealthcheckCommand(&configPath),
+		&cobra.Command{
+			Use:   "check-connectivity",
+			Short: "Connect to the MQTT broker and the Pulsar clusters, then exit",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, _ []string) error {
+				if err := initConfig(configPath); err != nil {
+					return err
+				}
+				return checkConnectivity(cmd)
+			},
+		},
+	)
+	return root
+}
+
+// validateConfig loads the config at path and builds the pipeline from it,
+// printing every problem found on the way.
+func validateConfig(cmd *cobra.Command, path string) error {
+	c, err := readConfig(path)
+	problems := unknownFields(path)
+	problems = append(problems, flattenErrors(err)...)
+	if c != nil {
+		problems = append(problems, flattenErrors(c.validate())...)
+		cfg = c
+		problems = append(problems, flattenErrors(initPipeline())...)
+	}
+
+	if len(problems) == 0 {
+		cmd.Println("Config is valid")
+		return nil
+	}
+	for _, p := range problems {
+		cmd.PrintErrln("  -", p)
+	}
+	return fmt.Errorf("config has %d problem(s)", len(problems))
+}
+
+// unknownFields lists keys in the config file that no setting reads, which
+// are usually typos. The connector itself ignores them. Values of the wrong
+// type are left to readConfig.
+func unknownFields(path string) []string {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var typeErr *yaml.TypeError
+	var unknown []string
+	if err := dec.Decode(defaultConfig()); errors.As(err, &typeErr) {
+		for _, e := range typeErr.Errors {
+			if strings.Contains(e, "not found in type") {
+				unknown = append(unknown, e)
+			}
+		}
+	}
+	return unknown
+}
+
+// flattenErrors splits joined errors into one message each, keeping the
+// context they were wrapped with.
+func flattenErrors(err error) []string {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var messages []string
+		for _, e := range joined.Unwrap() {
+			messages = append(messages, flattenErrors(e)...)
+		}
+		return messages
+	}
+	if inner := errors.Unwrap(err); inner != nil && strings.HasSuffix(err.Error(), inner.Error()) {
+		prefix := strings.TrimSuffix(err.Error(), inner.Error())
+		messages := flattenErrors(inner)
+		for i := range messages {
+			messages[i] = prefix + messages[i]
+		}
+		return messages
+	}
+	return []string{err.Error()}
+}
+
+func versionString() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return fmt.Sprintf("%s (%s)", version, info.GoVersion)
+	}
+	return version
+}
+
+func newHealthcheckCommand(configPath *string) *cobra.Command {
+	var (
+		url     string
+		ready   bool
+		timeout time.Duration
+	)
+	cmd := &cobra.Command{
+		Use:   "healthcheck",
+		Short: "Query the local health endpoint and fail unless MQTT and Pulsar are up",
+		Long: "Query the health endpoint of a connector running on this host, e.g. as a Docker\n" +
+			"HEALTHCHECK or Nomad check. Exits non-zero when it reports a failure or is unreachable.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if url == "" {
+				// Only the metrics address is needed, so the check
+				// doesn't depend on the remote config store or Vault
+				c, err := readLocalConfig(*configPath)
+				if err != nil {
+					return fmt.Errorf("loading config: %w", err)
+				}
+				url = healthURL(c.Metrics, ready)
+			}
+			return healthcheck(cmd, url, timeout)
+		},
+	}
+	cmd.Flags().StringVar(&url, "url", "", "health endpoint to query (default derived from the metrics config)")
+	cmd.Flags().BoolVar(&ready, "ready", false, "query the readiness probe, which also fails while the queue is full")
+	cmd.Flags().DurationVar(&timeout, "timeout", 5*time.Second, "how long to wait for the endpoint")
+	return cmd
+}
+
+// healthURL returns the local URL of the liveness or readiness probe.
+func healthURL(c MetricsConfig, ready bool) string {
+	scheme := "http"
+	if c.TLS.enabled() {
+		scheme = "https"
+	}
+	host := c.Address
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	path := "/healthz"
+	if ready {
+		path = "/readyz"
+	}
+	return scheme + "://" + net.JoinHostPort(host, c.Port) + path
+}
+
+// healthcheck fails unless url responds with 200 OK, printing the report.
+// The certificate isn't verified, since the connector is local and often
+// serves a certificate for its external name.
+func healthcheck(cmd *cobra.Command, url string, timeout time.Duration) error {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	cmd.Print(string(body))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unhealthy: %s", resp.Status)
+	}
+	return nil
+}
+
+// probeConfig returns c for a connection that only checks the broker is
+// reachable. It must not take over the running connector's connection or
+// session, so it uses a client ID of its own, and it must not announce the
+// connector as online or, through the last will, offline.
+func probeConfig(c MQTTConfig) MQTTConfig {
+	id := c.ClientID
+	if id == "" {
+		id = "mqtt-pulsar-connector"
+	}
+	c.ClientID = fmt.Sprintf("%s-check-%d", id, os.Getpid())
+	c.PersistentSession = false
+	c.Availability = AvailabilityConfig{}
+	return c
+}
+
+// checkConnectivity connects to every configured endpoint and reports the
+// outcome of each.
+func checkConnectivity(cmd *cobra.Command) error {
+	var errs []error
+	report := func(name string, err error) {
+		if err != nil {
+			cmd.Printf("%-8s FAIL  %v\n", name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		cmd.Printf("%-8s OK\n", name)
+	}
+
+	if cfg.Vault.Address != "" {
+		_, err := applyVaultSecrets(context.Background(), cfg)
+		report("vault", err)
+	}
+
+	conn, err := connectMQTT(probeConfig(cfg.MQTT))
+	if err == nil {
+		conn.Disconnect()
+	}
+	report("mqtt", err)
+	for i, bc := range cfg.MQTT.brokerConfigs() {
+		conn, err := connectMQTT(probeConfig(bc))
+		if err == nil {
+			conn.Disconnect()
+		}
+		report(fmt.Sprintf("mqtt[%d]", i+1), err)
+	}
+	for _, b := range cfg.Bridges {
+		if b.Source.Type != sourceAMQP {
+			continue
+		}
+		src, err := newAMQPSource(b.Source.AMQP)
+		if err == nil {
+			src.Close()
+		}
+		report("amqp["+b.Name+"]", err)
+	}
+
+	clusters, err := newClusterClient(cfg.Pulsar)
+	if err != nil {
+		report("pulsar", err)
+	} else {
+		defer clusters.Close()
+		for i, c := range clusters.clients {
+			_, err := c.TopicPartitions(cfg.Pulsar.Failover.ProbeTopic)
+			report(fmt.Sprintf("pulsar[%d]", i), err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestFlattenErrors(t *testing.T) {
+	a, b, c := errors.New("a"), errors.New("b"), errors.New("c")
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{"nil", nil, nil},
+		{"single", a, []string{"a"}},
+		{"joined", errors.Join(a, b), []string{"a", "b"}},
+		{"nested join", errors.Join(a, errors.Join(b, c)), []string{"a", "b", "c"}},
+		{"wrapped join", fmt.Errorf("remote config: %w", errors.Join(a, b)), []string{"remote config: a", "remote config: b"}},
+		{"double wrap", fmt.Errorf("x: %w", fmt.Errorf("y: %w", errors.Join(a, b))), []string{"x: y: a", "x: y: b"}},
+		{"wrapped in the middle", fmt.Errorf("x: %w (retrying)", errors.Join(a, b)), []string{"x: a\nb (retrying)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := flattenErrors(tt.err); !slices.Equal(got, tt.want) {
+				t.Errorf("flattenErrors() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
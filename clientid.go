@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Client ID placeholders and suffixes. Brokers disconnect a client when
+// another connects with the same ID, so replicas sharing a static ID keep
+// taking over each other's connection.
+const (
+	clientIDHostname = "hostname"
+	clientIDPod      = "pod"
+	clientIDRandom   = "random"
+)
+
+// resolveClientID makes id unique per replica: {hostname}, {pod} and
+// {random} in id are expanded, and suffix, one of the same names, appends
+// the corresponding value after a dash. {pod} is the POD_NAME environment
+// variable, falling back to the hostname; {random} is chosen once per
+// process start.
+func resolveClientID(id, suffix string) (string, error) {
+	if suffix != "" {
+		switch suffix {
+		case clientIDHostname, clientIDPod, clientIDRandom:
+		default:
+			return "", fmt.Errorf("unknown client ID suffix %q", suffix)
+		}
+		id += "-{" + suffix + "}"
+	}
+
+	var err error
+	expand := func(name string, value func() (string, error)) {
+		ph := "{" + name + "}"
+		if err != nil || !strings.Contains(id, ph) {
+			return
+		}
+		var v string
+		if v, err = value(); err == nil {
+			id = strings.ReplaceAll(id, ph, v)
+		}
+	}
+	expand(clientIDHostname, os.Hostname)
+	expand(clientIDPod, podName)
+	expand(clientIDRandom, randomSuffix)
+	return id, err
+}
+
+func podName() (string, error) {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name, nil
+	}
+	return os.Hostname()
+}
+
+func randomSuffix() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// contentEncodingProperty marks gzipped payloads for Pulsar consumers.
+const contentEncodingProperty = "content-encoding"
+
+// newGunzipTransformer decompresses gzipped payloads and forwards others
+// as they are, since gateways often gzip only some of their messages.
+// MaxBytes bounds the decompressed size.
+func newGunzipTransformer(step TransformStep) (Transformer, error) {
+	if step.MaxBytes < 0 {
+		return nil, errors.New("gunzip max_bytes must not be negative")
+	}
+	return TransformerFunc(func(msg *Message) error {
+		if len(msg.Payload) < 2 || msg.Payload[0] != 0x1f || msg.Payload[1] != 0x8b {
+			return nil
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(msg.Payload))
+		if err != nil {
+			return fmt.Errorf("payload is not valid gzip: %w", err)
+		}
+		defer zr.Close()
+
+		var r io.Reader = zr
+		if step.MaxBytes > 0 {
+			r = io.LimitReader(zr, int64(step.MaxBytes)+1)
+		}
+		payload, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("payload is not valid gzip: %w", err)
+		}
+		if step.MaxBytes > 0 && len(payload) > step.MaxBytes {
+			return fmt.Errorf("decompressed payload exceeds %d bytes", step.MaxBytes)
+		}
+		msg.Payload = payload
+		return nil
+	}), nil
+}
+
+// newGzipTransformer compresses payloads at Level, the gzip default when
+// zero, and sets the content-encoding property.
+func newGzipTransformer(step TransformStep) (Transformer, error) {
+	level := step.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return TransformerFunc(func(msg *Message) error {
+		var b bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&b, level)
+		if _, err := zw.Write(msg.Payload); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		msg.Payload = b.Bytes()
+		if msg.UserProperties == nil {
+			msg.UserProperties = make(map[string]string)
+		}
+		msg.UserProperties[contentEncodingProperty] = "gzip"
+		return nil
+	}), nil
+}
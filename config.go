@@ -0,0 +1,1029 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds all connector settings. It is loaded from a YAML file and
+// individual values can be overridden through environment variables.
+type Config struct {
+	MQTT           MQTTConfig           `yaml:"mqtt"`
+	Pulsar         PulsarConfig         `yaml:"pulsar"`
+	Mapping        MappingConfig        `yaml:"mapping"`
+	Transforms     []TransformRule      `yaml:"transforms"`
+	Filters        []FilterRule         `yaml:"filters"`
+	Topics         TopicACLConfig       `yaml:"topics"`
+	Bridges        []BridgeConfig       `yaml:"bridges"`
+	Heartbeat      HeartbeatConfig      `yaml:"heartbeat"`
+	SchemaRegistry SchemaRegistryConfig `yaml:"schema_registry"`
+	Validation     ValidationConfig     `yaml:"validation"`
+	RateLimit      RateLimitConfig      `yaml:"rate_limit"`
+	Dedup          DedupConfig          `yaml:"dedup"`
+	PayloadLimit   PayloadLimitConfig   `yaml:"payload_limit"`
+	Processing     ProcessingConfig     `yaml:"processing"`
+	Shutdown       ShutdownConfig       `yaml:"shutdown"`
+	DeadLetter     DeadLetterConfig     `yaml:"dead_letter"`
+	Buffer         BufferConfig         `yaml:"buffer"`
+	WAL            WALConfig            `yaml:"wal"`
+	Reverse        ReverseConfig        `yaml:"reverse"`
+	Retry          RetryConfig          `yaml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Metrics        MetricsConfig        `yaml:"metrics"`
+	Profiling      ProfilingConfig      `yaml:"profiling"`
+	Log            LogConfig            `yaml:"log"`
+	Tracing        TracingConfig        `yaml:"tracing"`
+	Admin          AdminConfig          `yaml:"admin"`
+	LeaderElection LeaderElectionConfig `yaml:"leader_election"`
+	Vault          VaultConfig          `yaml:"vault"`
+	Rotation       RotationConfig       `yaml:"rotation"`
+	Remote         RemoteConfig         `yaml:"remote"`
+	Control        ControlConfig        `yaml:"control"`
+}
+
+type MQTTConfig struct {
+	// BrokerURL is a tcp://, ssl://, mqtt://, mqtts://, ws:// or wss:// URL.
+	// WebSocket URLs include the path of the listener, e.g.
+	// wss://broker.example.com/mqtt.
+	BrokerURL string `yaml:"broker_url"`
+	// ClientID may contain {hostname}, {pod} or {random} to give each
+	// replica its own ID; ClientIDSuffix appends one of them instead.
+	ClientID       string    `yaml:"client_id"`
+	ClientIDSuffix string    `yaml:"client_id_suffix"`
+	Username       string    `yaml:"username"`
+	Password       string    `yaml:"password"`
+	TLS            TLSConfig `yaml:"tls"`
+	// ProtocolVersion selects MQTT 3.1 (3), 3.1.1 (4) or 5. Defaults to 3.1.1.
+	ProtocolVersion uint `yaml:"protocol_version"`
+	// QoS is the default QoS for subscriptions that don't set their own.
+	QoS byte `yaml:"qos"`
+	// Subscriptions lists the topic filters to bridge. Defaults to device/#.
+	Subscriptions []Subscription `yaml:"subscriptions"`
+	// ManualAck defers acknowledging QoS 1/2 messages until they have been
+	// persisted in Pulsar, so the broker redelivers anything lost in between.
+	ManualAck bool `yaml:"manual_ack"`
+	// ReceiveMaximum caps the QoS 1/2 messages an MQTT 5 broker sends
+	// before they are acked, so when Pulsar falls behind the broker queues
+	// them rather than the connector. With manual_ack it defaults to
+	// processing.queue_size, which keeps the queue from ever filling up.
+	// MQTT 3 brokers apply their own inflight limit instead.
+	ReceiveMaximum int `yaml:"receive_maximum"`
+	// ShareGroup, when set, subscribes through $share/<group>/ so replicas
+	// in the same group split the messages between them.
+	ShareGroup string `yaml:"share_group"`
+	// WebSocketHeaders are added to the WebSocket handshake request for
+	// ws:// and wss:// brokers, e.g. for a load balancer's auth header.
+	WebSocketHeaders map[string]string  `yaml:"websocket_headers"`
+	Availability     AvailabilityConfig `yaml:"availability"`
+	// PersistentSession connects without a clean session, so the broker
+	// keeps the subscriptions and queues QoS 1/2 messages published while
+	// the connector restarts. It requires a fixed client ID. SessionExpiry
+	// is how long an MQTT 5 broker keeps the session after a disconnect;
+	// unset, it is kept indefinitely.
+	PersistentSession bool          `yaml:"persistent_session"`
+	SessionExpiry     time.Duration `yaml:"session_expiry"`
+	// Retained decides what happens to retained messages the broker sends
+	// on subscribing, which are stale values rather than fresh telemetry:
+	// forward (the default) bridges them like any other message, skip drops
+	// them and tag bridges them with an mqtt_stale property set to true.
+	Retained string `yaml:"retained"`
+	// Brokers are further brokers bridged into the same pipeline, e.g. the
+	// second of two redundant brokers at an edge site. Each is configured
+	// like this section, with its own credentials and subscriptions, and
+	// takes the protocol version, QoS and client ID from this section
+	// unless it sets them. Messages both brokers deliver are bridged twice
+	// unless dedup is enabled. Their subscriptions are not reloaded.
+	Brokers []MQTTConfig `yaml:"brokers"`
+}
+
+// Retained message policies.
+const (
+	retainedForward = "forward"
+	retainedSkip    = "skip"
+	retainedTag     = "tag"
+)
+
+// webSocketHeader returns WebSocketHeaders as an http.Header.
+func (c MQTTConfig) webSocketHeader() http.Header {
+	h := make(http.Header, len(c.WebSocketHeaders))
+	for k, v := range c.WebSocketHeaders {
+		h.Set(k, v)
+	}
+	return h
+}
+
+// randomClientID reports whether the client ID changes on every start.
+func (c *MQTTConfig) randomClientID() bool {
+	return c.ClientIDSuffix == clientIDRandom || strings.Contains(c.ClientID, "{"+clientIDRandom+"}")
+}
+
+// resolveClientIDs resolves the client ID of this broker and of the
+// additional ones.
+func (c *MQTTConfig) resolveClientIDs() error {
+	random := c.randomClientID()
+	if c.PersistentSession && random {
+		return fmt.Errorf("mqtt.persistent_session requires a client ID that is the same after a restart")
+	}
+	for i, b := range c.Brokers {
+		// Brokers without a client ID take this one
+		if b.PersistentSession && (b.randomClientID() || b.ClientID == "" && random) {
+			return fmt.Errorf("mqtt.brokers[%d].persistent_session requires a client ID that is the same after a restart", i)
+		}
+	}
+	var err error
+	if c.ClientID, err = resolveClientID(c.ClientID, c.ClientIDSuffix); err != nil {
+		return fmt.Errorf("mqtt.client_id: %w", err)
+	}
+	for i := range c.Brokers {
+		b := &c.Brokers[i]
+		if b.ClientID, err = resolveClientID(b.ClientID, b.ClientIDSuffix); err != nil {
+			return fmt.Errorf("mqtt.brokers[%d].client_id: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// brokerFilter returns the filter to send to the broker for a subscription,
+// adding the shared subscription prefix when a share group is configured.
+func (c MQTTConfig) brokerFilter(filter string) string {
+	if c.ShareGroup == "" {
+		return filter
+	}
+	return "$share/" + c.ShareGroup + "/" + filter
+}
+
+// TLSConfig describes the certificates used for a TLS (or mutual TLS)
+// connection. TLS is enabled as soon as any of the fields is set.
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// Subscription is a single MQTT topic filter. When Topic is set it is used
+// as the Pulsar topic template for messages received on this filter, ahead
+// of the global mapping rules.
+type Subscription struct {
+	Filter string `yaml:"filter"`
+	QoS    *byte  `yaml:"qos"`
+	Topic  string `yaml:"topic"`
+}
+
+// qos returns the subscription's QoS, falling back to the given default.
+func (s Subscription) qos(fallback byte) byte {
+	if s.QoS != nil {
+		return *s.QoS
+	}
+	return fallback
+}
+
+type PulsarConfig struct {
+	URL           string              `yaml:"url"`
+	ListenerName  string              `yaml:"listener_name"`
+	TLS           PulsarTLSConfig     `yaml:"tls"`
+	Auth          PulsarAuthConfig    `yaml:"auth"`
+	Producer      ProducerConfig      `yaml:"producer"`
+	ProducerCache ProducerCacheConfig `yaml:"producer_cache"`
+	Transactions  TransactionConfig   `yaml:"transactions"`
+	Failover      FailoverConfig      `yaml:"failover"`
+}
+
+// primary returns the connection settings of the primary cluster.
+func (c PulsarConfig) primary() PulsarClusterConfig {
+	return PulsarClusterConfig{URL: c.URL, ListenerName: c.ListenerName, TLS: c.TLS, Auth: c.Auth}
+}
+
+type PulsarTLSConfig struct {
+	TrustCertsFile   string `yaml:"trust_certs_file"`
+	AllowInsecure    bool   `yaml:"allow_insecure"`
+	ValidateHostname bool   `yaml:"validate_hostname"`
+}
+
+// PulsarAuthConfig configures token authentication. Token takes precedence
+// over TokenFile when both are set.
+type PulsarAuthConfig struct {
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+
+	// tokenSupplier, when set, provides a token that may change at runtime
+	// and takes precedence over the other fields.
+	tokenSupplier func() (string, error)
+}
+
+// ProcessingConfig controls the worker pool that sends messages to Pulsar.
+//
+// Dispatch is shared, where any worker takes the next message, or key,
+// where messages with the same ShardKey (by default the MQTT topic) are
+// handled by the same worker, preserving e.g. per-device ordering. Retried
+// sends can still overtake, so strict ordering also needs retry.max_attempts
+// set to 1.
+//
+// Overflow is what happens to messages arriving at a full queue: block
+// (the default) holds up the MQTT client, drop_newest drops the arriving
+// message and drop_oldest the longest queued one, which needs a QueueSize.
+// Dropped messages are acked and lost.
+type ProcessingConfig struct {
+	Workers   int       `yaml:"workers"`
+	QueueSize int       `yaml:"queue_size"`
+	Dispatch  string    `yaml:"dispatch"`
+	ShardKey  KeyConfig `yaml:"shard_key"`
+	Overflow  string    `yaml:"overflow"`
+}
+
+const (
+	dispatchShared = "shared"
+	dispatchKey    = "key"
+)
+
+// shardKey returns the key messages are dispatched by, or nil for shared
+// dispatch.
+func (c ProcessingConfig) shardKey() func(*Message) string {
+	if c.Dispatch != dispatchKey {
+		return nil
+	}
+	return func(msg *Message) string {
+		if key := c.ShardKey.derive(msg); key != "" {
+			return key
+		}
+		return msg.Topic
+	}
+}
+
+// ShutdownConfig bounds how long shutdown waits for queued and in-flight
+// messages to reach Pulsar before closing the clients.
+type ShutdownConfig struct {
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+}
+
+type MetricsConfig struct {
+	// Address is the interface to bind to; all interfaces when empty.
+	Address string            `yaml:"address"`
+	Port    string            `yaml:"port"`
+	TLS     MetricsTLSConfig  `yaml:"tls"`
+	Auth    MetricsAuthConfig `yaml:"auth"`
+	// DisablePrometheus stops serving /metrics, for deployments that only
+	// export over OTLP. The health probes are served regardless.
+	DisablePrometheus bool              `yaml:"disable_prometheus"`
+	OTLP              OTLPMetricsConfig `yaml:"otlp"`
+	// PayloadTimestamp, when set, additionally measures latency from a
+	// device timestamp embedded in the payload.
+	PayloadTimestamp TimestampConfig `yaml:"payload_timestamp"`
+	// MaxTopicLabels caps the distinct topics the per-topic received and
+	// byte counters are labeled with; further topics are counted as
+	// "other". Zero removes the cap.
+	MaxTopicLabels int          `yaml:"max_topic_labels"`
+	Health         HealthConfig `yaml:"health"`
+}
+
+// ProfilingConfig configures continuous profiling with Pyroscope, which is
+// enabled by setting ServerAddress. BasicAuth and TenantID are needed for
+// Grafana Cloud and multi-tenant Pyroscope servers.
+type ProfilingConfig struct {
+	ServerAddress     string            `yaml:"server_address"`
+	ApplicationName   string            `yaml:"application_name"`
+	BasicAuthUser     string            `yaml:"basic_auth_user"`
+	BasicAuthPassword string            `yaml:"basic_auth_password"`
+	TenantID          string            `yaml:"tenant_id"`
+	Tags              map[string]string `yaml:"tags"`
+	Pprof             PprofConfig       `yaml:"pprof"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		MQTT: MQTTConfig{
+			Retained: retainedForward,
+			Availability: AvailabilityConfig{
+				Online:  "online",
+				Offline: "offline",
+				Retain:  true,
+			},
+		},
+		Pulsar: PulsarConfig{
+			ListenerName: "internal",
+			ProducerCache: ProducerCacheConfig{
+				MaxProducers: 10000,
+				IdleTimeout:  10 * time.Minute,
+			},
+			Transactions: TransactionConfig{
+				BatchSize:    100,
+				BatchTimeout: 100 * time.Millisecond,
+				Timeout:      time.Minute,
+			},
+			Failover: FailoverConfig{
+				FailureTimeout: 30 * time.Second,
+				ProbeInterval:  30 * time.Second,
+				ProbeTopic:     "persistent://public/default/mqtt-pulsar-connector-probe",
+			},
+			Producer: ProducerConfig{
+				SendTimeout: 30 * time.Second,
+				Batching: BatchingConfig{
+					Enabled:         true,
+					MaxMessages:     1000,
+					MaxBytes:        128 << 10,
+					MaxPublishDelay: 10 * time.Millisecond,
+				},
+			},
+		},
+		Mapping: MappingConfig{
+			Default:     defaultTopicTemplate,
+			Tenant:      "public",
+			Namespace:   "default",
+			SchemaCheck: schemaCheckWarn,
+		},
+		Processing: ProcessingConfig{
+			Workers:   8,
+			QueueSize: 1000,
+			Dispatch:  dispatchShared,
+			Overflow:  overflowBlock,
+		},
+		PayloadLimit: PayloadLimitConfig{
+			Policy: "reject",
+		},
+		Shutdown: ShutdownConfig{
+			DrainTimeout: 30 * time.Second,
+		},
+		Buffer: BufferConfig{
+			MaxBytes:       1 << 30,
+			Retention:      24 * time.Hour,
+			ReplayInterval: 10 * time.Second,
+		},
+		Reverse: ReverseConfig{
+			SubscriptionName: "mqtt-pulsar-connector",
+		},
+		SchemaRegistry: SchemaRegistryConfig{
+			Type:     registryPulsar,
+			CacheTTL: 5 * time.Minute,
+			Timeout:  10 * time.Second,
+		},
+		Retry: RetryConfig{
+			MaxAttempts: 3,
+			BaseBackoff: 100 * time.Millisecond,
+			MaxBackoff:  5 * time.Second,
+			Jitter:      0.2,
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureThreshold: 5,
+			OpenTimeout:      30 * time.Second,
+		},
+		LeaderElection: LeaderElectionConfig{
+			LeaseName:     "mqtt-pulsar-connector",
+			LeaseDuration: 15 * time.Second,
+			RenewDeadline: 10 * time.Second,
+			RetryPeriod:   2 * time.Second,
+		},
+		Tracing: TracingConfig{
+			Protocol:      "grpc",
+			SamplingRatio: 1,
+			ServiceName:   "mqtt-to-pulsar",
+		},
+		Metrics: MetricsConfig{
+			Port:           "2112",
+			MaxTopicLabels: 1000,
+			Health: HealthConfig{
+				StartupGracePeriod: 5 * time.Minute,
+				LivenessTimeout:    time.Minute,
+			},
+			OTLP: OTLPMetricsConfig{
+				Protocol: "grpc",
+				Interval: 30 * time.Second,
+			},
+		},
+		Profiling: ProfilingConfig{
+			ApplicationName: "mqtt-to-pulsar",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Rotation: RotationConfig{
+			Interval: time.Minute,
+		},
+		Remote: RemoteConfig{
+			Type:          remoteConsul,
+			Timeout:       10 * time.Second,
+			WaitTime:      5 * time.Minute,
+			RetryInterval: 10 * time.Second,
+		},
+		Vault: VaultConfig{
+			Kubernetes: VaultKubernetesConfig{
+				MountPath: "kubernetes",
+				TokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			},
+			MQTT:   VaultSecretConfig{UsernameKey: "username", PasswordKey: "password"},
+			Pulsar: VaultSecretConfig{TokenKey: "token"},
+		},
+	}
+}
+
+// loadConfig reads the YAML file at path (if any) and applies environment
+// variable overrides on top of it.
+func loadConfig(path string) (*Config, error) {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readConfig is loadConfig without validation. Like readLocalConfig, it
+// carries on past problems that leave a usable config, returning it along
+// with all of them.
+func readConfig(path string) (*Config, error) {
+	cfg, err := readLocalConfig(path)
+	if cfg == nil {
+		return nil, err
+	}
+	errs := []error{err}
+	if cfg.Remote.enabled() {
+		if err := cfg.Remote.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("remote: %w", err))
+		} else if err := applyRemoteConfig(context.Background(), cfg); err != nil {
+			errs = append(errs, fmt.Errorf("loading remote config: %w", err))
+		}
+	}
+	if update := controlUpdate.Load(); update != nil {
+		if err := applyRemoteSections(cfg, *update); err != nil {
+			errs = append(errs, fmt.Errorf("parsing routing update: %w", err))
+		}
+	}
+	if len(cfg.MQTT.Subscriptions) == 0 {
+		cfg.MQTT.Subscriptions = []Subscription{{Filter: "device/#"}}
+	}
+	if err := cfg.MQTT.resolveClientIDs(); err != nil {
+		errs = append(errs, err)
+	}
+	return cfg, errors.Join(errs...)
+}
+
+// readLocalConfig reads the defaults, the config file and the environment,
+// without contacting anything. The config is nil only when the file can't
+// be read or parsed; values of the wrong type and invalid environment
+// variables are reported with the config.
+func readLocalConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	var errs []error
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file %s: %w", path, err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+			}
+			for _, e := range typeErr.Errors {
+				errs = append(errs, fmt.Errorf("parsing config file %s: %s", path, e))
+			}
+		}
+	}
+
+	if err := applyEnvOverrides(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	return cfg, errors.Join(errs...)
+}
+
+// validate checks settings that don't need anything loaded or connected.
+// It reports every problem rather than stopping at the first.
+func (c *Config) validate() error {
+	var errs []error
+	if c.MQTT.BrokerURL == "" {
+		errs = append(errs, required("mqtt.broker_url", "MQTT_BROKER_URL"))
+	} else if err := validateURL(c.MQTT.BrokerURL, mqttSchemes); err != nil {
+		errs = append(errs, fmt.Errorf("mqtt.broker_url: %w", err))
+	}
+	if c.Pulsar.URL == "" {
+		errs = append(errs, required("pulsar.url", "PULSAR_BROKER_URL"))
+	} else if err := validateURL(c.Pulsar.URL, pulsarSchemes); err != nil {
+		errs = append(errs, fmt.Errorf("pulsar.url: %w", err))
+	}
+	if c.Metrics.Port == "" {
+		errs = append(errs, required("metrics.port", "PROMETHEUS_PORT"))
+	} else if err := validatePort(c.Metrics.Port); err != nil {
+		errs = append(errs, fmt.Errorf("metrics.port: %w", err))
+	}
+	if c.Admin.Port != "" {
+		if err := validatePort(c.Admin.Port); err != nil {
+			errs = append(errs, fmt.Errorf("admin.port: %w", err))
+		}
+	}
+	if c.Profiling.Pprof.Port != "" {
+		if err := validatePort(c.Profiling.Pprof.Port); err != nil {
+			errs = append(errs, fmt.Errorf("profiling.pprof.port: %w", err))
+		}
+	}
+	switch c.MQTT.ProtocolVersion {
+	case 0, 3, 4, 5:
+	default:
+		errs = append(errs, fmt.Errorf("unsupported MQTT protocol version %d", c.MQTT.ProtocolVersion))
+	}
+	if c.MQTT.QoS > 2 {
+		errs = append(errs, fmt.Errorf("invalid MQTT QoS %d", c.MQTT.QoS))
+	}
+	if strings.ContainsAny(c.MQTT.ShareGroup, "/+#") {
+		errs = append(errs, fmt.Errorf("mqtt.share_group must not contain /, + or #, got %q", c.MQTT.ShareGroup))
+	}
+	if c.Heartbeat.Interval < 0 {
+		errs = append(errs, fmt.Errorf("heartbeat.interval must not be negative, got %s", c.Heartbeat.Interval))
+	}
+	if c.Heartbeat.QoS > 2 {
+		errs = append(errs, fmt.Errorf("heartbeat.qos must be 0, 1 or 2, got %d", c.Heartbeat.QoS))
+	}
+	if err := c.SchemaRegistry.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("schema_registry: %w", err))
+	}
+	if err := validateBridges(c); err != nil {
+		errs = append(errs, err)
+	}
+	switch c.MQTT.Retained {
+	case "", retainedForward, retainedSkip, retainedTag:
+	default:
+		errs = append(errs, fmt.Errorf("mqtt.retained must be forward, skip or tag, got %q", c.MQTT.Retained))
+	}
+	if c.MQTT.PersistentSession && c.MQTT.ClientID == "" {
+		errs = append(errs, fmt.Errorf("mqtt.persistent_session requires mqtt.client_id"))
+	}
+	if c.MQTT.SessionExpiry < 0 || c.MQTT.SessionExpiry > math.MaxUint32*time.Second {
+		errs = append(errs, fmt.Errorf("mqtt.session_expiry must be between 0 and %d seconds, got %s", uint32(math.MaxUint32), c.MQTT.SessionExpiry))
+	}
+	for i, b := range c.MQTT.brokerConfigs() {
+		if b.BrokerURL == "" {
+			errs = append(errs, fmt.Errorf("mqtt.brokers[%d]: broker_url is required", i))
+		} else if err := validateURL(b.BrokerURL, mqttSchemes); err != nil {
+			errs = append(errs, fmt.Errorf("mqtt.brokers[%d]: broker_url: %w", i, err))
+		}
+		if len(b.Subscriptions) == 0 {
+			errs = append(errs, fmt.Errorf("mqtt.brokers[%d]: subscriptions are required", i))
+		}
+		if len(b.Brokers) > 0 {
+			errs = append(errs, fmt.Errorf("mqtt.brokers[%d]: brokers can't be nested", i))
+		}
+		for _, s := range b.Subscriptions {
+			if s.Filter == "" || s.qos(b.QoS) > 2 {
+				errs = append(errs, fmt.Errorf("mqtt.brokers[%d]: invalid subscription %q", i, s.Filter))
+			}
+		}
+	}
+	for i, s := range c.MQTT.Subscriptions {
+		if s.Filter == "" {
+			errs = append(errs, fmt.Errorf("subscription %d: filter is required", i))
+		}
+		if s.qos(c.MQTT.QoS) > 2 {
+			errs = append(errs, fmt.Errorf("subscription %s: invalid QoS %d", s.Filter, s.qos(c.MQTT.QoS)))
+		}
+	}
+	if err := c.Pulsar.Producer.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("pulsar.producer: %w", err))
+	}
+	for i, s := range c.Pulsar.Failover.Standby {
+		if s.URL == "" {
+			errs = append(errs, fmt.Errorf("pulsar.failover.standby %d: url is required", i))
+		} else if err := validateURL(s.URL, pulsarSchemes); err != nil {
+			errs = append(errs, fmt.Errorf("pulsar.failover.standby %d: url: %w", i, err))
+		}
+	}
+	if len(c.Pulsar.Failover.Standby) > 0 && (c.Pulsar.Failover.FailureTimeout <= 0 || c.Pulsar.Failover.ProbeInterval <= 0) {
+		errs = append(errs, fmt.Errorf("pulsar.failover: failure_timeout and probe_interval must be positive"))
+	}
+	if err := c.Pulsar.Transactions.validate(c.MQTT.ManualAck); err != nil {
+		errs = append(errs, fmt.Errorf("pulsar.transactions: %w", err))
+	}
+	for i, t := range c.Mapping.Tenants {
+		if t.Match == "" || t.Tenant == "" || t.Namespace == "" {
+			errs = append(errs, fmt.Errorf("mapping.tenants %d: match, tenant and namespace are required", i))
+		}
+	}
+	for name, pos := range c.Mapping.Segments {
+		if name == "tenant" || name == "namespace" {
+			errs = append(errs, fmt.Errorf("mapping.segments: %s is reserved", name))
+		}
+		if !segmentPositionPattern.MatchString(pos) {
+			errs = append(errs, fmt.Errorf("mapping.segments: %s must be a segment index like 2 or 2:, got %q", name, pos))
+		}
+	}
+	if err := c.Mapping.EventTime.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("mapping.event_time: %w", err))
+	}
+	switch c.Mapping.SchemaCheck {
+	case schemaCheckOff, schemaCheckWarn, schemaCheckFail:
+	default:
+		errs = append(errs, fmt.Errorf("mapping.schema_check must be off, warn or fail, got %q", c.Mapping.SchemaCheck))
+	}
+	for _, r := range c.Mapping.Rules {
+		if _, err := parseCompressionType(r.Compression); err != nil {
+			errs = append(errs, fmt.Errorf("mapping rule %s: %w", r.name(), err))
+		}
+		if r.EventTime != nil {
+			if err := r.EventTime.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("mapping rule %s: event_time: %w", r.name(), err))
+			}
+		}
+		if r.NonPersistent && r.Chunking {
+			errs = append(errs, fmt.Errorf("mapping rule %s: chunking is not supported on non-persistent topics", r.name()))
+		}
+		if r.Producer != nil {
+			if err := r.Producer.apply(c.Pulsar.Producer).validate(); err != nil {
+				errs = append(errs, fmt.Errorf("mapping rule %s: producer: %w", r.name(), err))
+			}
+		}
+		if r.Delivery != nil {
+			if err := r.Delivery.At.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("mapping rule %s: delivery.at: %w", r.name(), err))
+			}
+			if r.Delivery.After < 0 {
+				errs = append(errs, fmt.Errorf("mapping rule %s: delivery.after must not be negative, got %s", r.name(), r.Delivery.After))
+			}
+		}
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limit: %w", err))
+	}
+	if err := c.Metrics.PayloadTimestamp.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("metrics.payload_timestamp: %w", err))
+	}
+	if err := c.PayloadLimit.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("payload_limit: %w", err))
+	}
+	if c.PayloadLimit.MaxBytes > 0 && c.PayloadLimit.Policy == "dead_letter" && c.DeadLetter.Topic == "" {
+		errs = append(errs, errors.New("payload_limit.policy dead_letter requires dead_letter.topic"))
+	}
+	if c.Dedup.Window < 0 {
+		errs = append(errs, fmt.Errorf("dedup.window must not be negative, got %s", c.Dedup.Window))
+	}
+	if c.Metrics.MaxTopicLabels < 0 {
+		errs = append(errs, fmt.Errorf("metrics.max_topic_labels must not be negative, got %d", c.Metrics.MaxTopicLabels))
+	}
+	if c.Metrics.Health.LivenessTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("metrics.health.liveness_timeout must be positive, got %s", c.Metrics.Health.LivenessTimeout))
+	}
+	if c.Metrics.Health.StartupGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("metrics.health.startup_grace_period must not be negative, got %s", c.Metrics.Health.StartupGracePeriod))
+	}
+	if c.Metrics.OTLP.Enabled && c.Metrics.OTLP.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("metrics.otlp.interval must be positive, got %s", c.Metrics.OTLP.Interval))
+	}
+	if c.Tracing.SamplingRatio < 0 || c.Tracing.SamplingRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing.sampling_ratio must be between 0 and 1, got %g", c.Tracing.SamplingRatio))
+	}
+	if c.Processing.Workers < 1 {
+		errs = append(errs, fmt.Errorf("processing.workers must be at least 1, got %d", c.Processing.Workers))
+	}
+	if c.Buffer.Dir != "" && c.Buffer.ReplayInterval <= 0 {
+		errs = append(errs, fmt.Errorf("buffer.replay_interval must be positive, got %s", c.Buffer.ReplayInterval))
+	}
+	for i, r := range c.Reverse.Routes {
+		if r.PulsarTopic == "" || r.MQTTTopic == "" {
+			errs = append(errs, fmt.Errorf("reverse route %d: pulsar_topic and mqtt_topic are required", i))
+		}
+		if r.QoS > 2 {
+			errs = append(errs, fmt.Errorf("reverse route %d: invalid QoS %d", i, r.QoS))
+		}
+	}
+	if c.Retry.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("retry.max_attempts must be at least 1, got %d", c.Retry.MaxAttempts))
+	}
+	if c.Retry.BaseBackoff < 0 {
+		errs = append(errs, fmt.Errorf("retry.base_backoff must not be negative, got %s", c.Retry.BaseBackoff))
+	}
+	if c.Retry.MaxBackoff != 0 && c.Retry.MaxBackoff < c.Retry.BaseBackoff {
+		errs = append(errs, fmt.Errorf("retry.max_backoff must be at least retry.base_backoff (%s), got %s", c.Retry.BaseBackoff, c.Retry.MaxBackoff))
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		errs = append(errs, fmt.Errorf("retry.jitter must be between 0 and 1, got %g", c.Retry.Jitter))
+	}
+	if c.CircuitBreaker.FailureThreshold > 0 && c.CircuitBreaker.OpenTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("circuit_breaker.open_timeout must be positive, got %s", c.CircuitBreaker.OpenTimeout))
+	}
+	if c.MQTT.ReceiveMaximum < 0 || c.MQTT.ReceiveMaximum > math.MaxUint16 {
+		errs = append(errs, fmt.Errorf("mqtt.receive_maximum must be between 0 and %d, got %d", math.MaxUint16, c.MQTT.ReceiveMaximum))
+	}
+	if c.Processing.QueueSize < 0 {
+		errs = append(errs, fmt.Errorf("processing.queue_size must not be negative, got %d", c.Processing.QueueSize))
+	}
+	if c.Processing.Dispatch != dispatchShared && c.Processing.Dispatch != dispatchKey {
+		errs = append(errs, fmt.Errorf("processing.dispatch must be shared or key, got %q", c.Processing.Dispatch))
+	}
+	switch c.Processing.Overflow {
+	case overflowBlock, overflowDropNewest:
+	case overflowDropOldest:
+		// An unbuffered queue has no oldest message to drop
+		if c.Processing.QueueSize == 0 {
+			errs = append(errs, errors.New("processing.overflow drop_oldest requires a processing.queue_size"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("processing.overflow must be block, drop_newest or drop_oldest, got %q", c.Processing.Overflow))
+	}
+	if c.Shutdown.DrainTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown.drain_timeout must be positive, got %s", c.Shutdown.DrainTimeout))
+	}
+	if c.Rotation.Interval < 0 {
+		errs = append(errs, fmt.Errorf("rotation.interval must not be negative, got %s", c.Rotation.Interval))
+	}
+	if err := c.LeaderElection.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("leader_election: %w", err))
+	}
+	if c.Metrics.Auth.Username != "" && c.Metrics.Auth.Password == "" {
+		errs = append(errs, fmt.Errorf("metrics.auth.password is required with a username"))
+	}
+	if c.Admin.Port != "" && c.Admin.Token == "" {
+		errs = append(errs, fmt.Errorf("admin.token is required when the admin API is enabled"))
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	mqttSchemes   = []string{"tcp", "ssl", "tls", "mqtt", "mqtts", "ws", "wss"}
+	pulsarSchemes = []string{"pulsar", "pulsar+ssl", "http", "https"}
+)
+
+// required reports a missing setting along with the environment variable
+// that sets it.
+func required(setting, key string) error {
+	return fmt.Errorf("%s is required, set it in the config file or with %s%s", setting, envPrefix, key)
+}
+
+// validatePort checks that port is a TCP port number.
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("must be a port number between 1 and 65535, got %q", port)
+	}
+	return nil
+}
+
+// validateURL checks that s, if set, parses as a URL with one of schemes.
+func validateURL(s string, schemes []string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(schemes, u.Scheme) {
+		return fmt.Errorf("scheme must be one of %s, got %q", strings.Join(schemes, ", "), u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", s)
+	}
+	return nil
+}
+
+// applyEnvOverrides sets the settings given as environment variables. Each
+// is read with the MQTT_PULSAR_ prefix first and, for existing deployments,
+// without it. Values that don't parse are errors.
+func applyEnvOverrides(cfg *Config) error {
+	env := &envOverrides{}
+	env.overrideString(&cfg.MQTT.BrokerURL, "MQTT_BROKER_URL")
+	env.overrideString(&cfg.MQTT.ClientID, "MQTT_CLIENT_ID")
+	env.overrideString(&cfg.MQTT.ClientIDSuffix, "MQTT_CLIENT_ID_SUFFIX")
+	env.overrideString(&cfg.MQTT.Retained, "MQTT_RETAINED")
+	env.overrideString(&cfg.SchemaRegistry.URL, "SCHEMA_REGISTRY_URL")
+	env.overrideString(&cfg.SchemaRegistry.Token, "SCHEMA_REGISTRY_TOKEN")
+	env.overrideDuration(&cfg.Heartbeat.Interval, "HEARTBEAT_INTERVAL")
+	env.overrideString(&cfg.Heartbeat.MQTTTopic, "HEARTBEAT_MQTT_TOPIC")
+	env.overrideString(&cfg.Heartbeat.PulsarTopic, "HEARTBEAT_PULSAR_TOPIC")
+	env.overrideString(&cfg.MQTT.Username, "MQTT_USERNAME")
+	env.overrideString(&cfg.MQTT.Password, "MQTT_PASSWORD")
+	env.overrideUint(&cfg.MQTT.ProtocolVersion, "MQTT_PROTOCOL_VERSION")
+	env.overrideByte(&cfg.MQTT.QoS, "MQTT_QOS")
+	env.overrideBool(&cfg.MQTT.ManualAck, "MQTT_MANUAL_ACK")
+	env.overrideInt(&cfg.MQTT.ReceiveMaximum, "MQTT_RECEIVE_MAXIMUM")
+	env.overrideString(&cfg.MQTT.ShareGroup, "MQTT_SHARE_GROUP")
+	env.overrideString(&cfg.MQTT.Availability.Topic, "MQTT_AVAILABILITY_TOPIC")
+	env.overrideString(&cfg.MQTT.Availability.PulsarTopic, "MQTT_AVAILABILITY_PULSAR_TOPIC")
+	env.overrideString(&cfg.MQTT.TLS.CAFile, "MQTT_TLS_CA_FILE")
+	env.overrideString(&cfg.MQTT.TLS.CertFile, "MQTT_TLS_CERT_FILE")
+	env.overrideString(&cfg.MQTT.TLS.KeyFile, "MQTT_TLS_KEY_FILE")
+	env.overrideBool(&cfg.MQTT.TLS.InsecureSkipVerify, "MQTT_TLS_INSECURE_SKIP_VERIFY")
+
+	env.overrideString(&cfg.Pulsar.URL, "PULSAR_BROKER_URL")
+	env.overrideString(&cfg.Pulsar.ListenerName, "PULSAR_LISTENER_NAME")
+	env.overrideString(&cfg.Pulsar.TLS.TrustCertsFile, "PULSAR_TLS_TRUST_CERTS_FILE")
+	env.overrideBool(&cfg.Pulsar.TLS.AllowInsecure, "PULSAR_TLS_ALLOW_INSECURE")
+	env.overrideBool(&cfg.Pulsar.TLS.ValidateHostname, "PULSAR_TLS_VALIDATE_HOSTNAME")
+	env.overrideString(&cfg.Pulsar.Auth.Token, "PULSAR_AUTH_TOKEN")
+	env.overrideString(&cfg.Pulsar.Auth.TokenFile, "PULSAR_AUTH_TOKEN_FILE")
+	env.overrideBool(&cfg.Pulsar.Producer.Batching.Enabled, "PULSAR_BATCHING_ENABLED")
+	env.overrideDuration(&cfg.Pulsar.Producer.Batching.MaxPublishDelay, "PULSAR_BATCHING_MAX_PUBLISH_DELAY")
+	env.overrideString(&cfg.Pulsar.Producer.Batching.BatcherType, "PULSAR_BATCHER_TYPE")
+	env.overrideString(&cfg.Pulsar.Producer.Compression, "PULSAR_COMPRESSION")
+	env.overrideInt(&cfg.Pulsar.ProducerCache.MaxProducers, "PULSAR_MAX_PRODUCERS")
+	env.overrideDuration(&cfg.Pulsar.ProducerCache.IdleTimeout, "PULSAR_PRODUCER_IDLE_TIMEOUT")
+	env.overrideString(&cfg.Pulsar.Producer.CompressionLevel, "PULSAR_COMPRESSION_LEVEL")
+	env.overrideBool(&cfg.Pulsar.Producer.Chunking.Enabled, "PULSAR_CHUNKING_ENABLED")
+	env.overrideDuration(&cfg.Pulsar.Producer.SendTimeout, "PULSAR_SEND_TIMEOUT")
+	env.overrideInt(&cfg.Pulsar.Producer.MaxPendingMessages, "PULSAR_MAX_PENDING_MESSAGES")
+	env.overrideString(&cfg.Pulsar.Producer.HashingScheme, "PULSAR_HASHING_SCHEME")
+	env.overrideBool(&cfg.Pulsar.Producer.Deduplication, "PULSAR_DEDUPLICATION")
+	env.overrideBool(&cfg.Pulsar.Transactions.Enabled, "PULSAR_TRANSACTIONS_ENABLED")
+	env.overrideDuration(&cfg.Pulsar.Failover.FailureTimeout, "PULSAR_FAILOVER_FAILURE_TIMEOUT")
+	env.overrideDuration(&cfg.Pulsar.Failover.ProbeInterval, "PULSAR_FAILOVER_PROBE_INTERVAL")
+	env.overrideString(&cfg.Mapping.Tenant, "PULSAR_TENANT")
+	env.overrideString(&cfg.Mapping.Namespace, "PULSAR_NAMESPACE")
+	env.overrideString(&cfg.Mapping.TopicMap, "TOPIC_MAP_FILE")
+	env.overrideString(&cfg.Mapping.SchemaCheck, "MAPPING_SCHEMA_CHECK")
+	env.overrideBool(&cfg.Topics.Strict, "TOPICS_STRICT")
+
+	env.overrideInt(&cfg.Processing.Workers, "PROCESSING_WORKERS")
+	env.overrideInt(&cfg.Processing.QueueSize, "PROCESSING_QUEUE_SIZE")
+	env.overrideString(&cfg.Processing.Dispatch, "PROCESSING_DISPATCH")
+	env.overrideString(&cfg.Processing.Overflow, "PROCESSING_OVERFLOW")
+
+	env.overrideDuration(&cfg.Shutdown.DrainTimeout, "SHUTDOWN_DRAIN_TIMEOUT")
+
+	env.overrideInt(&cfg.Retry.MaxAttempts, "RETRY_MAX_ATTEMPTS")
+	env.overrideDuration(&cfg.Retry.BaseBackoff, "RETRY_BASE_BACKOFF")
+	env.overrideDuration(&cfg.Retry.MaxBackoff, "RETRY_MAX_BACKOFF")
+
+	env.overrideInt(&cfg.CircuitBreaker.FailureThreshold, "CIRCUIT_BREAKER_FAILURE_THRESHOLD")
+	env.overrideDuration(&cfg.CircuitBreaker.OpenTimeout, "CIRCUIT_BREAKER_OPEN_TIMEOUT")
+
+	env.overrideString(&cfg.DeadLetter.Topic, "DEAD_LETTER_TOPIC")
+	env.overrideString(&cfg.Validation.QuarantineTopic, "QUARANTINE_TOPIC")
+
+	env.overrideString(&cfg.WAL.Dir, "WAL_DIR")
+	env.overrideBool(&cfg.WAL.Sync, "WAL_SYNC")
+	env.overrideString(&cfg.Buffer.Dir, "BUFFER_DIR")
+	env.overrideInt64(&cfg.Buffer.MaxBytes, "BUFFER_MAX_BYTES")
+	env.overrideDuration(&cfg.Buffer.Retention, "BUFFER_RETENTION")
+	env.overrideDuration(&cfg.Buffer.ReplayInterval, "BUFFER_REPLAY_INTERVAL")
+
+	env.overrideString(&cfg.Metrics.Port, "PROMETHEUS_PORT")
+	env.overrideString(&cfg.Metrics.Address, "PROMETHEUS_ADDRESS")
+	env.overrideString(&cfg.Metrics.TLS.CertFile, "PROMETHEUS_TLS_CERT_FILE")
+	env.overrideString(&cfg.Metrics.TLS.KeyFile, "PROMETHEUS_TLS_KEY_FILE")
+	env.overrideString(&cfg.Metrics.Auth.Token, "PROMETHEUS_AUTH_TOKEN")
+	env.overrideString(&cfg.Metrics.Auth.Username, "PROMETHEUS_AUTH_USERNAME")
+	env.overrideString(&cfg.Metrics.Auth.Password, "PROMETHEUS_AUTH_PASSWORD")
+
+	env.overrideString(&cfg.Profiling.ServerAddress, "PYROSCOPE_SERVER_ADDRESS")
+	env.overrideString(&cfg.Profiling.ApplicationName, "PYROSCOPE_APPLICATION_NAME")
+	env.overrideString(&cfg.Profiling.BasicAuthUser, "PYROSCOPE_BASIC_AUTH_USER")
+	env.overrideString(&cfg.Profiling.BasicAuthPassword, "PYROSCOPE_BASIC_AUTH_PASSWORD")
+	env.overrideString(&cfg.Profiling.TenantID, "PYROSCOPE_TENANT_ID")
+	env.overrideBool(&cfg.Profiling.Pprof.Enabled, "PPROF_ENABLED")
+	env.overrideString(&cfg.Profiling.Pprof.Port, "PPROF_PORT")
+
+	env.overrideBool(&cfg.Tracing.Enabled, "TRACING_ENABLED")
+	env.overrideString(&cfg.Tracing.Protocol, "TRACING_PROTOCOL")
+	env.overrideString(&cfg.Tracing.Endpoint, "TRACING_ENDPOINT")
+	env.overrideBool(&cfg.Tracing.Insecure, "TRACING_INSECURE")
+
+	env.overrideBool(&cfg.Metrics.DisablePrometheus, "PROMETHEUS_DISABLED")
+	env.overrideInt(&cfg.Metrics.MaxTopicLabels, "PROMETHEUS_MAX_TOPIC_LABELS")
+	env.overrideDuration(&cfg.Metrics.Health.StartupGracePeriod, "HEALTH_STARTUP_GRACE_PERIOD")
+	env.overrideDuration(&cfg.Metrics.Health.LivenessTimeout, "HEALTH_LIVENESS_TIMEOUT")
+	env.overrideBool(&cfg.Metrics.OTLP.Enabled, "OTLP_METRICS_ENABLED")
+	env.overrideString(&cfg.Metrics.OTLP.Protocol, "OTLP_METRICS_PROTOCOL")
+	env.overrideString(&cfg.Metrics.OTLP.Endpoint, "OTLP_METRICS_ENDPOINT")
+	env.overrideBool(&cfg.Metrics.OTLP.Insecure, "OTLP_METRICS_INSECURE")
+	env.overrideDuration(&cfg.Metrics.OTLP.Interval, "OTLP_METRICS_INTERVAL")
+
+	env.overrideBool(&cfg.LeaderElection.Enabled, "LEADER_ELECTION_ENABLED")
+	env.overrideString(&cfg.LeaderElection.LeaseName, "LEADER_ELECTION_LEASE_NAME")
+	env.overrideString(&cfg.LeaderElection.Namespace, "LEADER_ELECTION_NAMESPACE")
+	env.overrideString(&cfg.LeaderElection.Identity, "LEADER_ELECTION_IDENTITY")
+
+	env.overrideString(&cfg.Vault.Address, "VAULT_ADDR")
+	env.overrideString(&cfg.Control.Topic, "CONTROL_TOPIC")
+	env.overrideString(&cfg.Remote.Type, "REMOTE_CONFIG_TYPE")
+	env.overrideString(&cfg.Remote.Address, "REMOTE_CONFIG_ADDRESS")
+	env.overrideString(&cfg.Remote.Key, "REMOTE_CONFIG_KEY")
+	env.overrideString(&cfg.Remote.Token, "REMOTE_CONFIG_TOKEN")
+	env.overrideString(&cfg.Remote.Username, "REMOTE_CONFIG_USERNAME")
+	env.overrideString(&cfg.Remote.Password, "REMOTE_CONFIG_PASSWORD")
+	env.overrideString(&cfg.Vault.Namespace, "VAULT_NAMESPACE")
+	env.overrideString(&cfg.Vault.Token, "VAULT_TOKEN")
+	env.overrideString(&cfg.Vault.TLS.CAFile, "VAULT_CACERT")
+	env.overrideString(&cfg.Vault.Kubernetes.Role, "VAULT_KUBERNETES_ROLE")
+
+	env.overrideDuration(&cfg.Rotation.Interval, "CREDENTIAL_ROTATION_INTERVAL")
+
+	env.overrideInt(&cfg.PayloadLimit.MaxBytes, "PAYLOAD_MAX_BYTES")
+	env.overrideString(&cfg.PayloadLimit.Policy, "PAYLOAD_LIMIT_POLICY")
+
+	env.overrideDuration(&cfg.Dedup.Window, "DEDUP_WINDOW")
+	env.overrideString(&cfg.Dedup.Redis.Address, "DEDUP_REDIS_ADDRESS")
+	env.overrideString(&cfg.Dedup.Redis.Password, "DEDUP_REDIS_PASSWORD")
+
+	env.overrideString(&cfg.Admin.Port, "ADMIN_PORT")
+	env.overrideString(&cfg.Admin.Token, "ADMIN_TOKEN")
+
+	env.overrideString(&cfg.Log.Level, "LOG_LEVEL")
+	env.overrideString(&cfg.Log.Format, "LOG_FORMAT")
+	env.overrideInt(&cfg.Log.SampleEvery, "LOG_SAMPLE_EVERY")
+	return errors.Join(env.errs...)
+}
+
+// envPrefix is the prefix of the connector's environment variables.
+const envPrefix = "MQTT_PULSAR_"
+
+// lookupEnv returns the value of the environment variable envPrefix+key or,
+// if that isn't set, key, along with the name it was found under.
+func lookupEnv(key string) (name, value string, ok bool) {
+	if v, ok := os.LookupEnv(envPrefix + key); ok {
+		return envPrefix + key, v, true
+	}
+	v, ok := os.LookupEnv(key)
+	return key, v, ok
+}
+
+// envOverrides collects the errors of environment variables that don't
+// parse, so all of them are reported at once.
+type envOverrides struct {
+	errs []error
+}
+
+func (e *envOverrides) invalid(name, kind, value string) {
+	e.errs = append(e.errs, fmt.Errorf("environment variable %s: invalid %s %q", name, kind, value))
+}
+
+func (e *envOverrides) overrideString(dst *string, key string) {
+	if _, v, ok := lookupEnv(key); ok {
+		*dst = v
+	}
+}
+
+func (e *envOverrides) overrideBool(dst *bool, key string) {
+	if name, v, ok := lookupEnv(key); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.invalid(name, "boolean", v)
+			return
+		}
+		*dst = b
+	}
+}
+
+func (e *envOverrides) overrideUint(dst *uint, key string) {
+	if name, v, ok := lookupEnv(key); ok {
+		n, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			e.invalid(name, "number", v)
+			return
+		}
+		*dst = uint(n)
+	}
+}
+
+func (e *envOverrides) overrideInt(dst *int, key string) {
+	if name, v, ok := lookupEnv(key); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			e.invalid(name, "number", v)
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envOverrides) overrideInt64(dst *int64, key string) {
+	if name, v, ok := lookupEnv(key); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			e.invalid(name, "number", v)
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envOverrides) overrideDuration(dst *time.Duration, key string) {
+	if name, v, ok := lookupEnv(key); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			e.invalid(name, "duration", v)
+			return
+		}
+		*dst = d
+	}
+}
+
+func (e *envOverrides) overrideByte(dst *byte, key string) {
+	if name, v, ok := lookupEnv(key); ok {
+		n, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			e.invalid(name, "number", v)
+			return
+		}
+		*dst = byte(n)
+	}
+}
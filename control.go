@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ControlConfig reads routing updates from a Pulsar topic, enabled by
+// setting Topic. Each message holds YAML or JSON with the mapping and
+// filters sections, like a remote config key, and replaces them on top of
+// the local and remote config. An update is applied like a SIGHUP reload,
+// so an invalid one leaves the running routing intact.
+//
+// Every replica reads the topic without a subscription, starting at the
+// latest message, so only the most recent update matters and the topic
+// can be compacted.
+type ControlConfig struct {
+	Topic string `yaml:"topic"`
+}
+
+var (
+	controlUpdates = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "control_updates",
+			Help: "Number of routing updates read from the control topic, by outcome",
+		},
+		[]string{"outcome"},
+	)
+
+	// controlUpdate is the payload of the routing update in effect.
+	controlUpdate atomic.Pointer[[]byte]
+)
+
+// controlReader follows the control topic on the active Pulsar cluster.
+type controlReader struct {
+	path string
+	c    ControlConfig
+
+	mu sync.Mutex
+	// stale is set when the cluster switched, and cancel interrupts the
+	// pending read so the reader is recreated on the new cluster.
+	stale  bool
+	cancel context.CancelFunc
+}
+
+// control is the control topic reader, nil when it is disabled.
+var control atomic.Pointer[controlReader]
+
+// startControlReader applies the latest update on the control topic, then
+// keeps applying new ones until ctx is cancelled.
+func startControlReader(ctx context.Context, path string, c ControlConfig) error {
+	r := &controlReader{path: path, c: c}
+	// Route with the latest update from the first message on
+	reader, err := r.open(ctx)
+	if err != nil {
+		return err
+	}
+	control.Store(r)
+	go r.run(ctx, reader)
+	return nil
+}
+
+// open creates a reader on the active cluster and applies the latest
+// update on the topic.
+func (r *controlReader) open(ctx context.Context) (pulsar.Reader, error) {
+	reader, err := pulsarClient.CreateReader(pulsar.ReaderOptions{
+		Topic:                   r.c.Topic,
+		StartMessageID:          pulsar.LatestMessageID(),
+		StartMessageIDInclusive: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reader.HasNext() {
+		if msg, err := reader.Next(ctx); err == nil {
+			applyControlUpdate(r.path, msg)
+		}
+	}
+	return reader, nil
+}
+
+// run applies updates until ctx is cancelled. It backs off after errors
+// and recreates the reader after a cluster switch.
+func (r *controlReader) run(ctx context.Context, reader pulsar.Reader) {
+	defer func() {
+		if reader != nil {
+			reader.Close()
+		}
+	}()
+
+	delay := time.Second
+	backoff := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, 30*time.Second)
+		return true
+	}
+
+	for {
+		if reader == nil {
+			var err error
+			if reader, err = r.open(ctx); err != nil {
+				slog.Error("Failed to create control topic reader, retrying", "pulsar_topic", r.c.Topic, "error", err, "retry_in", delay)
+				if !backoff() {
+					return
+				}
+				continue
+			}
+		}
+
+		readCtx, cancel := context.WithCancel(ctx)
+		r.mu.Lock()
+		r.cancel = cancel
+		stale := r.stale
+		r.stale = false
+		r.mu.Unlock()
+		if stale {
+			cancel()
+			reader.Close()
+			reader = nil
+			continue
+		}
+		msg, err := reader.Next(readCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if readCtx.Err() != nil {
+				continue
+			}
+			slog.Error("Failed to read from the control topic, retrying", "pulsar_topic", r.c.Topic, "error", err, "retry_in", delay)
+			if !backoff() {
+				return
+			}
+			continue
+		}
+		delay = time.Second
+		applyControlUpdate(r.path, msg)
+	}
+}
+
+// restart makes the reader move to the active cluster.
+func (r *controlReader) restart() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stale = true
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// applyControlUpdate reloads the config with the update in msg, going back
+// to the previous update if that fails.
+func applyControlUpdate(path string, msg pulsar.Message) {
+	payload := msg.Payload()
+	previous := controlUpdate.Swap(&payload)
+	if err := reloadConfig(path); err != nil {
+		controlUpdate.Store(previous)
+		controlUpdates.With(prometheus.Labels{"outcome": "invalid"}).Inc()
+		slog.Error("Failed to apply routing update, keeping the current routing",
+			"pulsar_topic", msg.Topic(), "message_id", msg.ID().String(), "error", err)
+		return
+	}
+	controlUpdates.With(prometheus.Labels{"outcome": "applied"}).Inc()
+	slog.Info("Applied routing update", "pulsar_topic", msg.Topic(), "message_id", msg.ID().String())
+}
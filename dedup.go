@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DedupConfig drops messages already seen within Window, such as QoS 1
+// redeliveries or retained messages replayed on every reconnect. A message
+// is identified by a hash of its topic and payload, or by the MQTT 5 user
+// property named Property when set (falling back to the hash for messages
+// without it). Seen messages are remembered in memory unless a Redis
+// address is configured, which lets replicas share the window. Note that a
+// broker redelivery of a message that failed to send also counts as a
+// duplicate, so combine this with a dead-letter topic or disk buffer.
+type DedupConfig struct {
+	Window   time.Duration `yaml:"window"`
+	Property string        `yaml:"property"`
+	Redis    RedisConfig   `yaml:"redis"`
+}
+
+type RedisConfig struct {
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	// KeyPrefix namespaces the keys, so several connectors can share a
+	// Redis instance.
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+// seenStore records keys for a limited time.
+type seenStore interface {
+	// markSeen records key and reports whether it was already recorded.
+	markSeen(ctx context.Context, key string, ttl time.Duration) (bool, error)
+}
+
+type deduplicator struct {
+	window   time.Duration
+	property string
+	store    seenStore
+}
+
+func newDeduplicator(c DedupConfig) *deduplicator {
+	d := &deduplicator{window: c.Window, property: c.Property}
+	if c.Redis.Address != "" {
+		d.store = &redisSeenStore{
+			client: redis.NewClient(&redis.Options{
+				Addr:     c.Redis.Address,
+				Password: c.Redis.Password,
+				DB:       c.Redis.DB,
+			}),
+			prefix: c.Redis.KeyPrefix,
+		}
+	} else {
+		d.store = &memorySeenStore{expiries: make(map[string]time.Time)}
+	}
+	return d
+}
+
+// Duplicate reports whether msg was seen within the window. When the store
+// can't be reached the message is let through, since a duplicate is better
+// than a lost message.
+func (d *deduplicator) Duplicate(ctx context.Context, msg *Message) bool {
+	seen, err := d.store.markSeen(ctx, d.key(msg), d.window)
+	if err != nil {
+		slog.Warn("Failed to check for duplicate message", "mqtt_topic", msg.Topic, "error", err)
+		return false
+	}
+	return seen
+}
+
+func (d *deduplicator) key(msg *Message) string {
+	if id := msg.UserProperties[d.property]; d.property != "" && id != "" {
+		return "id:" + msg.Topic + "\x00" + id
+	}
+	h := sha256.New()
+	h.Write([]byte(msg.Topic))
+	h.Write([]byte{0})
+	h.Write(msg.Payload)
+	return "hash:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// run evicts expired keys from the in-memory store until ctx is cancelled.
+func (d *deduplicator) run(ctx context.Context) {
+	s, ok := d.store.(*memorySeenStore)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(d.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, expiry := range s.expiries {
+				if now.After(expiry) {
+					delete(s.expiries, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+type memorySeenStore struct {
+	mu       sync.Mutex
+	expiries map[string]time.Time
+}
+
+func (s *memorySeenStore) markSeen(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if expiry, ok := s.expiries[key]; ok && now.Before(expiry) {
+		return true, nil
+	}
+	s.expiries[key] = now.Add(ttl)
+	return false, nil
+}
+
+type redisSeenStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func (s *redisSeenStore) markSeen(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	set, err := s.client.SetNX(ctx, s.prefix+key, 1, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis: %w", err)
+	}
+	return !set, nil
+}
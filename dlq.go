@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DeadLetterConfig configures where messages that could not be delivered
+// are published. Dead-lettering is disabled when Topic is empty.
+type DeadLetterConfig struct {
+	Topic string `yaml:"topic"`
+}
+
+// deadLetter publishes the original payload to the dead-letter topic along
+// with properties describing where it was headed and why it failed.
+func deadLetter(ctx context.Context, msg *Message, pulsarTopic string, cause error) {
+	if cfg.DeadLetter.Topic == "" {
+		// Not acked: with manual acknowledgement the broker redelivers it.
+		messagesDropped.With(prometheus.Labels{"reason": dropSendFailed}).Inc()
+		return
+	}
+
+	if dryRun {
+		logDryRun(msg, cfg.DeadLetter.Topic, "", len(msg.Payload))
+		return
+	}
+
+	producer, ok := getOrCreateProducer(cfg.DeadLetter.Topic, cfg.Pulsar.Producer, nil)
+	if !ok {
+		slog.Error("Failed to get dead-letter producer, dropping message",
+			"mqtt_topic", msg.Topic, "pulsar_topic", pulsarTopic, "dlq_topic", cfg.DeadLetter.Topic)
+		messagesDropped.With(prometheus.Labels{"reason": dropDeadLetterError}).Inc()
+		return
+	}
+
+	props := messageProperties(msg)
+	props["dlq_mqtt_topic"] = msg.Topic
+	props["dlq_pulsar_topic"] = pulsarTopic
+	props["dlq_error"] = cause.Error()
+	props["dlq_failed_at"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	producer.SendAsync(ctx, &pulsar.ProducerMessage{
+		Payload:    msg.Payload,
+		Properties: props,
+	}, func(_ pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+		if err != nil {
+			slog.Error("Failed to dead-letter message",
+				"mqtt_topic", msg.Topic, "pulsar_topic", pulsarTopic, "dlq_topic", cfg.DeadLetter.Topic, "error", err)
+			messagesDropped.With(prometheus.Labels{"reason": dropDeadLetterError}).Inc()
+			return
+		}
+		messagesDeadLettered.With(prometheus.Labels{"topic": pulsarTopic}).Inc()
+		msg.Ack()
+	})
+}
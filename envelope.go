@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// envelope is the JSON document the envelope transformer wraps payloads
+// in. JSON payloads are embedded as they are; anything else is base64
+// encoded and flagged through PayloadEncoding.
+type envelope struct {
+	Topic            string          `json:"topic"`
+	GatewayID        string          `json:"gateway_id"`
+	ReceivedAt       time.Time       `json:"received_at"`
+	ConnectorVersion string          `json:"connector_version"`
+	PayloadEncoding  string          `json:"payload_encoding,omitempty"`
+	Payload          json.RawMessage `json:"payload"`
+}
+
+// newEnvelopeTransformer wraps the payload in an envelope recording where
+// and when it was received, for consumers that need provenance in the
+// payload itself. The gateway ID defaults to the MQTT client ID.
+func newEnvelopeTransformer(step TransformStep) (Transformer, error) {
+	return TransformerFunc(func(msg *Message) error {
+		env := envelope{
+			Topic:            msg.Topic,
+			GatewayID:        step.GatewayID,
+			ReceivedAt:       msg.ReceivedAt.UTC(),
+			ConnectorVersion: version,
+			Payload:          msg.Payload,
+		}
+		if env.GatewayID == "" {
+			env.GatewayID = cfg.MQTT.ClientID
+		}
+		if !json.Valid(msg.Payload) {
+			// []byte marshals as a base64 string
+			b, _ := json.Marshal(msg.Payload)
+			env.PayloadEncoding = "base64"
+			env.Payload = b
+		}
+		return setJSONPayload(msg, env)
+	}), nil
+}
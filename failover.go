@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// FailoverConfig lists standby Pulsar clusters. When sends to the active
+// cluster have been failing for FailureTimeout, the connector moves its
+// producers to the next cluster in line. While on a standby it checks the
+// primary every ProbeInterval by looking up ProbeTopic, and moves back once
+// the primary answers.
+//
+// The reverse bridge keeps consuming from the primary.
+type FailoverConfig struct {
+	Standby        []PulsarClusterConfig `yaml:"standby"`
+	FailureTimeout time.Duration         `yaml:"failure_timeout"`
+	ProbeInterval  time.Duration         `yaml:"probe_interval"`
+	ProbeTopic     string                `yaml:"probe_topic"`
+}
+
+// PulsarClusterConfig holds the connection settings of a single cluster.
+type PulsarClusterConfig struct {
+	URL          string           `yaml:"url"`
+	ListenerName string           `yaml:"listener_name"`
+	TLS          PulsarTLSConfig  `yaml:"tls"`
+	Auth         PulsarAuthConfig `yaml:"auth"`
+}
+
+// clusterClient wraps one Pulsar client per cluster and forwards to the
+// active one.
+type clusterClient struct {
+	cfg     FailoverConfig
+	urls    []string
+	clients []pulsar.Client
+	active  atomic.Int32
+}
+
+func newClusterClient(c PulsarConfig) (*clusterClient, error) {
+	clusters := append([]PulsarClusterConfig{c.primary()}, c.Failover.Standby...)
+	cc := &clusterClient{cfg: c.Failover}
+	for _, cluster := range clusters {
+		client, err := pulsar.NewClient(newPulsarClientOptions(cluster, c.Transactions.Enabled))
+		if err != nil {
+			cc.Close()
+			return nil, err
+		}
+		cc.urls = append(cc.urls, cluster.URL)
+		cc.clients = append(cc.clients, client)
+	}
+	return cc, nil
+}
+
+func (c *clusterClient) current() pulsar.Client {
+	return c.clients[c.active.Load()]
+}
+
+func (c *clusterClient) CreateProducer(opts pulsar.ProducerOptions) (pulsar.Producer, error) {
+	return c.current().CreateProducer(opts)
+}
+
+func (c *clusterClient) Subscribe(opts pulsar.ConsumerOptions) (pulsar.Consumer, error) {
+	return c.current().Subscribe(opts)
+}
+
+func (c *clusterClient) CreateReader(opts pulsar.ReaderOptions) (pulsar.Reader, error) {
+	return c.current().CreateReader(opts)
+}
+
+func (c *clusterClient) NewTransaction(timeout time.Duration) (pulsar.Transaction, error) {
+	return c.current().NewTransaction(timeout)
+}
+
+func (c *clusterClient) Close() {
+	for _, client := range c.clients {
+		client.Close()
+	}
+}
+
+// run watches the active cluster until ctx is cancelled. It does nothing
+// without standby clusters.
+func (c *clusterClient) run(ctx context.Context) {
+	if len(c.clients) < 2 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var failingSince, lastProbe time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if pulsarHealthy.Load() {
+				failingSince = time.Time{}
+			} else if failingSince.IsZero() {
+				failingSince = now
+			} else if now.Sub(failingSince) >= c.cfg.FailureTimeout {
+				c.switchTo((int(c.active.Load()) + 1) % len(c.clients))
+				failingSince = time.Time{}
+				continue
+			}
+
+			if c.active.Load() != 0 && now.Sub(lastProbe) >= c.cfg.ProbeInterval {
+				lastProbe = now
+				if _, err := c.clients[0].TopicPartitions(c.cfg.ProbeTopic); err == nil {
+					c.switchTo(0)
+				}
+			}
+		}
+	}
+}
+
+// switchTo makes cluster i active. Cached producers belong to the previous
+// cluster, so they are closed; in-flight sends on them fail and are retried
+// on the new cluster. The control topic reader moves over as well.
+func (c *clusterClient) switchTo(i int) {
+	from := c.active.Swap(int32(i))
+	slog.Warn("Switching Pulsar cluster", "from", c.urls[from], "to", c.urls[i])
+	pulsarFailovers.Inc()
+	producers.CloseAll()
+	if r := control.Load(); r != nil {
+		r.restart()
+	}
+	setPulsarHealthy(true)
+}
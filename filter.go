@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+)
+
+// FilterRule is a CEL expression deciding what happens to a message. The
+// expression must evaluate to a bool and can use:
+//
+//	topic     the MQTT topic
+//	segments  the topic split on /
+//	payload   the JSON payload, or an empty map if it isn't JSON
+//	previous  the last payload forwarded on the same topic, or an empty map
+//
+// previous is kept for the maxPreviousTopics most recently seen topics and
+// survives reloads.
+//
+// When the expression is true, Action is applied: drop discards the message
+// and reroute sends it to Topic, a template like the mapping rule topics.
+// Rules are evaluated in order and the first true one wins; messages no rule
+// applies to are forwarded as usual.
+type FilterRule struct {
+	Match      string `yaml:"match"`
+	Expression string `yaml:"expression"`
+	Action     string `yaml:"action"`
+	Topic      string `yaml:"topic"`
+}
+
+const (
+	filterDrop    = "drop"
+	filterReroute = "reroute"
+)
+
+type compiledFilter struct {
+	FilterRule
+	program cel.Program
+}
+
+// maxPreviousTopics caps the topics whose last payload is remembered.
+const maxPreviousTopics = 10000
+
+// messageFilter evaluates the filter rules. It remembers the last forwarded
+// payload per topic for the previous variable.
+type messageFilter struct {
+	filters  []compiledFilter
+	previous *payloadHistory
+}
+
+// payloadHistory holds the last payload of the most recently seen topics.
+type payloadHistory struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front = most recently used
+}
+
+type topicPayload struct {
+	topic   string
+	payload map[string]any
+}
+
+func newPayloadHistory() *payloadHistory {
+	return &payloadHistory{entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (h *payloadHistory) get(topic string) (map[string]any, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	el, ok := h.entries[topic]
+	if !ok {
+		return nil, false
+	}
+	return el.Value.(*topicPayload).payload, true
+}
+
+func (h *payloadHistory) set(topic string, payload map[string]any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if el, ok := h.entries[topic]; ok {
+		el.Value.(*topicPayload).payload = payload
+		h.lru.MoveToFront(el)
+		return
+	}
+	h.entries[topic] = h.lru.PushFront(&topicPayload{topic: topic, payload: payload})
+	if h.lru.Len() > maxPreviousTopics {
+		el := h.lru.Back()
+		h.lru.Remove(el)
+		delete(h.entries, el.Value.(*topicPayload).topic)
+	}
+}
+
+// inherit takes over the payload history of the filter f replaces, so a
+// reload doesn't make every topic look new.
+func (f *messageFilter) inherit(prev *messageFilter) {
+	if prev != nil {
+		f.previous = prev.previous
+	}
+}
+
+func newMessageFilter(rules []FilterRule) (*messageFilter, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("topic", cel.StringType),
+		cel.Variable("segments", cel.ListType(cel.StringType)),
+		cel.Variable("payload", cel.DynType),
+		cel.Variable("previous", cel.DynType),
+		cel.CrossTypeNumericComparisons(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &messageFilter{previous: newPayloadHistory()}
+	for i, r := range rules {
+		if r.Match == "" || r.Expression == "" {
+			return nil, fmt.Errorf("filter rule %d: match and expression are required", i)
+		}
+		switch r.Action {
+		case filterDrop:
+		case filterReroute:
+			if r.Topic == "" {
+				return nil, fmt.Errorf("filter rule %s: reroute requires topic", r.Match)
+			}
+		default:
+			return nil, fmt.Errorf("filter rule %s: unknown action %q", r.Match, r.Action)
+		}
+
+		ast, iss := env.Compile(r.Expression)
+		if iss.Err() != nil {
+			return nil, fmt.Errorf("filter rule %s: %w", r.Match, iss.Err())
+		}
+		if ast.OutputType() != cel.BoolType {
+			return nil, fmt.Errorf("filter rule %s: expression must return a bool, got %s", r.Match, ast.OutputType())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("filter rule %s: %w", r.Match, err)
+		}
+		f.filters = append(f.filters, compiledFilter{FilterRule: r, program: program})
+	}
+	return f, nil
+}
+
+// Apply evaluates the rules matching msg's topic. It returns errDropMessage
+// for dropped messages and sets the destination of rerouted ones. An
+// expression that fails to evaluate, for example because a field is
+// missing, counts as false.
+func (f *messageFilter) Apply(msg *Message) error {
+	if len(f.filters) == 0 {
+		return nil
+	}
+
+	payload := map[string]any{}
+	_ = json.Unmarshal(msg.Payload, &payload)
+
+	previous, ok := f.previous.get(msg.Topic)
+	if !ok {
+		previous = map[string]any{}
+	}
+
+	vars := map[string]any{
+		"topic":    msg.Topic,
+		"segments": strings.Split(msg.Topic, "/"),
+		"payload":  payload,
+		"previous": previous,
+	}
+	for _, r := range f.filters {
+		if !topicMatches(r.Match, msg.Topic) {
+			continue
+		}
+		out, _, err := r.program.Eval(vars)
+		if err != nil || out.Value() != true {
+			continue
+		}
+		if r.Action == filterDrop {
+			return errDropMessage
+		}
+		msg.rerouteTopic = expandTopicTemplate(r.Topic, msg.Topic)
+		break
+	}
+
+	f.previous.set(msg.Topic, payload)
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HealthConfig tunes the probes. Until startup completes, that is both
+// connections are up and the subscriptions active, /startupz fails and
+// /livez passes for StartupGracePeriod, so a slow broker connection isn't
+// mistaken for a hung process. LivenessTimeout is how long the event loop
+// or busy workers may go without progress before /livez fails.
+type HealthConfig struct {
+	StartupGracePeriod time.Duration `yaml:"startup_grace_period"`
+	LivenessTimeout    time.Duration `yaml:"liveness_timeout"`
+}
+
+var (
+	// pulsarHealthy tracks whether the most recent Pulsar send succeeded.
+	// The Pulsar client does not expose its connection state, so the
+	// outcome of sends is the best signal available.
+	pulsarHealthy atomic.Bool
+
+	// startTime is when the process started, for the startup grace period.
+	startTime = time.Now()
+	// startupDone is set once run has connected and subscribed.
+	startupDone atomic.Bool
+	// shuttingDown is set when shutdown begins, to fail readiness before
+	// the subscriptions go away.
+	shuttingDown atomic.Bool
+	// watchdogBeat is when the watchdog last ran, in Unix nanoseconds.
+	watchdogBeat atomic.Int64
+)
+
+// setPulsarHealthy records the outcome of a send, counting recoveries.
+func setPulsarHealthy(ok bool) {
+	if !pulsarHealthy.Swap(ok) && ok {
+		pulsarReconnects.Inc()
+	}
+}
+
+// runWatchdog records a beat every second. A stale beat means goroutines
+// are no longer being scheduled, e.g. because of a deadlock that stopped
+// the world or a starved runtime.
+func runWatchdog(ctx context.Context) {
+	watchdogBeat.Store(time.Now().UnixNano())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			watchdogBeat.Store(now.UnixNano())
+		}
+	}
+}
+
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func checkHealth() (mqttOK, pulsarOK, queueOK bool, report healthReport) {
+	mqttOK = anyMQTTConnected()
+	pulsarOK = pulsarClient != nil && pulsarHealthy.Load()
+	queueOK = pool != nil && !pool.Full()
+
+	report.Checks = map[string]string{
+		"mqtt":   statusString(mqttOK),
+		"pulsar": statusString(pulsarOK),
+		"queue":  statusString(queueOK),
+	}
+	return mqttOK, pulsarOK, queueOK, report
+}
+
+// checkSubscriptions reports whether the configured subscriptions are
+// active. A standby replica under leader election holds none, yet is ready
+// to take over.
+func checkSubscriptions() (bool, string) {
+	switch {
+	case shuttingDown.Load():
+		return false, "stopping"
+	case mqttSubscribed.Load():
+		return true, "ok"
+	case cfg.LeaderElection.Enabled && startupDone.Load():
+		return true, "standby"
+	default:
+		return false, "fail"
+	}
+}
+
+// healthzHandler reports both connections, for Docker and Nomad checks
+// that only support a single endpoint. Kubernetes should use the probes
+// below instead.
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	mqttOK, pulsarOK, _, report := checkHealth()
+	writeHealth(w, mqttOK && pulsarOK, report)
+}
+
+// startupzHandler is the startup probe. It passes once the connector has
+// connected to both sides and subscribed.
+func startupzHandler(w http.ResponseWriter, _ *http.Request) {
+	ok := startupDone.Load()
+	writeHealth(w, ok, healthReport{Checks: map[string]string{"startup": statusString(ok)}})
+}
+
+// livezHandler is the liveness probe. It only fails when the process is
+// stuck, which a restart recovers from, and not when a broker is down,
+// which it doesn't.
+func livezHandler(w http.ResponseWriter, _ *http.Request) {
+	c := cfg.Metrics.Health
+	loopOK := time.Since(time.Unix(0, watchdogBeat.Load())) < c.LivenessTimeout
+	workersOK := pool == nil || !pool.Stalled(c.LivenessTimeout)
+	startupOK := startupDone.Load() || time.Since(startTime) < c.StartupGracePeriod
+
+	report := healthReport{Checks: map[string]string{
+		"event_loop": statusString(loopOK),
+		"workers":    statusString(workersOK),
+		"startup":    statusString(startupOK),
+	}}
+	writeHealth(w, loopOK && workersOK && startupOK, report)
+}
+
+// readyzHandler is the readiness probe. It passes while both connections
+// are up, the subscriptions are active and the internal queue has room.
+func readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	mqttOK, pulsarOK, queueOK, report := checkHealth()
+	subscribedOK, subscribed := checkSubscriptions()
+	report.Checks["subscriptions"] = subscribed
+	writeHealth(w, startupDone.Load() && mqttOK && pulsarOK && queueOK && subscribedOK, report)
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, report healthReport) {
+	report.Status = statusString(ok)
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+func statusString(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "fail"
+}
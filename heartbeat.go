@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// HeartbeatConfig periodically publishes a JSON status message, with the
+// connector's version, uptime and throughput, to MQTTTopic and PulsarTopic,
+// so monitoring on either side can tell a stalled bridge from a quiet one.
+// Heartbeats are disabled without an Interval or without either topic.
+type HeartbeatConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	MQTTTopic   string        `yaml:"mqtt_topic"`
+	QoS         byte          `yaml:"qos"`
+	PulsarTopic string        `yaml:"pulsar_topic"`
+}
+
+func (c HeartbeatConfig) enabled() bool {
+	return c.Interval > 0 && (c.MQTTTopic != "" || c.PulsarTopic != "")
+}
+
+type heartbeat struct {
+	ClientID         string  `json:"client_id"`
+	Version          string  `json:"version"`
+	UptimeSeconds    float64 `json:"uptime_seconds"`
+	MessagesProduced uint64  `json:"messages_produced"`
+	MessagesPerSec   float64 `json:"messages_per_second"`
+	Timestamp        string  `json:"timestamp"`
+}
+
+// runHeartbeat publishes a heartbeat every interval until ctx is cancelled.
+func runHeartbeat(ctx context.Context, c HeartbeatConfig) {
+	started := time.Now()
+	last, lastAt := producedTotal(), started
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			total := producedTotal()
+			payload, _ := json.Marshal(heartbeat{
+				ClientID:         cfg.MQTT.ClientID,
+				Version:          version,
+				UptimeSeconds:    now.Sub(started).Seconds(),
+				MessagesProduced: total,
+				MessagesPerSec:   float64(total-last) / now.Sub(lastAt).Seconds(),
+				Timestamp:        now.UTC().Format(time.RFC3339Nano),
+			})
+			last, lastAt = total, now
+			publishHeartbeat(ctx, c, payload)
+		}
+	}
+}
+
+func publishHeartbeat(ctx context.Context, c HeartbeatConfig, payload []byte) {
+	if c.MQTTTopic != "" {
+		if err := client.Publish(c.MQTTTopic, c.QoS, false, payload); err != nil {
+			slog.Warn("Failed to publish heartbeat", "mqtt_topic", c.MQTTTopic, "error", err)
+		}
+	}
+	if c.PulsarTopic == "" || dryRun {
+		return
+	}
+	producer, ok := getOrCreateProducer(c.PulsarTopic, cfg.Pulsar.Producer, nil)
+	if !ok {
+		slog.Warn("Failed to get heartbeat producer", "pulsar_topic", c.PulsarTopic)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if _, err := producer.Send(ctx, &pulsar.ProducerMessage{Payload: payload, Key: cfg.MQTT.ClientID}); err != nil {
+		slog.Warn("Failed to publish heartbeat", "pulsar_topic", c.PulsarTopic, "error", err)
+	}
+}
+
+// producedTotal returns the number of messages produced since startup.
+func producedTotal() uint64 {
+	var total uint64
+	for _, tp := range throughput.snapshot() {
+		total += tp.Total
+	}
+	return total
+}
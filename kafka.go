@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// KafkaConfig configures the Kafka sink. RequiredAcks is one of none, one
+// or all (the default); Compression one of none, gzip, snappy, lz4 or zstd.
+// Username and Password enable SASL/PLAIN. Sends are retried up to
+// retry.max_attempts times; messages that still fail are counted as
+// send_failed and left unacked, as there is no disk buffer or dead-letter
+// topic for Kafka.
+type KafkaConfig struct {
+	Brokers      []string      `yaml:"brokers"`
+	RequiredAcks string        `yaml:"required_acks"`
+	Compression  string        `yaml:"compression"`
+	BatchTimeout time.Duration `yaml:"batch_timeout"`
+	TLS          TLSConfig     `yaml:"tls"`
+	Username     string        `yaml:"username"`
+	Password     string        `yaml:"password"`
+}
+
+func parseRequiredAcks(s string) (kafka.RequiredAcks, error) {
+	switch s {
+	case "", "all":
+		return kafka.RequireAll, nil
+	case "one":
+		return kafka.RequireOne, nil
+	case "none":
+		return kafka.RequireNone, nil
+	default:
+		return 0, fmt.Errorf("unknown required acks %q", s)
+	}
+}
+
+func parseKafkaCompression(s string) (kafka.Compression, error) {
+	switch s {
+	case "", "none":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	default:
+		return 0, fmt.Errorf("unknown compression type %q", s)
+	}
+}
+
+func (c KafkaConfig) validate() error {
+	if len(c.Brokers) == 0 {
+		return errors.New("kafka.brokers is required")
+	}
+	if _, err := parseRequiredAcks(c.RequiredAcks); err != nil {
+		return err
+	}
+	if _, err := parseKafkaCompression(c.Compression); err != nil {
+		return err
+	}
+	return nil
+}
+
+var (
+	// kafkaTopicPattern matches the characters Kafka allows in topic names.
+	kafkaTopicPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]*$`)
+	// topicPlaceholderPattern matches the parts of a topic template that
+	// expand per message: Go template actions, {placeholders} and regex
+	// captures.
+	topicPlaceholderPattern = regexp.MustCompile(`\{\{.*?\}\}|\{[^}]*\}|\$\{?\w+\}?`)
+)
+
+// validateKafkaTopic checks the fixed parts of a topic template against
+// Kafka's topic name rules. The parts that expand per message can't be
+// checked before a message arrives.
+func validateKafkaTopic(tmpl string) error {
+	literal := topicPlaceholderPattern.ReplaceAllString(tmpl, "")
+	if len(literal) > 249 || !kafkaTopicPattern.MatchString(literal) {
+		return fmt.Errorf("invalid kafka topic %q: only letters, digits, '.', '_' and '-' are allowed", tmpl)
+	}
+	if literal == tmpl && (tmpl == "" || tmpl == "." || tmpl == "..") {
+		return fmt.Errorf("invalid kafka topic %q", tmpl)
+	}
+	return nil
+}
+
+// kafkaSink produces through an asynchronous writer, which batches messages
+// across workers and reports each batch to complete.
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+// kafkaPending is what the writer hands back for a message on completion.
+type kafkaPending struct {
+	ctx  context.Context
+	span trace.Span
+	msg  *Message
+}
+
+func newKafkaSink(c KafkaConfig) (*kafkaSink, error) {
+	acks, _ := parseRequiredAcks(c.RequiredAcks)
+	compression, _ := parseKafkaCompression(c.Compression)
+	transport := &kafka.Transport{}
+	if c.TLS.enabled() {
+		tlsConfig, err := newTLSConfig(c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLS = tlsConfig
+	}
+	if c.Username != "" {
+		transport.SASL = plain.Mechanism{Username: c.Username, Password: c.Password}
+	}
+
+	s := &kafkaSink{}
+	s.writer = &kafka.Writer{
+		Addr:         kafka.TCP(c.Brokers...),
+		Balancer:     &kafka.Hash{},
+		MaxAttempts:  max(cfg.Retry.MaxAttempts, 1),
+		BatchTimeout: c.BatchTimeout,
+		RequiredAcks: acks,
+		Compression:  compression,
+		Transport:    transport,
+		Async:        true,
+		Completion:   s.complete,
+	}
+	return s, nil
+}
+
+func (s *kafkaSink) Produce(ctx context.Context, msg *Message, dest Destination) {
+	ctx, span := tracer.Start(ctx, "send-to-kafka", trace.WithAttributes(attribute.String("kafka.topic", dest.Topic)))
+
+	payload, err := dest.encodePayload(msg.Payload)
+	if err != nil {
+		logSampled(slog.LevelWarn, msg.Topic, "Payload does not match the producer schema", "mqtt_topic", msg.Topic, "kafka_topic", dest.Topic, "error", err)
+		messagesInvalid.With(prometheus.Labels{"rule": dest.route.name()}).Inc()
+		quarantine(ctx, msg, err)
+		span.End()
+		return
+	}
+
+	key := dest.messageKey(msg)
+	if dryRun {
+		logDryRun(msg, dest.Topic, key, len(payload))
+		span.End()
+		return
+	}
+
+	props := messageProperties(msg)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(props))
+	headers := make([]kafka.Header, 0, len(props))
+	for k, v := range props {
+		headers = append(headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	km := kafka.Message{
+		Topic:      dest.Topic,
+		Value:      payload,
+		Headers:    headers,
+		Time:       dest.eventTime(msg),
+		WriterData: &kafkaPending{ctx: ctx, span: span, msg: msg},
+	}
+	if key != "" {
+		km.Key = []byte(key)
+	}
+
+	messagesInFlight.Inc()
+	inFlight.Add(1)
+	if err := s.writer.WriteMessages(ctx, km); err != nil {
+		s.complete([]kafka.Message{km}, err)
+	}
+}
+
+// complete settles a batch the writer has finished with.
+func (s *kafkaSink) complete(messages []kafka.Message, err error) {
+	for _, km := range messages {
+		p := km.WriterData.(*kafkaPending)
+		messagesInFlight.Dec()
+		labels := prometheus.Labels{"topic": km.Topic}
+		if err != nil {
+			slog.Error("Failed to send message", "mqtt_topic", p.msg.Topic, "kafka_topic", km.Topic, "error", err)
+			sendFailures.With(labels).Inc()
+			// Not acked: with manual acknowledgement the broker redelivers it
+			messagesDropped.With(prometheus.Labels{"reason": dropSendFailed}).Inc()
+			countBridge(p.msg, "dropped")
+		} else {
+			p.msg.Ack()
+			messagesProduced.With(labels).Inc()
+			countBytesProduced(km.Topic, len(km.Value))
+			countBridge(p.msg, "produced")
+			throughput.record(km.Topic)
+			observeLatency(p.msg, km.Topic)
+		}
+		p.span.End()
+		inFlight.Done()
+	}
+}
+
+func (s *kafkaSink) Close() {
+	if err := s.writer.Close(); err != nil {
+		slog.Error("Failed to close Kafka writer", "error", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderElectionConfig runs replicas active/passive using a Kubernetes
+// Lease. Only the replica holding the lease subscribes to MQTT; the others
+// stay connected and take over when the lease expires or is released.
+// Namespace defaults to the pod's namespace and Identity to the hostname.
+type LeaderElectionConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	LeaseName     string        `yaml:"lease_name"`
+	Namespace     string        `yaml:"namespace"`
+	Identity      string        `yaml:"identity"`
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+	RenewDeadline time.Duration `yaml:"renew_deadline"`
+	RetryPeriod   time.Duration `yaml:"retry_period"`
+}
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+func (c LeaderElectionConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.LeaseName == "" {
+		return fmt.Errorf("lease_name is required")
+	}
+	if c.LeaseDuration <= c.RenewDeadline || c.RenewDeadline <= c.RetryPeriod || c.RetryPeriod <= 0 {
+		return fmt.Errorf("lease_duration must exceed renew_deadline, which must exceed retry_period")
+	}
+	return nil
+}
+
+// newLeaderElector prepares the election against the Kubernetes API of the
+// cluster the connector runs in.
+func newLeaderElector(c LeaderElectionConfig) (*leaderelection.LeaderElector, error) {
+	restCfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading in-cluster config: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := c.Namespace
+	if namespace == "" {
+		data, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("determining namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	identity := c.Identity
+	if identity == "" {
+		if identity, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("determining identity: %w", err)
+		}
+	}
+
+	return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: c.LeaseName, Namespace: namespace},
+			Client:     clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   c.LeaseDuration,
+		RenewDeadline:   c.RenewDeadline,
+		RetryPeriod:     c.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            c.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				slog.Info("Became leader, subscribing to MQTT", "identity", identity)
+				subscribeToMQTT(client)
+			},
+			OnStoppedLeading: func() {
+				slog.Warn("Lost leadership, unsubscribing from MQTT", "identity", identity)
+				unsubscribeFromMQTT(client)
+			},
+		},
+	})
+}
+
+// runLeaderElection campaigns for the lease until ctx is cancelled, running
+// for it again whenever leadership is lost.
+func runLeaderElection(ctx context.Context, le *leaderelection.LeaderElector) {
+	for ctx.Err() == nil {
+		le.Run(ctx)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type LogConfig struct {
+	// Level is one of debug, info, warn or error.
+	Level string `yaml:"level"`
+	// Format is either text or json.
+	Format string `yaml:"format"`
+	// SampleEvery logs only every Nth per-message line for each MQTT topic,
+	// keeping log volume bounded at high throughput. Failures that lose a
+	// message are always logged. 0 or 1 logs every line.
+	SampleEvery int `yaml:"sample_every"`
+}
+
+// setupLogger installs the default slog logger according to the config.
+func setupLogger(c LogConfig) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", c.Level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(c.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", c.Format)
+	}
+
+	if c.SampleEvery < 0 {
+		return fmt.Errorf("invalid log sample_every %d", c.SampleEvery)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	logSampleEvery.Store(uint64(c.SampleEvery))
+	return nil
+}
+
+var (
+	logSampleEvery atomic.Uint64
+	// logSampleCounts counts per-message lines by topic hash, which bounds
+	// memory however many topics there are at the price of topics sharing
+	// a counter now and then.
+	logSampleCounts [1024]atomic.Uint64
+)
+
+// logSampled logs a per-message line about mqttTopic, subject to sampling.
+func logSampled(level slog.Level, mqttTopic, msg string, args ...any) {
+	ctx := context.Background()
+	if !slog.Default().Enabled(ctx, level) {
+		return
+	}
+	if n := logSampleEvery.Load(); n > 1 {
+		h := fnv.New32a()
+		h.Write([]byte(mqttTopic))
+		if logSampleCounts[h.Sum32()%uint32(len(logSampleCounts))].Add(1)%n != 1 {
+			return
+		}
+		args = append(args, "sample_every", n)
+	}
+	slog.Log(ctx, level, msg, args...)
+}
+
+// fatal logs at error level and exits, mirroring log.Fatal for slog.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
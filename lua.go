@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// newLuaTransformer runs an inline Lua script. The script must define
+//
+//	function transform(topic, payload)
+//
+// returning the new payload and, optionally, the Pulsar topic to send it
+// to instead of the mapped one. Returning nil drops the message and
+// raising an error fails it. Besides the base, string, table and math
+// libraries, scripts can call json_decode and json_encode.
+func newLuaTransformer(step TransformStep) (Transformer, error) {
+	if step.Script == "" {
+		return nil, errors.New("lua requires script")
+	}
+	chunk, err := parse.Parse(strings.NewReader(step.Script), "script")
+	if err != nil {
+		return nil, fmt.Errorf("parsing lua script: %w", err)
+	}
+	proto, err := lua.Compile(chunk, "script")
+	if err != nil {
+		return nil, fmt.Errorf("compiling lua script: %w", err)
+	}
+
+	t := &luaTransformer{proto: proto}
+	// Load the script once up front so errors surface as config errors
+	L, err := t.newState()
+	if err != nil {
+		return nil, err
+	}
+	t.states.Put(L)
+	return t, nil
+}
+
+// luaTransformer keeps a pool of interpreters, since an LState can't be
+// used from more than one worker at a time.
+type luaTransformer struct {
+	proto  *lua.FunctionProto
+	states sync.Pool
+}
+
+func (t *luaTransformer) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.StringLibName: lua.OpenString,
+		lua.TabLibName:    lua.OpenTable,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	L.SetGlobal("json_decode", L.NewFunction(luaJSONDecode))
+	L.SetGlobal("json_encode", L.NewFunction(luaJSONEncode))
+
+	L.Push(L.NewFunctionFromProto(t.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("running lua script: %w", err)
+	}
+	if _, ok := L.GetGlobal("transform").(*lua.LFunction); !ok {
+		L.Close()
+		return nil, errors.New("lua script does not define function transform")
+	}
+	return L, nil
+}
+
+// Close does nothing: idle interpreters are garbage collected with the
+// pool.
+func (t *luaTransformer) Close() {}
+
+func (t *luaTransformer) Transform(msg *Message) error {
+	L, _ := t.states.Get().(*lua.LState)
+	if L == nil {
+		var err error
+		if L, err = t.newState(); err != nil {
+			return err
+		}
+	}
+	defer t.states.Put(L)
+
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal("transform"), NRet: 2, Protect: true},
+		lua.LString(msg.Topic), lua.LString(msg.Payload))
+	if err != nil {
+		return fmt.Errorf("lua script: %w", err)
+	}
+	payload, topic := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+
+	switch payload := payload.(type) {
+	case *lua.LNilType:
+		return errDropMessage
+	case lua.LString:
+		msg.Payload = []byte(payload)
+	default:
+		return fmt.Errorf("lua script returned %s instead of a string payload", payload.Type())
+	}
+	if topic, ok := topic.(lua.LString); ok && topic != "" {
+		msg.rerouteTopic = string(topic)
+	}
+	return nil
+}
+
+func luaJSONDecode(L *lua.LState) int {
+	var v any
+	if err := json.Unmarshal([]byte(L.CheckString(1)), &v); err != nil {
+		L.RaiseError("json_decode: %v", err)
+	}
+	L.Push(toLua(L, v))
+	return 1
+}
+
+func luaJSONEncode(L *lua.LState) int {
+	b, err := json.Marshal(fromLua(L.CheckAny(1)))
+	if err != nil {
+		L.RaiseError("json_encode: %v", err)
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+func toLua(L *lua.LState, v any) lua.LValue {
+	switch v := v.(type) {
+	case map[string]any:
+		t := L.NewTable()
+		for k, e := range v {
+			t.RawSetString(k, toLua(L, e))
+		}
+		return t
+	case []any:
+		t := L.NewTable()
+		for _, e := range v {
+			t.Append(toLua(L, e))
+		}
+		return t
+	case string:
+		return lua.LString(v)
+	case float64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	default:
+		return lua.LNil
+	}
+}
+
+// fromLua converts a Lua value for JSON encoding. Tables with only keys
+// 1..n become arrays; any other table becomes an object.
+func fromLua(v lua.LValue) any {
+	switch v := v.(type) {
+	case *lua.LTable:
+		if n := v.MaxN(); n > 0 && countKeys(v) == n {
+			arr := make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				arr = append(arr, fromLua(v.RawGetInt(i)))
+			}
+			return arr
+		}
+		obj := make(map[string]any)
+		v.ForEach(func(k, e lua.LValue) {
+			obj[k.String()] = fromLua(e)
+		})
+		return obj
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LBool:
+		return bool(v)
+	default:
+		return nil
+	}
+}
+
+func countKeys(t *lua.LTable) int {
+	n := 0
+	t.ForEach(func(lua.LValue, lua.LValue) { n++ })
+	return n
+}
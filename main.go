@@ -2,32 +2,135 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/signal"
 	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/apache/pulsar-client-go/pulsar"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/grafana/pyroscope-go"
 	"github.com/joho/godotenv"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	_ "go.uber.org/automaxprocs"
 )
 
 var (
-	pulsarProducers  = &sync.Map{}
-	pulsarClient     pulsar.Client
-	client           mqtt.Client
-	profiler         *pyroscope.Profiler
+	cfg          *Config
+	routing      atomic.Pointer[pipeline]
+	limiter      *rateLimiter
+	dedup        *deduplicator
+	breaker      *circuitBreaker
+	pool         *workerPool
+	producers    *producerCache
+	pulsarClient *clusterClient
+	client       *rotatingConn
+	buffer       *diskBuffer
+	reverse      *reverseBridge
+	profiler     *pyroscope.Profiler
+	tracer       = otel.Tracer("mqtt-to-pulsar")
+	// inFlight tracks sends awaiting a result, so shutdown can drain them.
+	inFlight sync.WaitGroup
+	// sendsCtx is cancelled when shutdown gives up draining, aborting sends
+	// still blocked on a full producer queue.
+	sendsCtx, cancelSends = context.WithCancel(context.Background())
+	txns                  *txnBatcher
+	// dryRun logs what would be produced instead of producing it.
+	dryRun               bool
+	mqttMessagesReceived = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_messages_received",
+			Help: "Number of messages received from the MQTT broker",
+		},
+		[]string{"topic"},
+	)
+	messagesDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "messages_dropped",
+			Help: "Number of messages that were not produced to their Pulsar topic, by reason",
+		},
+		[]string{"reason"},
+	)
+	pulsarSendErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pulsar_send_errors",
+			Help: "Number of failed Pulsar send attempts, including ones that are retried",
+		},
+		[]string{"topic"},
+	)
+	producerCreateErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "producer_create_errors",
+			Help: "Number of failed attempts to create a Pulsar producer",
+		},
+		[]string{"topic"},
+	)
+	messagesInFlight = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "messages_in_flight",
+			Help: "Number of messages sent to Pulsar and awaiting acknowledgement, including pending retries",
+		},
+	)
+	queuePending = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "queue_pending_messages",
+			Help: "Number of messages waiting in the worker queue",
+		},
+		func() float64 {
+			if pool == nil {
+				return 0
+			}
+			return float64(pool.Len())
+		},
+	)
+	queueOverflows = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_overflows",
+			Help: "Number of messages submitted to a full worker queue, by outcome: blocked, dropped_newest or dropped_oldest",
+		},
+		[]string{"outcome"},
+	)
+	mqttBackpressure = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "mqtt_backpressure",
+			Help: "Whether MQTT consumption is held up by a full worker queue (1) or not (0)",
+		},
+		func() float64 {
+			if pool != nil && pool.Blocked() {
+				return 1
+			}
+			return 0
+		},
+	)
+	queueCapacity = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "queue_capacity",
+			Help: "Capacity of the worker queue",
+		},
+		func() float64 { return float64(cfg.Processing.QueueSize) },
+	)
+	bufferBytes = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "buffer_bytes",
+			Help: "Number of bytes held in the disk buffer",
+		},
+		func() float64 {
+			if buffer == nil {
+				return 0
+			}
+			return float64(buffer.Size())
+		},
+	)
 	messagesProduced = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "messages_produced",
@@ -35,167 +138,934 @@ var (
 		},
 		[]string{"topic"},
 	)
+	messagesDeadLettered = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "messages_dead_lettered",
+			Help: "Number of messages published to the dead-letter topic",
+		},
+		[]string{"topic"},
+	)
+	messagesInvalid = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "messages_invalid",
+			Help: "Number of messages that failed JSON Schema validation",
+		},
+		[]string{"rule"},
+	)
+	messagesQuarantined = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "messages_quarantined",
+			Help: "Number of invalid messages published to the quarantine topic",
+		},
+		[]string{"topic"},
+	)
+	bridgeLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "bridge_latency_seconds",
+			Help:    "Time from MQTT receipt to Pulsar acknowledgement",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+		},
+		[]string{"topic"},
+	)
+	endToEndLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "end_to_end_latency_seconds",
+			Help:    "Time from the device timestamp in the payload to Pulsar acknowledgement",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 20),
+		},
+		[]string{"topic"},
+	)
+	sendRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pulsar_send_retries",
+			Help: "Number of Pulsar sends retried after a failure",
+		},
+		[]string{"topic"},
+	)
+	sendFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pulsar_send_failures",
+			Help: "Number of messages that could not be sent after exhausting all retries",
+		},
+		[]string{"topic"},
+	)
+	mqttConnectionsLost = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mqtt_connections_lost",
+			Help: "Number of times the connection to the MQTT broker was lost",
+		},
+	)
+	mqttReconnects = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mqtt_reconnects",
+			Help: "Number of successful reconnections to the MQTT broker",
+		},
+	)
+	mqttConnected = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "mqtt_connected",
+			Help: "Whether the connection to the MQTT broker, or any of them when several are configured, is up (1) or down (0)",
+		},
+		func() float64 {
+			if anyMQTTConnected() {
+				return 1
+			}
+			return 0
+		},
+	)
+	pulsarConnected = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "pulsar_connected",
+			Help: "Whether the most recent send to Pulsar succeeded (1) or failed (0)",
+		},
+		func() float64 {
+			if pulsarClient != nil && pulsarHealthy.Load() {
+				return 1
+			}
+			return 0
+		},
+	)
+	pulsarReconnects = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pulsar_reconnects",
+			Help: "Number of times sends to Pulsar succeeded again after failing",
+		},
+	)
+	messagesBuffered = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "messages_buffered",
+			Help: "Number of messages written to the disk buffer",
+		},
+		[]string{"topic"},
+	)
+	messagesReplayed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "messages_replayed",
+			Help: "Number of buffered messages replayed to Pulsar",
+		},
+		[]string{"topic"},
+	)
+	messagesPublishedToMQTT = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "messages_published_to_mqtt",
+			Help: "Number of Pulsar messages published to MQTT by the reverse bridge",
+		},
+		[]string{"topic"},
+	)
+	pulsarFailovers = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pulsar_failovers",
+			Help: "Number of switches between Pulsar clusters",
+		},
+	)
+	pulsarActiveCluster = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "pulsar_active_cluster",
+			Help: "Index of the active Pulsar cluster: 0 is the primary, 1 the first standby and so on",
+		},
+		func() float64 {
+			if pulsarClient == nil {
+				return 0
+			}
+			return float64(pulsarClient.active.Load())
+		},
+	)
+	circuitBreakerState = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pulsar_circuit_breaker_state",
+			Help: "State of the Pulsar circuit breaker: 0 closed, 1 open, 2 half-open",
+		},
+	)
+	messagesBufferExpired = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "messages_buffer_expired",
+			Help: "Number of buffered messages discarded after exceeding the retention period",
+		},
+	)
+	bridgeMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bridge_messages",
+			Help: "Number of messages per bridge that were received, produced or dropped",
+		},
+		[]string{"bridge", "outcome"},
+	)
+	messagesUnmapped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "messages_unmapped",
+			Help: "Number of messages whose topic matched no mapping rule or topic map entry, including those sent to the default topic",
+		},
+	)
+	messagesDryRun = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "messages_dry_run",
+			Help: "Number of messages that would have been produced to Pulsar in dry-run mode",
+		},
+		[]string{"topic"},
+	)
 )
 
 func main() {
 	// Load environment variables from .env file
 	if err := godotenv.Load(); err != nil {
 		if os.IsNotExist(err) {
-			log.Println("No .env file found, using environment variables directly.")
+			slog.Info("No .env file found, using environment variables directly")
 		} else {
-			log.Printf("Error loading .env file: %v\n", err)
+			slog.Warn("Error loading .env file", "error", err)
 		}
 	}
 
-	var profError error
-	profiler, profError = setupProfiling()
-	if profError != nil {
-		log.Fatal(profError)
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
 	}
+}
 
-	// Connect to MQTT Broker
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(os.Getenv("MQTT_BROKER_URL"))
-	opts.ClientID = os.Getenv("MQTT_CLIENT_ID")
-	opts.Password = os.Getenv("MQTT_PASSWORD")
-	opts.Username = os.Getenv("MQTT_USERNAME")
-	client = mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
+// initConfig loads the config into cfg and sets up logging accordingly.
+func initConfig(configPath string) error {
+	var err error
+	if cfg, err = loadConfig(configPath); err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if err := setupLogger(cfg.Log); err != nil {
+		return fmt.Errorf("setting up logging: %w", err)
+	}
+	return nil
+}
+
+// initPipeline builds the mapping, transforms, filters and validation rules
+// from cfg. Each part is built even if another fails, so the error lists
+// every problem.
+func initPipeline() error {
+	if cfg.SchemaRegistry.URL != "" {
+		schemaRegistry = newRegistryClient(cfg.SchemaRegistry)
+	}
+	p, err := newPipeline(cfg, nil)
+	if err != nil {
+		return err
+	}
+	routing.Store(p)
+	return nil
+}
+
+// run is the run command: it bridges messages until SIGINT or SIGTERM.
+func run(configPath string) {
+	if err := initConfig(configPath); err != nil {
+		fatal("Failed to start", "error", err)
+	}
+
+	// Fetch credentials from Vault before connecting anywhere
+	var vault *vaultClient
+	if cfg.Vault.Address != "" {
+		var vaultError error
+		vault, vaultError = applyVaultSecrets(context.Background(), cfg)
+		if vaultError != nil {
+			fatal("Failed to fetch credentials from Vault", "error", vaultError)
+		}
+		slog.Info("Fetched credentials from Vault", "address", cfg.Vault.Address)
+	}
+
+	if err := initPipeline(); err != nil {
+		fatal("Failed to start", "error", err)
+	}
+
+	limiter = newRateLimiter(cfg.RateLimit)
+	if cfg.Dedup.Window > 0 {
+		dedup = newDeduplicator(cfg.Dedup)
+	}
+
+	shutdownTracing, tracingError := setupTracing(context.Background(), cfg.Tracing)
+	if tracingError != nil {
+		fatal("Failed to set up tracing", "error", tracingError)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("Failed to flush traces", "error", err)
+		}
+	}()
+
+	shutdownMetricsExport, metricsError := setupMetricsExport(context.Background(), cfg.Metrics.OTLP)
+	if metricsError != nil {
+		fatal("Failed to set up OTLP metrics export", "error", metricsError)
+	}
+	defer func() {
+		if err := shutdownMetricsExport(context.Background()); err != nil {
+			slog.Error("Failed to flush metrics", "error", err)
+		}
+	}()
+
+	// Profiling is optional, so the connector runs on without it
+	if cfg.Profiling.ServerAddress != "" {
+		var profError error
+		profiler, profError = setupProfiling(cfg.Profiling)
+		if profError != nil {
+			slog.Error("Failed to start profiler, continuing without it", "error", profError)
+		}
+	}
+
+	// Serve metrics and probes while connecting, so a slow broker fails the
+	// startup probe rather than looking like a dead process
+	go runWatchdog(context.Background())
+	startMetricsServer(cfg.Metrics)
+
+	if cfg.Profiling.Pprof.Enabled && cfg.Profiling.Pprof.Port != "" {
+		go servePprof(cfg.Profiling.Pprof.Port)
 	}
-	log.Println("Connected to mqtt")
 
 	// Connect to Pulsar
 	var errPulsar error
-	pulsarClient, errPulsar = pulsar.NewClient(pulsar.ClientOptions{
-		URL:          os.Getenv("PULSAR_BROKER_URL"),
-		ListenerName: "internal",
-	})
+	pulsarClient, errPulsar = newClusterClient(cfg.Pulsar)
 	if errPulsar != nil {
-		log.Fatal(errPulsar)
+		fatal("Failed to create Pulsar client", "error", errPulsar)
 	}
 	defer pulsarClient.Close()
+	pulsarHealthy.Store(true)
+	producers = newProducerCache(cfg.Pulsar.ProducerCache)
+	breaker = newCircuitBreaker(cfg.CircuitBreaker)
+	if cfg.Pulsar.Transactions.Enabled {
+		txns = newTxnBatcher(cfg.Pulsar.Transactions)
+	}
 
-	log.Println("Connected to pulsar")
+	slog.Info("Connected to Pulsar", "url", cfg.Pulsar.URL)
+	if dryRun {
+		slog.Warn("Dry run: messages are logged instead of produced to Pulsar")
+	}
 
-	// Start Prometheus metrics endpoint
-	go func() {
-		port := os.Getenv("PROMETHEUS_PORT")
-		log.Printf("Starting Prometheus metrics at http://localhost:%s/metrics\n", port)
-		http.Handle("/metrics", promhttp.Handler())
-		if err := http.ListenAndServe(fmt.Sprintf(":%s", port), nil); err != nil {
-			log.Fatal(err)
+	if !dryRun {
+		if err := registerSchemas(routing.Load().mapper, cfg.Mapping.SchemaCheck); err != nil {
+			fatal("Schema check failed", "error", err)
 		}
-	}()
-
-	// Subscribe to MQTT topics with wildcard
-	subscribeToMQTT(client)
+		for name, p := range routing.Load().bridges {
+			if !p.sink.config.pulsar() {
+				continue
+			}
+			if err := registerSchemas(p.mapper, cfg.Mapping.SchemaCheck); err != nil {
+				fatal("Schema check failed", "bridge", name, "error", err)
+			}
+		}
+	}
 
 	// Capture SIGINT and SIGTERM signals
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	go producers.run(ctx)
+	go pulsarClient.run(ctx)
+	go limiter.run(ctx)
+	if dedup != nil {
+		go dedup.run(ctx)
+	}
+
+	// Open the disk buffer and replay anything left from a previous run
+	if cfg.Buffer.Dir != "" && !dryRun {
+		var errBuffer error
+		buffer, errBuffer = newDiskBuffer(cfg.Buffer)
+		if errBuffer != nil {
+			fatal("Failed to open disk buffer", "error", errBuffer)
+		}
+		go buffer.run(ctx, replayBufferedRecord)
+	}
+
+	// Apply the latest routing update before routing anything
+	if cfg.Control.Topic != "" {
+		if err := startControlReader(ctx, configPath, cfg.Control); err != nil {
+			fatal("Failed to read the control topic", "pulsar_topic", cfg.Control.Topic, "error", err)
+		}
+	}
+
+	// Start the workers before connecting to MQTT, so no message is dropped,
+	// including those a persistent session delivers right away
+	pool = newWorkerPool(cfg.Processing, handleMQTTMessage)
+
+	// Replay what the previous run accepted but didn't finish
+	if cfg.WAL.Dir != "" && !dryRun {
+		var unacked []*walRecord
+		var errWAL error
+		wal, unacked, errWAL = openWAL(cfg.WAL)
+		if errWAL != nil {
+			fatal("Failed to open write-ahead log", "error", errWAL)
+		}
+		replayWAL(unacked)
+	}
+
+	// Connect to MQTT Broker
+	conn, errMQTT := connectMQTT(cfg.MQTT)
+	if errMQTT != nil {
+		fatal("Failed to connect to MQTT", "error", errMQTT)
+	}
+	client = newRotatingConn(conn)
+	slog.Info("Connected to MQTT", "broker", cfg.MQTT.BrokerURL)
+	if err := connectSources(cfg); err != nil {
+		fatal("Failed to connect to sources", "error", err)
+	}
+
+	announceAvailability(true)
+
+	// Subscribe to the configured MQTT topic filters, or leave that to
+	// whichever replica is the leader
+	if cfg.LeaderElection.Enabled {
+		elector, errElector := newLeaderElector(cfg.LeaderElection)
+		if errElector != nil {
+			fatal("Failed to set up leader election", "error", errElector)
+		}
+		go runLeaderElection(ctx, elector)
+	} else {
+		subscribeToMQTT(client)
+	}
+	startupDone.Store(true)
+
+	// Start the admin API
+	if cfg.Admin.Port != "" {
+		go throughput.run(ctx)
+		go serveAdmin(cfg.Admin)
+	}
+
+	// Publish heartbeats for monitoring on both sides
+	if cfg.Heartbeat.enabled() {
+		go runHeartbeat(ctx, cfg.Heartbeat)
+	}
+
+	// Pick up rotated credentials
+	if cfg.Rotation.Interval > 0 {
+		go watchCredentials(ctx, cfg.Rotation, vault)
+	}
+
+	// Reload routing configuration on SIGHUP
+	go watchReload(ctx, configPath)
+	if cfg.Remote.enabled() {
+		go watchRemoteConfig(ctx, configPath, cfg.Remote)
+	}
+
+	// Start the Pulsar to MQTT pipeline
+	if len(cfg.Reverse.Routes) > 0 && !dryRun {
+		var errReverse error
+		reverse, errReverse = startReverseBridge(ctx, cfg.Reverse)
+		if errReverse != nil {
+			fatal("Failed to start reverse bridge", "error", errReverse)
+		}
+	}
+
 	// Wait for termination signal
 	<-ctx.Done()
 
 	// Begin shutdown process
-	log.Println("Received shutdown signal, starting graceful shutdown...")
+	slog.Info("Received shutdown signal, starting graceful shutdown")
 	shutdown()
 }
 
-func subscribeToMQTT(client mqtt.Client) {
-	token := client.Subscribe("device/#", 0, func(client mqtt.Client, msg mqtt.Message) {
-		handleMQTTMessage(msg)
-	})
-	if token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
+// mqttSubscribed is whether this replica currently holds the configured
+// subscriptions. Without leader election that is always the case after
+// startup.
+var mqttSubscribed atomic.Bool
+
+func subscribeToMQTT(client mqttConn) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	mqttSubscribed.Store(true)
+	for _, s := range cfg.MQTT.Subscriptions {
+		qos := s.qos(cfg.MQTT.QoS)
+		if err := client.Subscribe(s.Filter, qos, receiveMessage); err != nil {
+			fatal("Failed to subscribe", "filter", s.Filter, "error", err)
+		}
+		slog.Info("Subscribed to MQTT topic filter", "filter", s.Filter, "qos", qos)
+	}
+	if err := subscribeBridges(client); err != nil {
+		fatal("Failed to subscribe", "error", err)
+	}
+	if err := startSources(); err != nil {
+		fatal("Failed to start sources", "error", err)
+	}
+}
+
+func unsubscribeFromMQTT(client mqttConn) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if !mqttSubscribed.Swap(false) {
+		return
+	}
+	for _, s := range cfg.MQTT.Subscriptions {
+		if err := client.Unsubscribe(s.Filter); err != nil {
+			slog.Warn("Failed to unsubscribe", "filter", s.Filter, "error", err)
+		}
+	}
+	if err := unsubscribeBridges(client); err != nil {
+		slog.Warn("Failed to unsubscribe", "error", err)
 	}
+	stopSources()
 }
 
-func handleMQTTMessage(msg mqtt.Message) {
-	ctx := context.Background()
-	tracer := otel.GetTracerProvider().Tracer("mqtt-to-pulsar")
+// receiveMessage is the MQTT subscription callback. It hands the message to
+// the worker pool unless its topic is blocked or, in strict mode, not
+// allowed, or it is a retained message to skip.
+func receiveMessage(msg *Message) {
+	countReceived(msg)
+	countBridge(msg, "received")
+	if reason := msg.routing().acl.Check(msg.Topic); reason != "" {
+		logSampled(slog.LevelDebug, msg.Topic, "Topic not bridged, dropping message", "mqtt_topic", msg.Topic, "reason", reason)
+		msg.releaseRouting()
+		dropMessage(msg, reason)
+		return
+	}
+	if msg.Retained && cfg.MQTT.Retained == retainedSkip {
+		logSampled(slog.LevelDebug, msg.Topic, "Skipping retained message", "mqtt_topic", msg.Topic)
+		msg.releaseRouting()
+		dropMessage(msg, dropRetained)
+		return
+	}
+	if wal != nil {
+		if err := wal.Append(msg); err != nil {
+			slog.Error("Failed to write message to the WAL", "mqtt_topic", msg.Topic, "error", err)
+		}
+	}
+	pool.Submit(msg)
+}
+
+// Reasons a message was dropped, used as the messages_dropped label.
+const (
+	dropNoMapping       = "no_mapping"
+	dropBlocked         = "blocked"
+	dropNotAllowed      = "not_allowed"
+	dropRetained        = "retained"
+	dropFiltered        = "filtered"
+	dropTransformError  = "transform_error"
+	dropInvalid         = "invalid"
+	dropRateLimited     = "rate_limited"
+	dropDuplicate       = "duplicate"
+	dropTooLarge        = "too_large"
+	dropQueueFull       = "queue_full"
+	dropTenantViolation = "tenant_violation"
+	dropSendFailed      = "send_failed"
+	dropDeadLetterError = "dead_letter_failed"
+)
+
+// dropMessage counts a deliberately discarded message and acks it so the
+// broker does not redeliver it.
+func dropMessage(msg *Message, reason string) {
+	messagesDropped.With(prometheus.Labels{"reason": reason}).Inc()
+	countBridge(msg, "dropped")
+	msg.Ack()
+}
+
+func handleMQTTMessage(msg *Message) {
+	// Continue the device's trace when it sent a traceparent as an MQTT 5
+	// user property
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(msg.UserProperties))
 	ctx, span := tracer.Start(ctx, "produce-to-pulsar")
 	defer span.End()
+	defer msg.releaseRouting()
 
 	// Extract MQTT topic
-	mqttTopic := msg.Topic()
+	mqttTopic := msg.Topic
 
-	// Map MQTT topic to Pulsar topic using wildcard logic
-	pulsarTopic := mapMQTTToPulsarTopic(mqttTopic)
+	if !limiter.Allow(msg) {
+		logSampled(slog.LevelDebug, mqttTopic, "Rate limit exceeded, dropping message", "mqtt_topic", mqttTopic)
+		dropMessage(msg, dropRateLimited)
+		return
+	}
+
+	if dedup != nil && dedup.Duplicate(ctx, msg) {
+		logSampled(slog.LevelDebug, mqttTopic, "Duplicate message, dropping", "mqtt_topic", mqttTopic)
+		dropMessage(msg, dropDuplicate)
+		return
+	}
+
+	// Apply the transformation chain configured for the topic
+	if err := msg.routing().bridge(msg).transforms.Apply(msg); err != nil {
+		if errors.Is(err, errDropMessage) {
+			dropMessage(msg, dropFiltered)
+		} else {
+			logSampled(slog.LevelWarn, mqttTopic, "Failed to transform message, dropping", "mqtt_topic", mqttTopic, "error", err)
+			dropMessage(msg, dropTransformError)
+		}
+		return
+	}
+
+	routeMessage(ctx, msg)
+}
+
+// routeMessage filters, validates and maps a transformed message, then
+// produces it to each of its destinations.
+func routeMessage(ctx context.Context, msg *Message) {
+	mqttTopic := msg.Topic
+	current := msg.routing()
+
+	if !enforcePayloadLimit(ctx, msg) {
+		return
+	}
+
+	// Drop or reroute messages according to the filter expressions
+	if err := current.filters.Apply(msg); err != nil {
+		dropMessage(msg, dropFiltered)
+		return
+	}
+
+	// Reject payloads that don't match the topic's JSON Schema
+	if rule, err := current.validator.Validate(msg); err != nil {
+		logSampled(slog.LevelWarn, mqttTopic, "Payload failed schema validation", "mqtt_topic", mqttTopic, "rule", rule, "error", err)
+		messagesInvalid.With(prometheus.Labels{"rule": rule}).Inc()
+		quarantine(ctx, msg, err)
+		return
+	}
+
+	// Map MQTT topic to Pulsar topics using the configured rules
+	bridge := current.bridge(msg)
+	m := bridge.mapper
+	dests := m.Map(msg)
+	if m.unmapped(dests) {
+		messagesUnmapped.Inc()
+	}
+	if msg.rerouteTopic != "" {
+		dest := Destination{Topic: msg.rerouteTopic}
+		if len(dests) > 0 {
+			dest.route = dests[0].route
+		}
+		dests = []Destination{dest}
+	}
+	if len(dests) == 0 {
+		logSampled(slog.LevelWarn, mqttTopic, "No mapping rule for MQTT topic", "mqtt_topic", mqttTopic)
+		dropMessage(msg, dropNoMapping)
+		return
+	}
+
+	// Never let a message cross into another tenant's namespace
+	for _, dest := range dests {
+		if err := m.Permits(mqttTopic, dest.Topic); err != nil {
+			slog.Warn("Refusing to produce outside the tenant's namespace", "mqtt_topic", mqttTopic, "pulsar_topic", dest.Topic)
+			dropMessage(msg, dropTenantViolation)
+			return
+		}
+	}
+
+	// Each destination succeeds or fails on its own; the MQTT message is
+	// acked once all of them are done
+	for i, part := range msg.split(len(dests)) {
+		bridge.sink.Produce(ctx, part, dests[i])
+	}
+}
+
+// produce sends msg to a single destination.
+func produce(ctx context.Context, msg *Message, dest Destination) {
+	pulsarTopic := dest.Topic
+	ctx, span := tracer.Start(ctx, "send-to-pulsar", trace.WithAttributes(attribute.String("pulsar.topic", pulsarTopic)))
+
+	// Encode the payload for the destination's schema, if it has one
+	payload, err := dest.encodePayload(msg.Payload)
+	if err != nil {
+		logSampled(slog.LevelWarn, msg.Topic, "Payload does not match the producer schema", "mqtt_topic", msg.Topic, "pulsar_topic", pulsarTopic, "error", err)
+		messagesInvalid.With(prometheus.Labels{"rule": dest.route.name()}).Inc()
+		quarantine(ctx, msg, err)
+		span.End()
+		return
+	}
+
+	if dryRun {
+		logDryRun(msg, pulsarTopic, dest.messageKey(msg), len(payload))
+		span.End()
+		return
+	}
+
+	// Keep messages aside without trying Pulsar while it is failing
+	if !breaker.Allow() {
+		handleSendFailure(ctx, msg, pulsarTopic, errCircuitOpen)
+		span.End()
+		return
+	}
 
 	// Get or create Pulsar producer for the topic
-	producer, ok := getOrCreateProducer(pulsarTopic)
+	producer, ok := getOrCreateProducer(pulsarTopic, dest.producerConfig(), dest.producerSchema())
 	if !ok {
-		log.Printf("Failed to get or create producer for topic: %s\n", pulsarTopic)
+		breaker.Failure()
+		slog.Error("Failed to get or create producer", "mqtt_topic", msg.Topic, "pulsar_topic", pulsarTopic)
+		handleSendFailure(ctx, msg, pulsarTopic, errProducerUnavailable)
+		span.End()
 		return
 	}
 
 	pmsg := &pulsar.ProducerMessage{
-		Payload: msg.Payload(),
+		Payload:    payload,
+		Key:        dest.messageKey(msg),
+		Properties: messageProperties(msg),
+		EventTime:  dest.eventTime(msg),
+		DeliverAt:  dest.deliverAt(msg),
 	}
 
-	if _, err := producer.Send(ctx, pmsg); err != nil {
-		log.Println(err)
-	}
+	// Propagate the trace context so Pulsar consumers can continue the trace
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(pmsg.Properties))
 
-	log.Println("Message Processed")
+	messagesInFlight.Inc()
+	inFlight.Add(1)
 
-	// Increment Prometheus metric
-	messagesProduced.With(prometheus.Labels{"topic": pulsarTopic}).Inc()
+	// QoS 0 messages may be lost anyway, so they skip the transaction, as
+	// do non-persistent topics, which don't support them
+	if txns != nil && msg.QoS > 0 && dest.persistent() {
+		txns.Add(txnEntry{ctx: ctx, span: span, producer: producer, pmsg: pmsg, msg: msg, pulsarTopic: pulsarTopic})
+		return
+	}
+	sendMessage(ctx, span, producer, dest.producerConfig(), dest.producerSchema(), pmsg, msg, pulsarTopic, 1, nil)
 }
 
-func getOrCreateProducer(topic string) (pulsar.Producer, bool) {
-	value, ok := pulsarProducers.Load(topic)
-	if ok {
-		return value.(pulsar.Producer), true
+// sendMessage sends pmsg asynchronously, rescheduling itself according to
+// the retry policy when the send fails. The span is ended once the message
+// has been sent or given up on, and so is release, which frees the topic
+// for the next message when sequence IDs are assigned.
+func sendMessage(ctx context.Context, span trace.Span, producer pulsar.Producer, pc ProducerConfig, schema pulsar.Schema,
+	pmsg *pulsar.ProducerMessage, msg *Message, pulsarTopic string, attempt int, release func()) {
+	if release == nil {
+		release = func() {}
 	}
+	if pc.Deduplication && attempt == 1 {
+		id, persisted, done := sequences.acquire(pulsarTopic, producer, msg, pmsg)
+		if persisted {
+			done()
+			// Pulsar has the message, so this counts as a success, which
+			// also settles a half-open probe
+			breaker.Success()
+			messagesInFlight.Dec()
+			inFlight.Done()
+			span.End()
+			dropMessage(msg, dropDuplicate)
+			return
+		}
+		release = done
+		if wal != nil && msg.walSeq != 0 {
+			wal.sent(msg.walSeq, pulsarTopic, id)
+		}
+	}
+	sendCtx, cancel := sendContext(ctx, pc.SendTimeout)
+	producer.SendAsync(sendCtx, pmsg, func(id pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+		cancel()
+		if err != nil {
+			setPulsarHealthy(false)
+			breaker.Failure()
+			pulsarSendErrors.With(prometheus.Labels{"topic": pulsarTopic}).Inc()
+			if attempt < cfg.Retry.MaxAttempts {
+				delay := cfg.Retry.backoff(attempt)
+				logSampled(slog.LevelWarn, msg.Topic, "Failed to send message, retrying", "mqtt_topic", msg.Topic, "pulsar_topic", pulsarTopic,
+					"attempt", attempt, "backoff", delay, "error", err)
+				sendRetries.With(prometheus.Labels{"topic": pulsarTopic}).Inc()
+				time.AfterFunc(delay, func() {
+					// Look the producer up again; it may have been evicted
+					// and closed in the meantime.
+					retryProducer, ok := getOrCreateProducer(pulsarTopic, pc, schema)
+					if !ok {
+						release()
+						breaker.Failure()
+						messagesInFlight.Dec()
+						inFlight.Done()
+						span.End()
+						handleSendFailure(ctx, msg, pulsarTopic, errProducerUnavailable)
+						return
+					}
+					sendMessage(ctx, span, retryProducer, pc, schema, pmsg, msg, pulsarTopic, attempt+1, release)
+				})
+				return
+			}
+
+			release()
+			defer span.End()
+			defer inFlight.Done()
+			messagesInFlight.Dec()
+			slog.Error("Failed to send message", "mqtt_topic", msg.Topic, "pulsar_topic", pulsarTopic,
+				"attempts", attempt, "error", err)
+			sendFailures.With(prometheus.Labels{"topic": pulsarTopic}).Inc()
+			handleSendFailure(ctx, msg, pulsarTopic, err)
+			return
+		}
 
-	producer, err := pulsarClient.CreateProducer(pulsar.ProducerOptions{
-		Topic: topic,
+		release()
+		defer span.End()
+		defer inFlight.Done()
+		messagesInFlight.Dec()
+		setPulsarHealthy(true)
+		breaker.Success()
+		msg.Ack()
+		logSampled(slog.LevelDebug, msg.Topic, "Message processed", "mqtt_topic", msg.Topic, "pulsar_topic", pulsarTopic, "message_id", id.String())
+
+		// Increment Prometheus metric
+		messagesProduced.With(prometheus.Labels{"topic": pulsarTopic}).Inc()
+		countBytesProduced(pulsarTopic, len(pmsg.Payload))
+		countBridge(msg, "produced")
+		throughput.record(pulsarTopic)
+		observeLatency(msg, pulsarTopic)
 	})
+}
+
+// observeLatency records how long a message took from receipt, and
+// optionally from the device timestamp in its payload, until Pulsar acked it.
+func observeLatency(msg *Message, pulsarTopic string) {
+	now := time.Now()
+	labels := prometheus.Labels{"topic": pulsarTopic}
+	bridgeLatency.With(labels).Observe(now.Sub(msg.ReceivedAt).Seconds())
+	if ts, ok := cfg.Metrics.PayloadTimestamp.extract(msg.Payload); ok {
+		endToEndLatency.With(labels).Observe(now.Sub(ts).Seconds())
+	}
+}
+
+// handleSendFailure keeps a message that could not be sent. It goes to the
+// disk buffer when enabled and to the dead-letter topic otherwise, or when
+// the buffer is full. The MQTT message is only acked once it is kept.
+func handleSendFailure(ctx context.Context, msg *Message, pulsarTopic string, cause error) {
+	if buffer != nil {
+		err := buffer.Store(&bufferedRecord{
+			MQTTTopic:   msg.Topic,
+			PulsarTopic: pulsarTopic,
+			Payload:     msg.Payload,
+			Properties:  messageProperties(msg),
+			StoredAt:    time.Now(),
+		})
+		if err == nil {
+			messagesBuffered.With(prometheus.Labels{"topic": pulsarTopic}).Inc()
+			msg.Ack()
+			return
+		}
+		slog.Error("Failed to buffer message", "mqtt_topic", msg.Topic, "pulsar_topic", pulsarTopic, "error", err)
+	}
+	deadLetter(ctx, msg, pulsarTopic, cause)
+}
+
+// replayBufferedRecord synchronously sends a record from the disk buffer.
+// Buffered payloads are stored as received, so they are encoded and keyed
+// again by the mapping currently in effect for the MQTT topic.
+func replayBufferedRecord(r *bufferedRecord) error {
+	msg := &Message{Topic: r.MQTTTopic, Payload: r.Payload}
+	dest := routing.Load().mapper.Lookup(msg, r.PulsarTopic)
+	payload, err := dest.encodePayload(r.Payload)
 	if err != nil {
-		log.Printf("Failed to create producer for topic: %s, error: %v\n", topic, err)
-		return nil, false
+		slog.Error("Dropping buffered message that no longer matches its schema",
+			"mqtt_topic", r.MQTTTopic, "pulsar_topic", r.PulsarTopic, "error", err)
+		return nil
 	}
 
-	pulsarProducers.Store(topic, producer)
-	return producer, true
+	pc := dest.producerConfig()
+	producer, ok := getOrCreateProducer(r.PulsarTopic, pc, dest.producerSchema())
+	if !ok {
+		return errProducerUnavailable
+	}
+	ctx, cancel := sendContext(context.Background(), pc.SendTimeout)
+	defer cancel()
+	if _, err := producer.Send(ctx, &pulsar.ProducerMessage{
+		Payload:    payload,
+		Key:        dest.messageKey(msg),
+		Properties: r.Properties,
+		EventTime:  dest.eventTime(msg),
+		DeliverAt:  dest.deliverAt(msg),
+	}); err != nil {
+		return err
+	}
+	messagesReplayed.With(prometheus.Labels{"topic": r.PulsarTopic}).Inc()
+	messagesProduced.With(prometheus.Labels{"topic": r.PulsarTopic}).Inc()
+	countBytesProduced(r.PulsarTopic, len(payload))
+	throughput.record(r.PulsarTopic)
+	return nil
 }
 
-func mapMQTTToPulsarTopic(mqttTopic string) string {
-	parts := strings.Split(mqttTopic, "/")
-	return fmt.Sprintf("persistent://public/default/%s", strings.Join(parts[1:], "/"))
+// sendContext bounds a single send by timeout, when positive, and by
+// shutdown, while keeping the values of ctx such as the trace.
+func sendContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(sendsCtx, cancel)
+	if timeout <= 0 {
+		return ctx, func() { stop(); cancel() }
+	}
+	ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	return ctx, func() { stop(); cancelTimeout(); cancel() }
+}
+
+// getOrCreateProducer returns the cached producer for a topic, creating it
+// with the given settings and schema (nil for schemaless bytes) on first use.
+func getOrCreateProducer(topic string, pc ProducerConfig, schema pulsar.Schema) (pulsar.Producer, bool) {
+	if producer, ok := producers.get(topic); ok {
+		return producer, true
+	}
+
+	producer, err := pulsarClient.CreateProducer(newProducerOptions(pc, topic, schema))
+	if err != nil {
+		slog.Error("Failed to create producer", "pulsar_topic", topic, "error", err)
+		producerCreateErrors.With(prometheus.Labels{"topic": topic}).Inc()
+		return nil, false
+	}
+
+	return producers.add(topic, producer), true
 }
 
 func shutdown() {
-	// Close all Pulsar producers
-	pulsarProducers.Range(func(key, value any) bool {
-		producer := value.(pulsar.Producer)
-		producer.Close()
-		return true
-	})
+	shuttingDown.Store(true)
+
+	// Stop forwarding Pulsar messages while MQTT is still connected
+	if reverse != nil {
+		reverse.Close()
+	}
+
+	// Stop receiving new messages but stay connected, so messages still
+	// being drained can be acked
+	unsubscribeFromMQTT(client)
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		pool.Stop()
+		if txns != nil {
+			txns.Close()
+		}
+		producers.FlushAll()
+		inFlight.Wait()
+	}()
+	select {
+	case <-drained:
+		slog.Info("Drained in-flight messages")
+	case <-time.After(cfg.Shutdown.DrainTimeout):
+		slog.Warn("Drain timeout exceeded, unacked messages will be redelivered by the broker",
+			"timeout", cfg.Shutdown.DrainTimeout, "queued", pool.Len())
+	}
+	cancelSends()
+
+	// Announce going offline, since a clean disconnect doesn't trigger the
+	// last will, then disconnect from MQTT broker
+	announceAvailability(false)
+	client.Disconnect()
+	closeSources()
+
+	// Close the bridges' sinks and all Pulsar producers
+	if p := routing.Load(); p != nil {
+		closeSinks(p.bridges)
+	}
+	producers.CloseAll()
+
+	if buffer != nil {
+		if err := buffer.Close(); err != nil {
+			slog.Error("Failed to close disk buffer", "error", err)
+		}
+	}
+	if wal != nil {
+		if err := wal.Close(); err != nil {
+			slog.Error("Failed to close WAL", "error", err)
+		}
+	}
 
-	// Disconnect from MQTT broker
-	client.Disconnect(250)
 	// Close Pulsar client
 	pulsarClient.Close()
 
-	profiler.Flush(false)
-	err := profiler.Stop()
-	if err != nil {
-		log.Fatal(err)
+	if profiler != nil {
+		profiler.Flush(false)
+		if err := profiler.Stop(); err != nil {
+			slog.Error("Failed to stop profiler", "error", err)
+		}
 	}
-	log.Println("Graceful shutdown completed.")
+
+	// Stop serving metrics and probes last, so they cover the shutdown
+	stopMetricsServer()
+	slog.Info("Graceful shutdown completed")
 }
 
-func setupProfiling() (*pyroscope.Profiler, error) {
+func setupProfiling(c ProfilingConfig) (*pyroscope.Profiler, error) {
 	runtime.SetMutexProfileFraction(5)
 	runtime.SetBlockProfileRate(5)
 	// Start Pyroscope with configuration
 	return pyroscope.Start(pyroscope.Config{
-		ApplicationName: "mqtt-to-pulsar",
-		ServerAddress:   os.Getenv("PULSAR_URL"), // Replace with your server address
+		ApplicationName:   c.ApplicationName,
+		ServerAddress:     c.ServerAddress,
+		BasicAuthUser:     c.BasicAuthUser,
+		BasicAuthPassword: c.BasicAuthPassword,
+		TenantID:          c.TenantID,
+		Tags:              c.Tags,
 		ProfileTypes: []pyroscope.ProfileType{
 			pyroscope.ProfileCPU,
 			pyroscope.ProfileAllocObjects,
@@ -210,3 +1080,12 @@ func setupProfiling() (*pyroscope.Profiler, error) {
 		},
 	})
 }
+
+// logDryRun records a message that would have been produced to pulsarTopic
+// and acks it.
+func logDryRun(msg *Message, pulsarTopic, key string, size int) {
+	slog.Info("Dry run: would produce message",
+		"mqtt_topic", msg.Topic, "pulsar_topic", pulsarTopic, "key", key, "bytes", size)
+	messagesDryRun.With(prometheus.Labels{"topic": pulsarTopic}).Inc()
+	msg.Ack()
+}
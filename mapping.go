@@ -0,0 +1,652 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultTopicTemplate reproduces the historic mapping: drop the first MQTT
+// topic segment and publish the rest under the configured tenant and
+// namespace, public/default unless changed.
+const defaultTopicTemplate = "persistent://{tenant}/{namespace}/{1:}"
+
+// MappingRule maps MQTT topics matching Match (an MQTT filter, + and #
+// wildcards allowed) onto the Pulsar topic produced by the Topic template.
+// For hierarchies that don't split neatly on slashes, Regex matches the
+// topic with a regular expression instead, and its capture groups can be
+// used in Topic as $1 or ${name}, or as .Captures in Go templates.
+//
+// Templates may reference topic segments by zero based index: {2} expands
+// to the third segment, {1:} to every segment from the second onwards
+// joined by slashes. {tenant} and {namespace} expand to the mapping's
+// tenant and namespace, and names defined in the mapping's segments stand
+// for the positional placeholder they are assigned.
+//
+// A Topic containing {{ is a Go template instead, for mappings that need
+// more than segment positions, e.g.
+// persistent://iot/{{index .Segments 1}}/{{.Payload.type}}. Templates see
+// the MQTT .Topic, its .Segments, the .Tenant and .Namespace of the
+// mapping and the JSON .Payload. A message the template fails on, e.g.
+// because the payload lacks a referenced field, isn't produced to this
+// rule's topic.
+//
+// When Schema is set, producers for the mapped topics are created with that
+// Pulsar schema and JSON payloads are encoded accordingly.
+//
+// With FanOut set, matching continues after this rule, so a message can be
+// produced to several topics, e.g. a raw archive and a per-device topic.
+type MappingRule struct {
+	Match  string        `yaml:"match"`
+	Regex  string        `yaml:"regex"`
+	Topic  string        `yaml:"topic"`
+	Schema *SchemaConfig `yaml:"schema"`
+	Key    *KeyConfig    `yaml:"key"`
+	// Compression overrides pulsar.producer.compression for this mapping.
+	Compression string `yaml:"compression"`
+	// Chunking enables chunking, and disables batching, for this mapping,
+	// e.g. for firmware images that exceed the broker's message size.
+	Chunking bool `yaml:"chunking"`
+	// NonPersistent sends to the non-persistent:// variant of the topic,
+	// for high-volume telemetry that isn't worth storing. Such messages are
+	// lost when no consumer is connected and never join a transaction.
+	NonPersistent bool `yaml:"non_persistent"`
+	FanOut        bool `yaml:"fan_out"`
+	// EventTime overrides mapping.event_time for this mapping.
+	EventTime *TimestampConfig `yaml:"event_time"`
+	Delivery  *DeliveryConfig  `yaml:"delivery"`
+	// Producer overrides pulsar.producer for this mapping, e.g. a short
+	// send timeout and no batching for command topics.
+	Producer *ProducerOverrides `yaml:"producer"`
+}
+
+// name identifies the rule in errors, logs and metrics.
+func (r MappingRule) name() string {
+	if r.Regex != "" {
+		return r.Regex
+	}
+	return r.Match
+}
+
+// DeliveryConfig delays delivery of messages to consumers, which Pulsar
+// only honours on shared subscriptions. At reads the delivery time from
+// the payload; messages without it fall back to the static After delay.
+type DeliveryConfig struct {
+	After time.Duration   `yaml:"after"`
+	At    TimestampConfig `yaml:"at"`
+}
+
+// KeyConfig derives the Pulsar message key, which drives partition routing
+// and compaction. Template uses the same segment placeholders as topic
+// templates (e.g. {1} for the device ID in device/<id>/...); Field is a
+// dotted path into a JSON payload. Field wins when both are set and the
+// payload contains it.
+type KeyConfig struct {
+	Template string `yaml:"template"`
+	Field    string `yaml:"field"`
+}
+
+type MappingConfig struct {
+	// Rules are evaluated in order; the first match without fan_out wins.
+	Rules []MappingRule `yaml:"rules"`
+	// Default is the template used when no rule matches, catching every
+	// otherwise unmapped topic. Without it unmapped messages are dropped.
+	Default string `yaml:"default"`
+	// TopicMap is a YAML file of exact MQTT topics and the Pulsar topic
+	// each maps to, for fleets whose topics follow no pattern. It is
+	// consulted before the rules and re-read on reload.
+	TopicMap string `yaml:"topic_map"`
+	// Tenant and Namespace are the values of the {tenant} and {namespace}
+	// placeholders. They are templates themselves, so e.g. "{1}" puts each
+	// customer in the tenant named by the second topic segment.
+	Tenant    string `yaml:"tenant"`
+	Namespace string `yaml:"namespace"`
+	// Segments names positional placeholders for readable templates, e.g.
+	// {customer: "1", site: "2", rest: "3:"} allows
+	// persistent://{customer}/{site}/{rest}.
+	Segments map[string]string `yaml:"segments"`
+	// Tenants, when set, take over the {tenant} and {namespace}
+	// placeholders from Tenant and Namespace and isolate tenants.
+	Tenants []TenantRoute `yaml:"tenants"`
+	// EventTime locates the device timestamp used as the Pulsar event
+	// time. Messages without it carry no event time.
+	EventTime TimestampConfig `yaml:"event_time"`
+	// SchemaCheck registers the schema files of rules with a fixed topic
+	// at startup: warn (the default) logs incompatible schemas, fail stops
+	// the connector and off skips the check.
+	SchemaCheck string `yaml:"schema_check"`
+}
+
+var placeholderPattern = regexp.MustCompile(`\{(\d+)(:?)\}`)
+
+// mappingRoute is a MappingRule with its resources loaded.
+type mappingRoute struct {
+	MappingRule
+	schema *producerSchema
+	// tmpl is the parsed Topic when it is a Go template, executed with
+	// the message's tenant and namespace: the mapping's, with positional
+	// placeholders expanded, or those of the tenant map entry owning the
+	// topic.
+	tmpl              *template.Template
+	tenant, namespace string
+	tenants           []TenantRoute
+	regex             *regexp.Regexp
+}
+
+// topicTemplateData is what Go topic templates are executed against.
+type topicTemplateData struct {
+	Topic     string
+	Segments  []string
+	Tenant    string
+	Namespace string
+	// Captures holds the groups of a regex rule by number and by name.
+	Captures map[string]string
+
+	payload []byte
+	decoded map[string]any
+}
+
+// Payload decodes the message payload as a JSON object on first use, so
+// templates that don't look at it cost nothing extra.
+func (d *topicTemplateData) Payload() (map[string]any, error) {
+	if d.decoded == nil {
+		if err := json.Unmarshal(d.payload, &d.decoded); err != nil {
+			return nil, fmt.Errorf("payload is not a JSON object: %w", err)
+		}
+	}
+	return d.decoded, nil
+}
+
+// Destination is the result of mapping an MQTT topic.
+type Destination struct {
+	Topic string
+	route *mappingRoute
+}
+
+// schema returns the destination's schema, if any, looking it up in the
+// schema registry for registry schemas.
+func (d Destination) schema() (*producerSchema, error) {
+	if d.route == nil {
+		return nil, nil
+	}
+	if d.route.Schema != nil && d.route.Schema.Registry {
+		return schemaRegistry.lookup(d.Topic, *d.route.Schema)
+	}
+	return d.route.schema, nil
+}
+
+// encodePayload prepares a payload for the destination's producer.
+func (d Destination) encodePayload(payload []byte) ([]byte, error) {
+	s, err := d.schema()
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return payload, nil
+	}
+	return s.encode(payload)
+}
+
+// messageKey derives the Pulsar message key for msg, or "" when the
+// mapping does not configure one.
+func (d Destination) messageKey(msg *Message) string {
+	if d.route == nil || d.route.Key == nil {
+		return ""
+	}
+	return d.route.Key.derive(msg)
+}
+
+// derive returns the key of msg, or "" when it has none.
+func (k *KeyConfig) derive(msg *Message) string {
+	if k.Field != "" {
+		var obj map[string]any
+		if err := json.Unmarshal(msg.Payload, &obj); err == nil {
+			if parent, key, ok := lookupPath(obj, k.Field); ok {
+				switch v := parent[key].(type) {
+				case string:
+					return v
+				case nil:
+				default:
+					return fmt.Sprint(v)
+				}
+			}
+		}
+	}
+	if k.Template != "" {
+		return expandTopicTemplate(k.Template, msg.Topic)
+	}
+	return ""
+}
+
+// eventTime extracts the event time of msg, or returns the zero time when
+// the mapping configures none or the payload lacks it.
+func (d Destination) eventTime(msg *Message) time.Time {
+	if d.route == nil || d.route.EventTime == nil {
+		return time.Time{}
+	}
+	t, _ := d.route.EventTime.extract(msg.Payload)
+	return t
+}
+
+// deliverAt returns when msg should be delivered to consumers, or the zero
+// time for immediate delivery.
+func (d Destination) deliverAt(msg *Message) time.Time {
+	if d.route == nil || d.route.Delivery == nil {
+		return time.Time{}
+	}
+	if t, ok := d.route.Delivery.At.extract(msg.Payload); ok {
+		return t
+	}
+	if d.route.Delivery.After > 0 {
+		return time.Now().Add(d.route.Delivery.After)
+	}
+	return time.Time{}
+}
+
+// producerConfig returns the global producer settings with the mapping's
+// overrides applied.
+func (d Destination) producerConfig() ProducerConfig {
+	pc := cfg.Pulsar.Producer
+	if d.route != nil && d.route.Compression != "" {
+		pc.Compression = d.route.Compression
+	}
+	if d.route != nil && d.route.Producer != nil {
+		pc = d.route.Producer.apply(pc)
+	}
+	if d.route != nil && d.route.Chunking {
+		pc.Chunking.Enabled = true
+		pc.Batching.Enabled = false
+	}
+	return pc
+}
+
+// producerSchema returns the Pulsar schema for the destination, if any.
+// Registry schemas have been looked up by encodePayload, so they are
+// cached.
+func (d Destination) producerSchema() pulsar.Schema {
+	if s, _ := d.schema(); s != nil {
+		return s
+	}
+	return nil
+}
+
+type topicMapper struct {
+	table    map[string]*mappingRoute
+	routes   []*mappingRoute
+	fallback *mappingRoute
+	tenants  []TenantRoute
+}
+
+// newTopicMapper builds a mapper from the mapping config. Subscriptions
+// carrying their own topic template contribute a rule each, evaluated before
+// the configured rules.
+func newTopicMapper(c MappingConfig, subs []Subscription) (*topicMapper, error) {
+	var rules []MappingRule
+	for _, s := range subs {
+		if s.Topic != "" {
+			rules = append(rules, MappingRule{Match: s.Filter, Topic: s.Topic})
+		}
+	}
+	rules = append(rules, c.Rules...)
+
+	// Rules are independent, so report every broken one
+	var errs []error
+	m := &topicMapper{tenants: c.Tenants}
+	for i, r := range rules {
+		if (r.Match == "") == (r.Regex == "") || r.Topic == "" {
+			errs = append(errs, fmt.Errorf("mapping rule %d: topic and either match or regex are required", i))
+			continue
+		}
+		if r.EventTime == nil {
+			r.EventTime = &c.EventTime
+		}
+		route, err := c.newMappingRoute(r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("mapping rule %s: %w", r.name(), err))
+			continue
+		}
+		m.routes = append(m.routes, route)
+	}
+	if c.TopicMap != "" {
+		table, err := c.loadTopicMap()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		m.table = table
+	}
+	if c.Default != "" {
+		route, err := c.newMappingRoute(MappingRule{Match: "#", Topic: c.Default, EventTime: &c.EventTime})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("mapping default: %w", err))
+		}
+		m.fallback = route
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return m, nil
+}
+
+// loadTopicMap reads the topic map file into a route per MQTT topic.
+func (c MappingConfig) loadTopicMap() (map[string]*mappingRoute, error) {
+	data, err := os.ReadFile(c.TopicMap)
+	if err != nil {
+		return nil, fmt.Errorf("reading topic map: %w", err)
+	}
+	var entries map[string]string
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing topic map %s: %w", c.TopicMap, err)
+	}
+	table := make(map[string]*mappingRoute, len(entries))
+	for mqttTopic, pulsarTopic := range entries {
+		if pulsarTopic == "" {
+			return nil, fmt.Errorf("topic map %s: no Pulsar topic for %s", c.TopicMap, mqttTopic)
+		}
+		route, err := c.newMappingRoute(MappingRule{Match: mqttTopic, Topic: pulsarTopic, EventTime: &c.EventTime})
+		if err != nil {
+			return nil, fmt.Errorf("topic map %s: %s: %w", c.TopicMap, mqttTopic, err)
+		}
+		table[mqttTopic] = route
+	}
+	return table, nil
+}
+
+var (
+	namedPlaceholderPattern = regexp.MustCompile(`\$?\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	segmentPositionPattern  = regexp.MustCompile(`^\d+:?$`)
+)
+
+// resolveNames replaces the named placeholders in tmpl with what they stand
+// for, leaving only positional ones to expand per message.
+func (c MappingConfig) resolveNames(tmpl string) (string, error) {
+	var err error
+	resolved := namedPlaceholderPattern.ReplaceAllStringFunc(tmpl, func(ph string) string {
+		if ph[0] == '$' {
+			// A regex capture group reference
+			return ph
+		}
+		name := ph[1 : len(ph)-1]
+		switch {
+		case (name == "tenant" || name == "namespace") && len(c.Tenants) > 0:
+			// Resolved per message from the tenant map
+			return ph
+		case name == "tenant":
+			return c.Tenant
+		case name == "namespace":
+			return c.Namespace
+		}
+		if pos, ok := c.Segments[name]; ok {
+			return "{" + pos + "}"
+		}
+		err = fmt.Errorf("unknown placeholder %s", ph)
+		return ph
+	})
+	return resolved, err
+}
+
+// isGoTemplate reports whether a topic is a Go template rather than one
+// with {n} placeholders.
+func isGoTemplate(topic string) bool {
+	return strings.Contains(topic, "{{")
+}
+
+func (c MappingConfig) newMappingRoute(r MappingRule) (*mappingRoute, error) {
+	route := &mappingRoute{MappingRule: r}
+	if r.Regex != "" {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return nil, err
+		}
+		route.regex = re
+	}
+	if isGoTemplate(r.Topic) {
+		tmpl, err := template.New(r.name()).Option("missingkey=error").Parse(r.Topic)
+		if err != nil {
+			return nil, err
+		}
+		route.tmpl = tmpl
+		if route.tenant, err = c.resolveNames(c.Tenant); err != nil {
+			return nil, fmt.Errorf("tenant: %w", err)
+		}
+		if route.namespace, err = c.resolveNames(c.Namespace); err != nil {
+			return nil, fmt.Errorf("namespace: %w", err)
+		}
+		route.tenants = c.Tenants
+	} else {
+		topic, err := c.resolveNames(r.Topic)
+		if err != nil {
+			return nil, err
+		}
+		route.Topic = topic
+	}
+	if r.Key != nil && r.Key.Template != "" {
+		// Keys take the same named placeholders as topics
+		key := *r.Key
+		var err error
+		if key.Template, err = c.resolveNames(key.Template); err != nil {
+			return nil, fmt.Errorf("key: %w", err)
+		}
+		route.Key = &key
+	}
+	if r.Schema != nil && r.Schema.Registry {
+		if schemaRegistry == nil {
+			return nil, errors.New("registry schemas require schema_registry.url")
+		}
+		if strings.EqualFold(r.Schema.Type, "protobuf") {
+			return nil, errors.New("protobuf schemas cannot be looked up in the schema registry")
+		}
+	} else if r.Schema != nil {
+		schema, err := loadProducerSchema(*r.Schema)
+		if err != nil {
+			return nil, err
+		}
+		route.schema = schema
+	}
+	return route, nil
+}
+
+// destination maps msg through the route. It fails only when the route's
+// Go template does.
+func (r *mappingRoute) destination(msg *Message) (Destination, error) {
+	topic, err := r.expand(msg)
+	if err != nil {
+		return Destination{}, err
+	}
+	if r.NonPersistent {
+		topic = nonPersistentTopic(topic)
+	}
+	return Destination{Topic: topic, route: r}, nil
+}
+
+// staticTopic returns the route's Pulsar topic when it doesn't depend on
+// the message.
+func (r *mappingRoute) staticTopic() (string, bool) {
+	if r.tmpl != nil || placeholderPattern.MatchString(r.Topic) {
+		return "", false
+	}
+	if r.regex != nil && strings.Contains(r.Topic, "$") {
+		return "", false
+	}
+	if r.NonPersistent {
+		return nonPersistentTopic(r.Topic), true
+	}
+	return r.Topic, true
+}
+
+// matches reports whether the route applies to mqttTopic.
+func (r *mappingRoute) matches(mqttTopic string) bool {
+	if r.regex != nil {
+		return r.regex.MatchString(mqttTopic)
+	}
+	return topicMatches(r.Match, mqttTopic)
+}
+
+func (r *mappingRoute) expand(msg *Message) (string, error) {
+	var submatches []int
+	if r.regex != nil {
+		submatches = r.regex.FindStringSubmatchIndex(msg.Topic)
+	}
+	if r.tmpl == nil {
+		topic := r.Topic
+		if r.regex != nil {
+			topic = string(r.regex.ExpandString(nil, topic, msg.Topic, submatches))
+		}
+		return expandTopicTemplate(topic, msg.Topic), nil
+	}
+	data := &topicTemplateData{
+		Topic:     msg.Topic,
+		Segments:  strings.Split(msg.Topic, "/"),
+		Tenant:    expandTopicTemplate(r.tenant, msg.Topic),
+		Namespace: expandTopicTemplate(r.namespace, msg.Topic),
+		payload:   msg.Payload,
+	}
+	if t, ok := tenantFor(r.tenants, msg.Topic); ok {
+		data.Tenant, data.Namespace = t.Tenant, t.Namespace
+	}
+	if r.regex != nil {
+		data.Captures = make(map[string]string)
+		for i, name := range r.regex.SubexpNames() {
+			if submatches[2*i] < 0 {
+				continue
+			}
+			group := msg.Topic[submatches[2*i]:submatches[2*i+1]]
+			data.Captures[strconv.Itoa(i)] = group
+			if name != "" {
+				data.Captures[name] = group
+			}
+		}
+	}
+	var b strings.Builder
+	if err := r.tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("template produced an empty topic")
+	}
+	return b.String(), nil
+}
+
+// nonPersistentTopic replaces the scheme of a topic name with
+// non-persistent://, expanding short names the way Pulsar does.
+func nonPersistentTopic(topic string) string {
+	if i := strings.Index(topic, "://"); i >= 0 {
+		topic = topic[i+3:]
+	}
+	if !strings.Contains(topic, "/") {
+		topic = "public/default/" + topic
+	}
+	return "non-persistent://" + topic
+}
+
+// persistent reports whether messages to the destination are stored.
+func (d Destination) persistent() bool {
+	return !strings.HasPrefix(d.Topic, "non-persistent://")
+}
+
+// Map returns the Pulsar destinations for a message: every matching
+// fan-out rule up to and including the first other match, or the default
+// template when no such rule matches. It returns nothing when neither a rule
+// nor a default template applies, or when tenants are configured and none
+// owns the topic.
+func (m *topicMapper) Map(msg *Message) []Destination {
+	if len(m.tenants) == 0 {
+		return m.match(msg)
+	}
+	tenant, ok := tenantFor(m.tenants, msg.Topic)
+	if !ok {
+		return nil
+	}
+	dests := m.match(msg)
+	for i := range dests {
+		dests[i].Topic = tenant.expand(dests[i].Topic)
+	}
+	return dests
+}
+
+// Permits checks that a message from mqttTopic may be produced to
+// pulsarTopic, which is always the case unless tenants are configured.
+func (m *topicMapper) Permits(mqttTopic, pulsarTopic string) error {
+	if len(m.tenants) == 0 {
+		return nil
+	}
+	if tenant, ok := tenantFor(m.tenants, mqttTopic); ok && tenant.owns(pulsarTopic) {
+		return nil
+	}
+	return errTenantViolation
+}
+
+func (m *topicMapper) match(msg *Message) []Destination {
+	var dests []Destination
+	if r, ok := m.table[msg.Topic]; ok {
+		return m.add(dests, r, msg)
+	}
+	matched := false
+	for _, r := range m.routes {
+		if r.matches(msg.Topic) {
+			matched = true
+			dests = m.add(dests, r, msg)
+			if !r.FanOut {
+				return dests
+			}
+		}
+	}
+	// The default only catches topics no rule matched, fan-out ones included
+	if !matched && m.fallback != nil {
+		dests = m.add(dests, m.fallback, msg)
+	}
+	return dests
+}
+
+// add appends the destination of msg through r, leaving it out if r's
+// template fails on the message.
+func (m *topicMapper) add(dests []Destination, r *mappingRoute, msg *Message) []Destination {
+	dest, err := r.destination(msg)
+	if err != nil {
+		logSampled(slog.LevelWarn, msg.Topic, "Topic template failed", "mqtt_topic", msg.Topic, "rule", r.name(), "error", err)
+		return dests
+	}
+	return append(dests, dest)
+}
+
+// unmapped reports whether dests, as returned by Map, came from the default
+// template or are empty because nothing matched.
+func (m *topicMapper) unmapped(dests []Destination) bool {
+	return len(dests) == 0 || (m.fallback != nil && dests[len(dests)-1].route == m.fallback)
+}
+
+// Lookup returns the destination msg maps to on pulsarTopic. When the
+// mapping has changed and no longer produces pulsarTopic, a destination
+// without schema or key settings is returned.
+func (m *topicMapper) Lookup(msg *Message, pulsarTopic string) Destination {
+	for _, d := range m.Map(msg) {
+		if d.Topic == pulsarTopic {
+			return d
+		}
+	}
+	return Destination{Topic: pulsarTopic}
+}
+
+func expandTopicTemplate(tmpl, mqttTopic string) string {
+	segments := strings.Split(mqttTopic, "/")
+	return placeholderPattern.ReplaceAllStringFunc(tmpl, func(ph string) string {
+		groups := placeholderPattern.FindStringSubmatch(ph)
+		idx, _ := strconv.Atoi(groups[1])
+		if idx >= len(segments) {
+			return ""
+		}
+		if groups[2] == ":" {
+			return strings.Join(segments[idx:], "/")
+		}
+		return segments[idx]
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExpandTopicTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl, topic, want string
+	}{
+		{"persistent://iot/default/{1}", "device/42/telemetry", "persistent://iot/default/42"},
+		{"persistent://iot/default/{1:}", "device/42/telemetry", "persistent://iot/default/42/telemetry"},
+		{"persistent://iot/{0}/{2}", "device/42/telemetry", "persistent://iot/device/telemetry"},
+		{"persistent://iot/default/{5}", "device/42", "persistent://iot/default/"},
+		{"persistent://iot/default/{5:}", "device/42", "persistent://iot/default/"},
+		{"persistent://iot/default/fixed", "device/42", "persistent://iot/default/fixed"},
+		{"{1}-{1}", "device/42", "42-42"},
+	}
+	for _, tt := range tests {
+		if got := expandTopicTemplate(tt.tmpl, tt.topic); got != tt.want {
+			t.Errorf("expandTopicTemplate(%q, %q) = %q, want %q", tt.tmpl, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestTopicMapperMap(t *testing.T) {
+	c := MappingConfig{
+		Default:   "persistent://{tenant}/{namespace}/unmapped-{0}",
+		Tenant:    "iot",
+		Namespace: "{1}",
+		Segments:  map[string]string{"site": "1", "device": "2"},
+		Rules: []MappingRule{
+			{Match: "archive/#", Topic: "persistent://iot/archive/all", FanOut: true},
+			{Match: "archive/+/+/raw", Topic: "persistent://iot/{site}/{device}-raw"},
+			{Regex: `^meter/(\d+)/(?P<kind>\w+)$`, Topic: "persistent://iot/meters/${kind}-$1"},
+			{Match: "event/+", Topic: "persistent://iot/events/{{.Payload.type}}"},
+			{Match: "site/+/+", Topic: "persistent://{tenant}/{namespace}/{device}"},
+		},
+	}
+	m, err := newTopicMapper(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		topic    string
+		payload  string
+		want     []string
+		unmapped bool
+	}{
+		{"named segments", "site/berlin/pump1", "", []string{"persistent://iot/berlin/pump1"}, false},
+		{"fan-out then first match", "archive/berlin/pump1/raw", "", []string{"persistent://iot/archive/all", "persistent://iot/berlin/pump1-raw"}, false},
+		{"fan-out alone skips the default", "archive/berlin", "", []string{"persistent://iot/archive/all"}, false},
+		{"regex captures", "meter/7/power", "", []string{"persistent://iot/meters/power-7"}, false},
+		{"go template", "event/1", `{"type":"alarm"}`, []string{"persistent://iot/events/alarm"}, false},
+		{"go template failure drops the rule", "event/1", `{}`, nil, true},
+		{"default", "other/thing", "", []string{"persistent://iot/thing/unmapped-other"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dests := m.Map(&Message{Topic: tt.topic, Payload: []byte(tt.payload)})
+			var got []string
+			for _, d := range dests {
+				got = append(got, d.Topic)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Map(%s) = %v, want %v", tt.topic, got, tt.want)
+			}
+			if u := m.unmapped(dests); u != tt.unmapped {
+				t.Errorf("unmapped = %v, want %v", u, tt.unmapped)
+			}
+		})
+	}
+}
+
+func TestNewTopicMapperErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule MappingRule
+	}{
+		{"missing topic", MappingRule{Match: "a/#"}},
+		{"match and regex", MappingRule{Match: "a/#", Regex: "a", Topic: "t"}},
+		{"invalid regex", MappingRule{Regex: "(", Topic: "t"}},
+		{"unknown placeholder", MappingRule{Match: "a/#", Topic: "persistent://iot/x/{nope}"}},
+		{"invalid go template", MappingRule{Match: "a/#", Topic: "persistent://iot/x/{{.Topic"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTopicMapper(MappingConfig{Rules: []MappingRule{tt.rule}}, nil); err == nil {
+				t.Error("newTopicMapper() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestMessageKey(t *testing.T) {
+	c := MappingConfig{
+		Segments: map[string]string{"device": "1"},
+		Rules: []MappingRule{
+			{Match: "device/+/telemetry", Topic: "persistent://iot/default/telemetry", Key: &KeyConfig{Template: "{device}", Field: "meta.id"}},
+			{Match: "device/+/status", Topic: "persistent://iot/default/status"},
+		},
+	}
+	m, err := newTopicMapper(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		topic, payload, want string
+	}{
+		{"device/42/telemetry", `{"meta":{"id":"pump-1"}}`, "pump-1"},
+		{"device/42/telemetry", `{"meta":{"id":7}}`, "7"},
+		{"device/42/telemetry", `{"meta":{"id":null}}`, "42"},
+		{"device/42/telemetry", `not json`, "42"},
+		{"device/42/status", `{"meta":{"id":"pump-1"}}`, ""},
+	}
+	for _, tt := range tests {
+		msg := &Message{Topic: tt.topic, Payload: []byte(tt.payload)}
+		dests := m.Map(msg)
+		if len(dests) != 1 {
+			t.Fatalf("Map(%s) = %d destinations, want 1", tt.topic, len(dests))
+		}
+		if got := dests[0].messageKey(msg); got != tt.want {
+			t.Errorf("key of %s %s = %q, want %q", tt.topic, tt.payload, got, tt.want)
+		}
+	}
+
+	c.Rules[0].Key = &KeyConfig{Template: "{nope}"}
+	if _, err := newTopicMapper(c, nil); err == nil {
+		t.Error("newTopicMapper() accepted an unknown key placeholder")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Message is a protocol independent view of an inbound MQTT message, so the
+// MQTT 3.1.1 and MQTT 5 clients can share the same processing path.
+type Message struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retained bool
+	// ReceivedAt is when the connector received the message.
+	ReceivedAt time.Time
+
+	// MQTT 5 only; empty for messages received over MQTT 3.1.1.
+	ContentType     string
+	CorrelationData []byte
+	UserProperties  map[string]string
+
+	// rerouteTopic, when set by a filter rule or script, replaces the Pulsar topic
+	// chosen by the mapping.
+	rerouteTopic string
+
+	// bridge is the named bridge the message arrived on, or "" for the
+	// default one.
+	bridge string
+
+	// walSeq identifies the message in the WAL, 0 when it isn't logged.
+	// sequenceIDs are the Pulsar sequence IDs it was last sent with by the
+	// previous run, by topic, for messages replayed from the WAL.
+	walSeq      uint64
+	sequenceIDs map[string]int64
+
+	// pipeline is the one in effect when the message was received, used
+	// for every step so a reload never splits a message across two.
+	pipeline *pipeline
+
+	// ack acknowledges the message to the broker when manual
+	// acknowledgement is enabled; nil otherwise.
+	ack func()
+}
+
+// Ack acknowledges the message to the MQTT broker. Without manual
+// acknowledgement the client has already acked on receipt and this is a
+// no-op.
+func (m *Message) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+// routing returns the pipeline msg is processed with, acquiring the
+// current one the first time. It is held until releaseRouting.
+func (m *Message) routing() *pipeline {
+	if m.pipeline == nil {
+		m.pipeline = acquirePipeline()
+	}
+	return m.pipeline
+}
+
+// releaseRouting lets go of msg's pipeline once processing is done with it.
+func (m *Message) releaseRouting() {
+	if m.pipeline != nil {
+		m.pipeline.release()
+		m.pipeline = nil
+	}
+}
+
+// split returns n copies of m for delivery to n destinations. The original
+// is acked once every copy has been acked.
+func (m *Message) split(n int) []*Message {
+	if n == 1 {
+		return []*Message{m}
+	}
+	var remaining atomic.Int32
+	remaining.Store(int32(n))
+	copies := make([]*Message, n)
+	for i := range copies {
+		c := *m
+		c.ack = func() {
+			if remaining.Add(-1) == 0 {
+				m.Ack()
+			}
+		}
+		copies[i] = &c
+	}
+	return copies
+}
+
+// messageProperties maps MQTT metadata onto Pulsar message properties so
+// consumers can trace where a message came from. MQTT 5 user properties are
+// copied verbatim; correlation data is base64 encoded because Pulsar
+// properties are strings.
+func messageProperties(msg *Message) map[string]string {
+	props := make(map[string]string, len(msg.UserProperties)+8)
+	for k, v := range msg.UserProperties {
+		props[k] = v
+	}
+	props["mqtt_topic"] = msg.Topic
+	props["mqtt_qos"] = strconv.Itoa(int(msg.QoS))
+	props["mqtt_retained"] = strconv.FormatBool(msg.Retained)
+	props["mqtt_received_at"] = msg.ReceivedAt.UTC().Format(time.RFC3339Nano)
+	props["mqtt_client_id"] = cfg.MQTT.ClientID
+	if msg.Retained && cfg.MQTT.Retained == retainedTag {
+		props["mqtt_stale"] = "true"
+	}
+	if msg.ContentType != "" {
+		props["mqtt_content_type"] = msg.ContentType
+	}
+	if len(msg.CorrelationData) > 0 {
+		props["mqtt_correlation_data"] = base64.StdEncoding.EncodeToString(msg.CorrelationData)
+	}
+	return props
+}
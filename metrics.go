@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsServer serves metrics, health probes and optionally pprof.
+var metricsServer *http.Server
+
+// MetricsAuthConfig protects /metrics and the pprof endpoints, either with
+// a bearer token or with basic auth. The health probes stay open so
+// Kubernetes can reach them.
+type MetricsAuthConfig struct {
+	Token    string `yaml:"token"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// protect wraps next in the configured authentication, if any.
+func (c MetricsAuthConfig) protect(next http.Handler) http.Handler {
+	switch {
+	case c.Token != "":
+		return requireToken(c.Token, next)
+	case c.Username != "":
+		return requireBasicAuth(c.Username, c.Password, next)
+	default:
+		return next
+	}
+}
+
+// MetricsTLSConfig serves the metrics endpoint over HTTPS when both files
+// are set.
+type MetricsTLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+func (c MetricsTLSConfig) enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// startMetricsServer starts serving on the configured address. A failure
+// to listen, e.g. because the port is taken, is logged rather than fatal:
+// the bridge keeps running without metrics and probes.
+func startMetricsServer(c MetricsConfig) {
+	protected := http.NewServeMux()
+	if !c.DisablePrometheus {
+		protected.Handle("/metrics", promhttp.Handler())
+	}
+	if cfg.Profiling.Pprof.Enabled && cfg.Profiling.Pprof.Port == "" {
+		registerPprof(protected)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", c.Auth.protect(protected))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/startupz", startupzHandler)
+	mux.HandleFunc("/livez", livezHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	addr := net.JoinHostPort(c.Address, c.Port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("Failed to start metrics endpoint, continuing without it", "addr", addr, "error", err)
+		return
+	}
+	metricsServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	slog.Info("Starting Prometheus metrics endpoint", "addr", addr, "tls", c.TLS.enabled())
+
+	go func() {
+		if c.TLS.enabled() {
+			err = metricsServer.ServeTLS(ln, c.TLS.CertFile, c.TLS.KeyFile)
+		} else {
+			err = metricsServer.Serve(ln)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server failed", "error", err)
+		}
+	}()
+}
+
+// stopMetricsServer lets in-flight scrapes and probes finish.
+func stopMetricsServer() {
+	if metricsServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to shut down metrics server", "error", err)
+	}
+}
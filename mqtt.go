@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttConn is the subset of MQTT client behaviour the connector relies on.
+// It is implemented for both MQTT 3.1.1 and MQTT 5.
+type mqttConn interface {
+	Subscribe(filter string, qos byte, handler func(*Message)) error
+	Unsubscribe(filter string) error
+	Publish(topic string, qos byte, retain bool, payload []byte) error
+	IsConnected() bool
+	Disconnect()
+}
+
+// connectMQTT connects to the broker using the configured protocol version.
+func connectMQTT(c MQTTConfig) (mqttConn, error) {
+	if c.ProtocolVersion == 5 {
+		return connectMQTTv5(c)
+	}
+	return connectMQTTv3(c)
+}
+
+type mqttV3Subscription struct {
+	filter  string
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+// mqttV3Conn wraps a paho MQTT 3.1.1 client. Subscriptions are kept so they
+// can be re-established after the client reconnects.
+type mqttV3Conn struct {
+	client mqtt.Client
+	cfg    MQTTConfig
+
+	mu            sync.RWMutex
+	subscriptions []mqttV3Subscription
+	connects      int
+}
+
+func connectMQTTv3(c MQTTConfig) (*mqttV3Conn, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(c.BrokerURL)
+	opts.ClientID = c.ClientID
+	opts.Password = c.Password
+	opts.Username = c.Username
+	opts.SetAutoAckDisabled(c.ManualAck)
+	opts.SetCleanSession(!c.PersistentSession)
+	// A persistent session may deliver messages before the subscriptions
+	// are restored, and those don't match any subscription's handler
+	opts.SetDefaultPublishHandler(func(_ mqtt.Client, msg mqtt.Message) {
+		receiveSessionMessage(newV3Message(msg))
+	})
+	opts.SetHTTPHeaders(c.webSocketHeader())
+	if a := c.Availability; a.enabled() {
+		opts.SetWill(a.Topic, a.Offline, a.QoS, a.Retain)
+	}
+	if c.ProtocolVersion != 0 {
+		opts.SetProtocolVersion(c.ProtocolVersion)
+	}
+	if c.TLS.enabled() {
+		tlsConfig, err := newTLSConfig(c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	conn := &mqttV3Conn{cfg: c}
+	opts.SetAutoReconnect(true)
+	opts.SetOnConnectHandler(conn.onConnect)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		slog.Warn("Lost connection to MQTT broker", "error", err)
+		mqttConnectionsLost.Inc()
+	})
+	opts.SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+		slog.Info("Reconnecting to MQTT broker")
+	})
+
+	conn.client = mqtt.NewClient(opts)
+	if token := conn.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return conn, nil
+}
+
+// onConnect publishes the birth message and restores all subscriptions
+// after a reconnect. With a clean session the broker has forgotten them.
+func (c *mqttV3Conn) onConnect(client mqtt.Client) {
+	c.mu.Lock()
+	c.connects++
+	reconnect := c.connects > 1
+	c.mu.Unlock()
+
+	if a := c.cfg.Availability; a.enabled() {
+		token := client.Publish(a.Topic, a.QoS, a.Retain, a.Online)
+		if token.Wait() && token.Error() != nil {
+			slog.Error("Failed to publish birth message", "mqtt_topic", a.Topic, "error", token.Error())
+		}
+	}
+
+	if !reconnect {
+		return
+	}
+	slog.Info("Reconnected to MQTT broker")
+	mqttReconnects.Inc()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, s := range c.subscriptions {
+		token := client.Subscribe(c.cfg.brokerFilter(s.filter), s.qos, s.handler)
+		if token.Wait() && token.Error() != nil {
+			slog.Error("Failed to resubscribe", "filter", s.filter, "error", token.Error())
+		}
+	}
+}
+
+func newV3Message(msg mqtt.Message) *Message {
+	return &Message{
+		Topic:      msg.Topic(),
+		Payload:    msg.Payload(),
+		QoS:        msg.Qos(),
+		Retained:   msg.Retained(),
+		ReceivedAt: time.Now(),
+		ack:        msg.Ack,
+	}
+}
+
+func (c *mqttV3Conn) Subscribe(filter string, qos byte, handler func(*Message)) error {
+	cb := func(_ mqtt.Client, msg mqtt.Message) {
+		handler(newV3Message(msg))
+	}
+
+	c.mu.Lock()
+	c.subscriptions = slices.DeleteFunc(c.subscriptions, func(s mqttV3Subscription) bool { return s.filter == filter })
+	c.subscriptions = append(c.subscriptions, mqttV3Subscription{filter: filter, qos: qos, handler: cb})
+	c.mu.Unlock()
+
+	token := c.client.Subscribe(c.cfg.brokerFilter(filter), qos, cb)
+	token.Wait()
+	return token.Error()
+}
+
+func (c *mqttV3Conn) Unsubscribe(filter string) error {
+	c.mu.Lock()
+	c.subscriptions = slices.DeleteFunc(c.subscriptions, func(s mqttV3Subscription) bool { return s.filter == filter })
+	c.mu.Unlock()
+
+	token := c.client.Unsubscribe(c.cfg.brokerFilter(filter))
+	token.Wait()
+	return token.Error()
+}
+
+func (c *mqttV3Conn) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	token := c.client.Publish(topic, qos, retain, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func (c *mqttV3Conn) IsConnected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+func (c *mqttV3Conn) Disconnect() {
+	c.client.Disconnect(250)
+}
+
+// topicMatches reports whether an MQTT topic name matches a subscription
+// filter, honouring the + and # wildcards.
+func topicMatches(filter, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(topicParts) {
+			return false
+		}
+		if part != "+" && part != topicParts[i] {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
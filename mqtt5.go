@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+type mqttV5Subscription struct {
+	filter  string
+	qos     byte
+	handler func(*Message)
+}
+
+// mqttV5Conn wraps an autopaho connection manager. Subscriptions are kept so
+// they can be re-established whenever the connection comes back up.
+type mqttV5Conn struct {
+	cm        *autopaho.ConnectionManager
+	connected atomic.Bool
+	connects  atomic.Int64
+	manualAck bool
+	cfg       MQTTConfig
+
+	mu            sync.RWMutex
+	subscriptions []mqttV5Subscription
+}
+
+func connectMQTTv5(c MQTTConfig) (*mqttV5Conn, error) {
+	brokerURL, err := url.Parse(c.BrokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing MQTT broker URL: %w", err)
+	}
+
+	conn := &mqttV5Conn{manualAck: c.ManualAck, cfg: c}
+	cliCfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{brokerURL},
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: !c.PersistentSession,
+		SessionExpiryInterval:         sessionExpiry(c),
+		ConnectUsername:               c.Username,
+		ConnectPassword:               []byte(c.Password),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			conn.connected.Store(true)
+			if conn.connects.Add(1) > 1 {
+				slog.Info("Reconnected to MQTT broker")
+				mqttReconnects.Inc()
+			}
+			conn.publishBirth(cm)
+			conn.resubscribe(cm)
+		},
+		OnConnectError: func(err error) {
+			slog.Warn("MQTT connection attempt failed", "error", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:                   c.ClientID,
+			EnableManualAcknowledgment: c.ManualAck,
+			OnClientError: func(err error) {
+				if conn.connected.Swap(false) {
+					mqttConnectionsLost.Inc()
+				}
+				slog.Warn("Lost connection to MQTT broker", "error", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				if conn.connected.Swap(false) {
+					mqttConnectionsLost.Inc()
+				}
+				slog.Warn("MQTT server requested disconnect", "reason_code", d.ReasonCode)
+			},
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					conn.dispatch(pr.Client, pr.Packet)
+					return true, nil
+				},
+			},
+		},
+	}
+	if c.TLS.enabled() {
+		tlsConfig, err := newTLSConfig(c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		cliCfg.TlsCfg = tlsConfig
+	}
+	if a := c.Availability; a.enabled() {
+		cliCfg.WillMessage = &paho.WillMessage{Topic: a.Topic, Payload: []byte(a.Offline), QoS: a.QoS, Retain: a.Retain}
+	}
+	if rm := receiveMaximum(c); rm > 0 {
+		cliCfg.ConnectPacketBuilder = func(cp *paho.Connect, _ *url.URL) (*paho.Connect, error) {
+			if cp.Properties == nil {
+				cp.Properties = &paho.ConnectProperties{}
+			}
+			cp.Properties.ReceiveMaximum = &rm
+			return cp, nil
+		}
+	}
+	if len(c.WebSocketHeaders) > 0 {
+		header := c.webSocketHeader()
+		cliCfg.WebSocketCfg = &autopaho.WebSocketConfig{
+			Header: func(*url.URL, *tls.Config) http.Header { return header },
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	conn.cm, err = autopaho.NewConnection(context.Background(), cliCfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.cm.AwaitConnection(ctx); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *mqttV5Conn) Subscribe(filter string, qos byte, handler func(*Message)) error {
+	c.mu.Lock()
+	c.subscriptions = slices.DeleteFunc(c.subscriptions, func(s mqttV5Subscription) bool { return s.filter == filter })
+	c.subscriptions = append(c.subscriptions, mqttV5Subscription{filter: filter, qos: qos, handler: handler})
+	c.mu.Unlock()
+
+	_, err := c.cm.Subscribe(context.Background(), &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: c.cfg.brokerFilter(filter), QoS: qos}},
+	})
+	return err
+}
+
+func (c *mqttV5Conn) Unsubscribe(filter string) error {
+	c.mu.Lock()
+	c.subscriptions = slices.DeleteFunc(c.subscriptions, func(s mqttV5Subscription) bool { return s.filter == filter })
+	c.mu.Unlock()
+
+	_, err := c.cm.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: []string{c.cfg.brokerFilter(filter)}})
+	return err
+}
+
+func (c *mqttV5Conn) publishBirth(cm *autopaho.ConnectionManager) {
+	a := c.cfg.Availability
+	if !a.enabled() {
+		return
+	}
+	if _, err := cm.Publish(context.Background(), &paho.Publish{
+		Topic:   a.Topic,
+		QoS:     a.QoS,
+		Retain:  a.Retain,
+		Payload: []byte(a.Online),
+	}); err != nil {
+		slog.Error("Failed to publish birth message", "mqtt_topic", a.Topic, "error", err)
+	}
+}
+
+func (c *mqttV5Conn) resubscribe(cm *autopaho.ConnectionManager) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, s := range c.subscriptions {
+		if _, err := cm.Subscribe(context.Background(), &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: c.cfg.brokerFilter(s.filter), QoS: s.qos}},
+		}); err != nil {
+			slog.Error("Failed to resubscribe", "filter", s.filter, "error", err)
+		}
+	}
+}
+
+func (c *mqttV5Conn) dispatch(pc *paho.Client, p *paho.Publish) {
+	msg := &Message{
+		Topic:      p.Topic,
+		Payload:    p.Payload,
+		QoS:        p.QoS,
+		Retained:   p.Retain,
+		ReceivedAt: time.Now(),
+	}
+	if c.manualAck {
+		msg.ack = func() {
+			if err := pc.Ack(p); err != nil {
+				slog.Warn("Failed to ack MQTT message", "mqtt_topic", p.Topic, "error", err)
+			}
+		}
+	}
+	if p.Properties != nil {
+		msg.ContentType = p.Properties.ContentType
+		msg.CorrelationData = p.Properties.CorrelationData
+		if len(p.Properties.User) > 0 {
+			msg.UserProperties = make(map[string]string, len(p.Properties.User))
+			for _, up := range p.Properties.User {
+				msg.UserProperties[up.Key] = up.Value
+			}
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, s := range c.subscriptions {
+		if topicMatches(s.filter, p.Topic) {
+			s.handler(msg)
+			return
+		}
+	}
+	// Delivered from a persistent session before the subscriptions were
+	// restored
+	receiveSessionMessage(msg)
+}
+
+// receiveMaximum returns the MQTT 5 receive maximum, or 0 to leave it to
+// the broker.
+func receiveMaximum(c MQTTConfig) uint16 {
+	switch {
+	case c.ReceiveMaximum > 0:
+		return uint16(c.ReceiveMaximum)
+	case c.ManualAck && cfg.Processing.QueueSize > 0:
+		return uint16(min(cfg.Processing.QueueSize, math.MaxUint16))
+	default:
+		return 0
+	}
+}
+
+// sessionExpiry returns the MQTT 5 session expiry interval in seconds.
+func sessionExpiry(c MQTTConfig) uint32 {
+	switch {
+	case !c.PersistentSession:
+		return 0
+	case c.SessionExpiry == 0:
+		return math.MaxUint32
+	default:
+		return uint32(c.SessionExpiry / time.Second)
+	}
+}
+
+func (c *mqttV5Conn) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	_, err := c.cm.Publish(context.Background(), &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retain,
+		Payload: payload,
+	})
+	return err
+}
+
+func (c *mqttV5Conn) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *mqttV5Conn) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if err := c.cm.Disconnect(ctx); err != nil {
+		slog.Error("Error disconnecting from MQTT", "error", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	prombridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// OTLPMetricsConfig pushes the connector's metrics to an OpenTelemetry
+// collector over OTLP every Interval. The metrics are the same ones served
+// on /metrics, bridged from the Prometheus registry, and carry the tracing
+// service name and resource attributes.
+type OTLPMetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Protocol is either grpc or http.
+	Protocol string            `yaml:"protocol"`
+	Endpoint string            `yaml:"endpoint"`
+	Insecure bool              `yaml:"insecure"`
+	Headers  map[string]string `yaml:"headers"`
+	Interval time.Duration     `yaml:"interval"`
+}
+
+// setupMetricsExport starts the OTLP metrics export and returns a function
+// that flushes and stops it.
+func setupMetricsExport(ctx context.Context, c OTLPMetricsConfig) (func(context.Context) error, error) {
+	if !c.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := newMetricExporter(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("creating metric exporter: %w", err)
+	}
+	res, err := newResource(cfg.Tracing)
+	if err != nil {
+		return nil, fmt.Errorf("building metric resource: %w", err)
+	}
+
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(c.Interval),
+		sdkmetric.WithProducer(prombridge.NewMetricProducer()),
+	)
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res))
+	otel.SetMeterProvider(mp)
+	return mp.Shutdown, nil
+}
+
+func newMetricExporter(ctx context.Context, c OTLPMetricsConfig) (sdkmetric.Exporter, error) {
+	switch c.Protocol {
+	case "", "grpc":
+		opts := []otlpmetricgrpc.Option{}
+		if c.Endpoint != "" {
+			opts = append(opts, otlpmetricgrpc.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		if len(c.Headers) > 0 {
+			opts = append(opts, otlpmetricgrpc.WithHeaders(c.Headers))
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	case "http":
+		opts := []otlpmetrichttp.Option{}
+		if c.Endpoint != "" {
+			opts = append(opts, otlpmetrichttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		if len(c.Headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(c.Headers))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q", c.Protocol)
+	}
+}
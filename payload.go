@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+var errPayloadTooLarge = errors.New("payload exceeds the maximum size")
+
+// PayloadLimitConfig caps the payload size forwarded to Pulsar, checked
+// after transforms. Policy decides what happens to larger payloads:
+// reject drops them, truncate cuts them down to MaxBytes and dead_letter
+// sends them to the dead-letter topic. Zero MaxBytes disables the limit.
+type PayloadLimitConfig struct {
+	MaxBytes int    `yaml:"max_bytes"`
+	Policy   string `yaml:"policy"`
+}
+
+func (c PayloadLimitConfig) validate() error {
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("max_bytes must not be negative, got %d", c.MaxBytes)
+	}
+	switch c.Policy {
+	case "reject", "truncate", "dead_letter":
+		return nil
+	default:
+		return fmt.Errorf("unknown policy %q", c.Policy)
+	}
+}
+
+// enforcePayloadLimit applies the configured policy to an oversized msg.
+// It reports whether msg should still be forwarded.
+func enforcePayloadLimit(ctx context.Context, msg *Message) bool {
+	limit := cfg.PayloadLimit
+	if limit.MaxBytes == 0 || len(msg.Payload) <= limit.MaxBytes {
+		return true
+	}
+
+	switch limit.Policy {
+	case "truncate":
+		logSampled(slog.LevelDebug, msg.Topic, "Truncating oversized payload", "mqtt_topic", msg.Topic, "bytes", len(msg.Payload))
+		if msg.UserProperties == nil {
+			msg.UserProperties = make(map[string]string, 1)
+		}
+		msg.UserProperties["payload_truncated_from"] = strconv.Itoa(len(msg.Payload))
+		msg.Payload = msg.Payload[:limit.MaxBytes]
+		return true
+	case "dead_letter":
+		slog.Warn("Dead-lettering oversized payload", "mqtt_topic", msg.Topic, "bytes", len(msg.Payload))
+		deadLetter(ctx, msg, "", errPayloadTooLarge)
+	default:
+		slog.Warn("Dropping oversized payload", "mqtt_topic", msg.Topic, "bytes", len(msg.Payload))
+		dropMessage(msg, dropTooLarge)
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+)
+
+// PprofConfig serves the net/http/pprof endpoints under /debug/pprof/ for
+// ad-hoc heap and goroutine profiles. They are served on the metrics port
+// unless a dedicated Port is set, which keeps them off a port scraped or
+// exposed more widely.
+type PprofConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Port    string `yaml:"port"`
+}
+
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// servePprof serves the pprof endpoints on their dedicated port, behind the
+// same authentication as the metrics endpoint.
+func servePprof(port string) {
+	mux := http.NewServeMux()
+	registerPprof(mux)
+	slog.Info("Starting pprof endpoint", "addr", "http://localhost:"+port+"/debug/pprof/")
+	if err := http.ListenAndServe(":"+port, cfg.Metrics.Auth.protect(mux)); err != nil {
+		slog.Error("pprof server failed", "error", err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ProducerCacheConfig bounds the producer cache. Zero values disable the
+// respective limit.
+type ProducerCacheConfig struct {
+	MaxProducers int           `yaml:"max_producers"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+}
+
+type cachedProducer struct {
+	topic     string
+	producer  pulsar.Producer
+	createdAt time.Time
+	lastUsed  time.Time
+}
+
+var (
+	producersCached = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "producers_cached",
+			Help: "Number of Pulsar producers in the producer cache",
+		},
+		func() float64 {
+			if producers == nil {
+				return 0
+			}
+			return float64(producers.Len())
+		},
+	)
+	producersCreated = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "producers_created",
+			Help: "Number of Pulsar producers created and cached",
+		},
+	)
+	producersEvicted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "producers_evicted",
+			Help: "Number of Pulsar producers evicted from the producer cache, by reason: max_producers or idle",
+		},
+		[]string{"reason"},
+	)
+)
+
+// producerCache holds one producer per Pulsar topic. It evicts the least
+// recently used producer once MaxProducers is exceeded and, when an idle
+// timeout is set, producers that have not been used for that long.
+type producerCache struct {
+	cfg ProducerCacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front = most recently used
+}
+
+func newProducerCache(c ProducerCacheConfig) *producerCache {
+	return &producerCache{
+		cfg:     c,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached producer for topic and marks it as used.
+func (c *producerCache) get(topic string) (pulsar.Producer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[topic]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cachedProducer)
+	entry.lastUsed = time.Now()
+	c.lru.MoveToFront(el)
+	return entry.producer, true
+}
+
+// add caches a freshly created producer. If another goroutine cached one
+// for the same topic in the meantime, that one wins and is returned.
+func (c *producerCache) add(topic string, producer pulsar.Producer) pulsar.Producer {
+	c.mu.Lock()
+	if el, ok := c.entries[topic]; ok {
+		c.mu.Unlock()
+		producer.Close()
+		return el.Value.(*cachedProducer).producer
+	}
+
+	now := time.Now()
+	c.entries[topic] = c.lru.PushFront(&cachedProducer{topic: topic, producer: producer, createdAt: now, lastUsed: now})
+	producersCreated.Inc()
+
+	var evicted []*cachedProducer
+	for c.cfg.MaxProducers > 0 && c.lru.Len() > c.cfg.MaxProducers {
+		evicted = append(evicted, c.removeOldest())
+	}
+	c.mu.Unlock()
+
+	c.close(evicted, "max_producers")
+	return producer
+}
+
+// removeOldest drops the least recently used entry. Callers must hold mu.
+func (c *producerCache) removeOldest() *cachedProducer {
+	el := c.lru.Back()
+	entry := el.Value.(*cachedProducer)
+	c.lru.Remove(el)
+	delete(c.entries, entry.topic)
+	return entry
+}
+
+// evictIdle closes every producer unused for longer than the idle timeout.
+func (c *producerCache) evictIdle() {
+	cutoff := time.Now().Add(-c.cfg.IdleTimeout)
+
+	c.mu.Lock()
+	var evicted []*cachedProducer
+	for c.lru.Len() > 0 && c.lru.Back().Value.(*cachedProducer).lastUsed.Before(cutoff) {
+		evicted = append(evicted, c.removeOldest())
+	}
+	c.mu.Unlock()
+
+	c.close(evicted, "idle")
+}
+
+// run evicts idle producers until ctx is cancelled.
+func (c *producerCache) run(ctx context.Context) {
+	if c.cfg.IdleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.cfg.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.evictIdle()
+		}
+	}
+}
+
+// close flushes and closes evicted producers outside the cache lock.
+func (c *producerCache) close(entries []*cachedProducer, reason string) {
+	for _, entry := range entries {
+		if err := entry.producer.Flush(); err != nil {
+			slog.Warn("Failed to flush evicted producer", "pulsar_topic", entry.topic, "error", err)
+		}
+		entry.producer.Close()
+		producersEvicted.With(prometheus.Labels{"reason": reason}).Inc()
+		slog.Debug("Evicted producer", "pulsar_topic", entry.topic, "reason", reason)
+	}
+}
+
+// producerInfo describes a cached producer for the admin API.
+type producerInfo struct {
+	Topic     string    `json:"topic"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// snapshot lists the cached producers, most recently used first.
+func (c *producerCache) snapshot() []producerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	infos := make([]producerInfo, 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*cachedProducer)
+		infos = append(infos, producerInfo{Topic: entry.topic, CreatedAt: entry.createdAt, LastUsed: entry.lastUsed})
+	}
+	return infos
+}
+
+// namespaceCounts counts the cached producers per tenant/namespace, which
+// shows where an unexpected number of topics comes from.
+func (c *producerCache) namespaceCounts() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make(map[string]int)
+	for topic := range c.entries {
+		name := topic
+		if i := strings.Index(name, "://"); i >= 0 {
+			name = name[i+3:]
+		}
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name = name[:i]
+		}
+		counts[name]++
+	}
+	return counts
+}
+
+// Len returns the number of cached producers.
+func (c *producerCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// FlushAll flushes every cached producer, waiting for pending async sends
+// to complete.
+func (c *producerCache) FlushAll() {
+	c.mu.Lock()
+	all := make([]*cachedProducer, 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		all = append(all, el.Value.(*cachedProducer))
+	}
+	c.mu.Unlock()
+
+	for _, entry := range all {
+		if err := entry.producer.Flush(); err != nil {
+			slog.Error("Failed to flush producer", "pulsar_topic", entry.topic, "error", err)
+		}
+	}
+}
+
+// CloseAll flushes and closes every cached producer.
+func (c *producerCache) CloseAll() {
+	c.mu.Lock()
+	var all []*cachedProducer
+	for c.lru.Len() > 0 {
+		all = append(all, c.removeOldest())
+	}
+	c.mu.Unlock()
+
+	for _, entry := range all {
+		if err := entry.producer.Flush(); err != nil {
+			slog.Error("Failed to flush producer", "pulsar_topic", entry.topic, "error", err)
+		}
+		entry.producer.Close()
+	}
+}
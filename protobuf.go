@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// loadMessageDescriptor finds messageType, a fully qualified name like
+// acme.telemetry.Reading, in the FileDescriptorSet at path, as written by
+// protoc --descriptor_set_out --include_imports.
+func loadMessageDescriptor(path, messageType string) (protoreflect.MessageDescriptor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading descriptor set: %w", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parsing descriptor set %s: %w", path, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("loading descriptor set %s: %w", path, err)
+	}
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(messageType))
+	if err != nil {
+		return nil, fmt.Errorf("finding %s in %s: %w", messageType, path, err)
+	}
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s in %s is not a message", messageType, path)
+	}
+	return md, nil
+}
+
+// newProtobufTransformer decodes binary protobuf payloads of the configured
+// message type and re-encodes them as JSON, with field names as written in
+// the .proto file.
+func newProtobufTransformer(step TransformStep) (Transformer, error) {
+	if step.Descriptor == "" || step.MessageType == "" {
+		return nil, errors.New("protobuf_to_json requires descriptor and message_type")
+	}
+	md, err := loadMessageDescriptor(step.Descriptor, step.MessageType)
+	if err != nil {
+		return nil, err
+	}
+	marshal := protojson.MarshalOptions{UseProtoNames: true}
+	return TransformerFunc(func(msg *Message) error {
+		m := dynamicpb.NewMessage(md)
+		if err := proto.Unmarshal(msg.Payload, m); err != nil {
+			return fmt.Errorf("payload is not a valid %s: %w", step.MessageType, err)
+		}
+		payload, err := marshal.Marshal(m)
+		if err != nil {
+			return fmt.Errorf("payload cannot be represented as JSON: %w", err)
+		}
+		msg.Payload = payload
+		return nil
+	}), nil
+}
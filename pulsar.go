@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+var errProducerUnavailable = errors.New("pulsar producer unavailable")
+
+// ProducerConfig holds the settings applied to every producer.
+type ProducerConfig struct {
+	Batching BatchingConfig `yaml:"batching"`
+	// Compression is one of none, lz4, zlib or zstd.
+	Compression string `yaml:"compression"`
+	// CompressionLevel is one of default, faster or better.
+	CompressionLevel string         `yaml:"compression_level"`
+	Chunking         ChunkingConfig `yaml:"chunking"`
+	// SendTimeout fails sends not acknowledged in time, including those
+	// blocked on a full queue; negative disables it.
+	SendTimeout        time.Duration `yaml:"send_timeout"`
+	MaxPendingMessages int           `yaml:"max_pending_messages"`
+	// HashingScheme picks the partition of keyed messages: java_string
+	// (the default) or murmur3.
+	HashingScheme string `yaml:"hashing_scheme"`
+	// Name is the producer name, unique per topic; generated when empty.
+	Name string `yaml:"name"`
+	// Deduplication assigns sequence IDs so a namespace with broker
+	// deduplication enabled discards resent messages. Producers are then
+	// named after the MQTT client ID unless Name is set, because the broker
+	// tracks the last sequence ID per producer name across restarts. A
+	// topic then has one message in flight at a time, which keeps its
+	// sequence ID across retries, so throughput per topic is bounded by
+	// the send latency. With the WAL enabled, messages replayed after a
+	// crash are skipped when the broker already has their sequence ID.
+	// Deduplication must be enabled on the namespace, e.g. with
+	// pulsar-admin namespaces set-deduplication --enable.
+	Deduplication bool `yaml:"deduplication"`
+}
+
+// ProducerOverrides replace, for one mapping, the pulsar.producer settings
+// they set.
+type ProducerOverrides struct {
+	Name               string          `yaml:"name"`
+	SendTimeout        time.Duration   `yaml:"send_timeout"`
+	MaxPendingMessages int             `yaml:"max_pending_messages"`
+	HashingScheme      string          `yaml:"hashing_scheme"`
+	Compression        string          `yaml:"compression"`
+	CompressionLevel   string          `yaml:"compression_level"`
+	Batching           *BatchingConfig `yaml:"batching"`
+}
+
+func (o ProducerOverrides) apply(pc ProducerConfig) ProducerConfig {
+	if o.Name != "" {
+		pc.Name = o.Name
+	}
+	if o.SendTimeout != 0 {
+		pc.SendTimeout = o.SendTimeout
+	}
+	if o.MaxPendingMessages != 0 {
+		pc.MaxPendingMessages = o.MaxPendingMessages
+	}
+	if o.HashingScheme != "" {
+		pc.HashingScheme = o.HashingScheme
+	}
+	if o.Compression != "" {
+		pc.Compression = o.Compression
+	}
+	if o.CompressionLevel != "" {
+		pc.CompressionLevel = o.CompressionLevel
+	}
+	if o.Batching != nil {
+		pc.Batching = *o.Batching
+	}
+	return pc
+}
+
+// ChunkingConfig lets payloads larger than the broker's maximum message
+// size through by splitting them into chunks that consumers reassemble.
+// Chunking can't be combined with batching. MaxChunkSize defaults to the
+// broker's maximum message size.
+type ChunkingConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	MaxChunkSize uint `yaml:"max_chunk_size"`
+}
+
+// BatchingConfig controls producer batching. BatcherType is either
+// "default" or "key_based"; the latter keeps messages with the same key in
+// the same batch, which Key_Shared consumers need.
+type BatchingConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	MaxMessages     uint          `yaml:"max_messages"`
+	MaxBytes        uint          `yaml:"max_bytes"`
+	MaxPublishDelay time.Duration `yaml:"max_publish_delay"`
+	BatcherType     string        `yaml:"batcher_type"`
+}
+
+func parseBatcherType(s string) (pulsar.BatcherBuilderType, error) {
+	switch s {
+	case "", "default":
+		return pulsar.DefaultBatchBuilder, nil
+	case "key_based":
+		return pulsar.KeyBasedBatchBuilder, nil
+	default:
+		return 0, fmt.Errorf("unknown batcher type %q", s)
+	}
+}
+
+func parseHashingScheme(s string) (pulsar.HashingScheme, error) {
+	switch s {
+	case "", "java_string":
+		return pulsar.JavaStringHash, nil
+	case "murmur3":
+		return pulsar.Murmur3_32Hash, nil
+	default:
+		return 0, fmt.Errorf("unknown hashing scheme %q", s)
+	}
+}
+
+func parseCompressionType(s string) (pulsar.CompressionType, error) {
+	switch s {
+	case "", "none":
+		return pulsar.NoCompression, nil
+	case "lz4":
+		return pulsar.LZ4, nil
+	case "zlib":
+		return pulsar.ZLib, nil
+	case "zstd":
+		return pulsar.ZSTD, nil
+	default:
+		return 0, fmt.Errorf("unknown compression type %q", s)
+	}
+}
+
+func parseCompressionLevel(s string) (pulsar.CompressionLevel, error) {
+	switch s {
+	case "", "default":
+		return pulsar.Default, nil
+	case "faster":
+		return pulsar.Faster, nil
+	case "better":
+		return pulsar.Better, nil
+	default:
+		return 0, fmt.Errorf("unknown compression level %q", s)
+	}
+}
+
+func (c ProducerConfig) validate() error {
+	if _, err := parseBatcherType(c.Batching.BatcherType); err != nil {
+		return err
+	}
+	if _, err := parseCompressionType(c.Compression); err != nil {
+		return err
+	}
+	if _, err := parseCompressionLevel(c.CompressionLevel); err != nil {
+		return err
+	}
+	if _, err := parseHashingScheme(c.HashingScheme); err != nil {
+		return err
+	}
+	if c.MaxPendingMessages < 0 {
+		return fmt.Errorf("max_pending_messages must not be negative, got %d", c.MaxPendingMessages)
+	}
+	if c.Chunking.Enabled && c.Batching.Enabled {
+		return errors.New("chunking requires batching to be disabled")
+	}
+	return nil
+}
+
+// newProducerOptions builds the options for a producer on topic. The
+// config has been validated, so parse errors cannot occur here.
+func newProducerOptions(c ProducerConfig, topic string, schema pulsar.Schema) pulsar.ProducerOptions {
+	batcherType, _ := parseBatcherType(c.Batching.BatcherType)
+	compressionType, _ := parseCompressionType(c.Compression)
+	compressionLevel, _ := parseCompressionLevel(c.CompressionLevel)
+	hashingScheme, _ := parseHashingScheme(c.HashingScheme)
+	name := c.Name
+	if name == "" && c.Deduplication {
+		name = cfg.MQTT.ClientID
+	}
+	return pulsar.ProducerOptions{
+		Name:                    name,
+		SendTimeout:             c.SendTimeout,
+		MaxPendingMessages:      c.MaxPendingMessages,
+		HashingScheme:           hashingScheme,
+		CompressionType:         compressionType,
+		CompressionLevel:        compressionLevel,
+		Topic:                   topic,
+		Schema:                  schema,
+		DisableBatching:         !c.Batching.Enabled,
+		BatchingMaxMessages:     c.Batching.MaxMessages,
+		BatchingMaxSize:         c.Batching.MaxBytes,
+		BatchingMaxPublishDelay: c.Batching.MaxPublishDelay,
+		BatcherBuilderType:      batcherType,
+		EnableChunking:          c.Chunking.Enabled,
+		ChunkMaxMessageSize:     c.Chunking.MaxChunkSize,
+	}
+}
+
+// newPulsarClientOptions translates a cluster's settings into client
+// options, including TLS and token authentication.
+func newPulsarClientOptions(c PulsarClusterConfig, transactions bool) pulsar.ClientOptions {
+	opts := pulsar.ClientOptions{
+		URL:                        c.URL,
+		ListenerName:               c.ListenerName,
+		TLSTrustCertsFilePath:      c.TLS.TrustCertsFile,
+		TLSAllowInsecureConnection: c.TLS.AllowInsecure,
+		TLSValidateHostname:        c.TLS.ValidateHostname,
+		EnableTransaction:          transactions,
+	}
+
+	switch {
+	case c.Auth.tokenSupplier != nil:
+		opts.Authentication = pulsar.NewAuthenticationTokenFromSupplier(c.Auth.tokenSupplier)
+	case c.Auth.Token != "":
+		opts.Authentication = pulsar.NewAuthenticationToken(c.Auth.Token)
+	case c.Auth.TokenFile != "":
+		opts.Authentication = pulsar.NewAuthenticationTokenFromFile(c.Auth.TokenFile)
+	}
+
+	return opts
+}
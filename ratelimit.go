@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig caps how fast messages are forwarded to Pulsar. Global
+// applies to all messages together. Each rule applies to every MQTT topic
+// matching its pattern separately, so a single flooding device is limited
+// without affecting the others; the first matching rule wins. Messages over
+// a limit are dropped.
+type RateLimitConfig struct {
+	Global RateLimit       `yaml:"global"`
+	Rules  []RateLimitRule `yaml:"rules"`
+}
+
+// RateLimit is a pair of token buckets. Each bucket holds one second's
+// worth of tokens, so BytesPerSecond must be larger than the biggest
+// expected payload. Zero disables the respective bucket.
+type RateLimit struct {
+	MessagesPerSecond float64 `yaml:"messages_per_second"`
+	BytesPerSecond    float64 `yaml:"bytes_per_second"`
+}
+
+type RateLimitRule struct {
+	Match     string `yaml:"match"`
+	RateLimit `yaml:",inline"`
+}
+
+func (l RateLimit) validate() error {
+	if l.MessagesPerSecond < 0 || l.BytesPerSecond < 0 {
+		return fmt.Errorf("rates must not be negative")
+	}
+	return nil
+}
+
+func (c RateLimitConfig) validate() error {
+	if err := c.Global.validate(); err != nil {
+		return fmt.Errorf("global: %w", err)
+	}
+	for i, r := range c.Rules {
+		if r.Match == "" {
+			return fmt.Errorf("rule %d: match is required", i)
+		}
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("rule %s: %w", r.Match, err)
+		}
+	}
+	return nil
+}
+
+// tokenBucket refills continuously at rate tokens per second up to rate.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// limiterPair enforces a RateLimit. Either bucket may be nil.
+type limiterPair struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+	lastUsed time.Time
+}
+
+func newLimiterPair(l RateLimit, now time.Time) *limiterPair {
+	p := &limiterPair{lastUsed: now}
+	if l.MessagesPerSecond > 0 {
+		p.messages = newTokenBucket(l.MessagesPerSecond, now)
+	}
+	if l.BytesPerSecond > 0 {
+		p.bytes = newTokenBucket(l.BytesPerSecond, now)
+	}
+	return p
+}
+
+// allow takes one message and size bytes if both buckets can afford it.
+func (p *limiterPair) allow(size int, now time.Time) bool {
+	p.lastUsed = now
+	if p.messages != nil {
+		p.messages.refill(now)
+		if p.messages.tokens < 1 {
+			return false
+		}
+	}
+	if p.bytes != nil {
+		p.bytes.refill(now)
+		if p.bytes.tokens < float64(size) {
+			return false
+		}
+		p.bytes.tokens -= float64(size)
+	}
+	if p.messages != nil {
+		p.messages.tokens--
+	}
+	return true
+}
+
+// rateLimiter holds the global limiter and one limiter per MQTT topic that
+// matched a rule.
+type rateLimiter struct {
+	rules []RateLimitRule
+
+	mu     sync.Mutex
+	global *limiterPair
+	topics map[string]*limiterPair
+}
+
+func newRateLimiter(c RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		rules:  c.Rules,
+		global: newLimiterPair(c.Global, time.Now()),
+		topics: make(map[string]*limiterPair),
+	}
+}
+
+// Allow reports whether msg is within its limits, consuming tokens if so.
+// The per-topic limit is checked first so a flooding topic doesn't eat into
+// the global budget.
+func (l *rateLimiter) Allow(msg *Message) bool {
+	now := time.Now()
+	size := len(msg.Payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if topic := l.topicLimiter(msg.Topic, now); topic != nil && !topic.allow(size, now) {
+		return false
+	}
+	return l.global.allow(size, now)
+}
+
+// topicLimiter returns the limiter for topic, creating it from the first
+// matching rule. Callers must hold mu.
+func (l *rateLimiter) topicLimiter(topic string, now time.Time) *limiterPair {
+	if p, ok := l.topics[topic]; ok {
+		return p
+	}
+	for _, r := range l.rules {
+		if topicMatches(r.Match, topic) {
+			p := newLimiterPair(r.RateLimit, now)
+			l.topics[topic] = p
+			return p
+		}
+	}
+	return nil
+}
+
+// run forgets per-topic limiters that have been idle long enough to have
+// refilled completely, until ctx is cancelled.
+func (l *rateLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for topic, p := range l.topics {
+				if now.Sub(p.lastUsed) > time.Minute {
+					delete(l.topics, topic)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SchemaRegistryConfig is where mapping schemas with registry set are looked
+// up per Pulsar topic: Pulsar's own schema registry through the admin API
+// at URL (type pulsar, the default), or a Confluent compatible registry
+// (type http). Schemas are cached for CacheTTL; when a refresh fails the
+// cached schema stays in use.
+type SchemaRegistryConfig struct {
+	Type     string        `yaml:"type"`
+	URL      string        `yaml:"url"`
+	Token    string        `yaml:"token"`
+	Username string        `yaml:"username"`
+	Password string        `yaml:"password"`
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+const (
+	registryPulsar = "pulsar"
+	registryHTTP   = "http"
+)
+
+func (c SchemaRegistryConfig) validate() error {
+	switch c.Type {
+	case "", registryPulsar, registryHTTP:
+	default:
+		return fmt.Errorf("unknown registry type %q", c.Type)
+	}
+	if c.CacheTTL < 0 || c.Timeout < 0 {
+		return errors.New("cache_ttl and timeout must not be negative")
+	}
+	return nil
+}
+
+var (
+	schemaRegistryLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "schema_registry_lookups",
+			Help: "Number of schema lookups by result: cached, fetched or failed",
+		},
+		[]string{"result"},
+	)
+
+	schemaRegistry *registryClient
+)
+
+type cachedSchema struct {
+	schema    *producerSchema
+	fetchedAt time.Time
+}
+
+// registryClient fetches Avro schemas and caches them by subject.
+type registryClient struct {
+	c      SchemaRegistryConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedSchema
+}
+
+func newRegistryClient(c SchemaRegistryConfig) *registryClient {
+	return &registryClient{
+		c:      c,
+		client: &http.Client{Timeout: c.Timeout},
+		cache:  make(map[string]cachedSchema),
+	}
+}
+
+// lookup returns the schema for pulsarTopic, fetching it when it isn't
+// cached or the cached copy has expired.
+func (r *registryClient) lookup(pulsarTopic string, sc SchemaConfig) (*producerSchema, error) {
+	subject := r.subject(pulsarTopic, sc.Subject)
+
+	r.mu.Lock()
+	cached, ok := r.cache[subject]
+	r.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < r.c.CacheTTL {
+		schemaRegistryLookups.With(prometheus.Labels{"result": "cached"}).Inc()
+		return cached.schema, nil
+	}
+
+	def, err := r.fetch(subject)
+	var schema *producerSchema
+	if err == nil {
+		schema, err = parseProducerSchema(sc.Type, def)
+	}
+	if err != nil {
+		schemaRegistryLookups.With(prometheus.Labels{"result": "failed"}).Inc()
+		if ok {
+			return cached.schema, nil
+		}
+		return nil, fmt.Errorf("looking up schema %s: %w", subject, err)
+	}
+
+	schemaRegistryLookups.With(prometheus.Labels{"result": "fetched"}).Inc()
+	r.mu.Lock()
+	r.cache[subject] = cachedSchema{schema: schema, fetchedAt: time.Now()}
+	r.mu.Unlock()
+	return schema, nil
+}
+
+// subject names the schema of pulsarTopic in the registry. For Pulsar it is
+// the topic path; for HTTP registries the configured subject, with {topic}
+// replaced by the short topic name, or <topic>-value by default.
+func (r *registryClient) subject(pulsarTopic, subject string) string {
+	path := pulsarTopic
+	if i := strings.Index(path, "://"); i >= 0 {
+		path = path[i+3:]
+	}
+	if r.c.Type != registryHTTP {
+		return path
+	}
+	name := path[strings.LastIndex(path, "/")+1:]
+	if subject == "" {
+		return name + "-value"
+	}
+	return strings.ReplaceAll(subject, "{topic}", name)
+}
+
+func (r *registryClient) fetch(subject string) (string, error) {
+	var u string
+	if r.c.Type == registryHTTP {
+		u = strings.TrimSuffix(r.c.URL, "/") + "/subjects/" + url.PathEscape(subject) + "/versions/latest"
+	} else {
+		u = strings.TrimSuffix(r.c.URL, "/") + "/admin/v2/schemas/" + subject + "/schema"
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case r.c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+r.c.Token)
+	case r.c.Username != "":
+		req.SetBasicAuth(r.c.Username, r.c.Password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry responded %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// Pulsar returns the definition as data, Confluent registries as schema
+	var doc struct {
+		Data   string `json:"data"`
+		Schema string `json:"schema"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return "", fmt.Errorf("parsing registry response: %w", err)
+	}
+	if doc.Data != "" {
+		return doc.Data, nil
+	}
+	if doc.Schema != "" {
+		return doc.Schema, nil
+	}
+	return "", errors.New("registry response contains no schema")
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	// configMu guards the config sections replaced by a reload against
+	// concurrent readers such as the admin API.
+	configMu sync.RWMutex
+	// reloadMu serializes reloads triggered by SIGHUP and the remote
+	// config watch.
+	reloadMu sync.Mutex
+)
+
+// pipeline is the part of the processing a reload replaces.
+type pipeline struct {
+	mapper     *topicMapper
+	transforms *transformPipeline
+	filters    *messageFilter
+	validator  *payloadValidator
+	acl        *topicACL
+	bridges    map[string]bridgePipeline
+
+	// users counts the messages being processed with the pipeline, plus
+	// one while it is the current one. The last to let go closes it.
+	users atomic.Int64
+}
+
+// newPipeline builds the pipeline for c, reporting every invalid section.
+// It takes over the filter history and unchanged sinks of prev, if any.
+func newPipeline(c *Config, prev *pipeline) (*pipeline, error) {
+	var errs []error
+	p := &pipeline{}
+	var err error
+	var prevBridges map[string]bridgePipeline
+	if prev != nil {
+		prevBridges = prev.bridges
+	}
+	if p.mapper, err = newTopicMapper(c.Mapping, c.MQTT.allSubscriptions()); err != nil {
+		errs = append(errs, fmt.Errorf("invalid topic mapping: %w", err))
+	}
+	if p.transforms, err = newTransformPipeline(c.Transforms); err != nil {
+		errs = append(errs, fmt.Errorf("invalid transform configuration: %w", err))
+	}
+	if p.filters, err = newMessageFilter(c.Filters); err != nil {
+		errs = append(errs, fmt.Errorf("invalid filter configuration: %w", err))
+	}
+	if p.validator, err = newPayloadValidator(c.Validation); err != nil {
+		errs = append(errs, fmt.Errorf("invalid validation configuration: %w", err))
+	}
+	if p.acl, err = newTopicACL(c.Topics); err != nil {
+		errs = append(errs, fmt.Errorf("invalid topics configuration: %w", err))
+	}
+	if p.bridges, err = newBridgePipelines(c, prevBridges); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		p.close()
+		return nil, errors.Join(errs...)
+	}
+	if prev != nil {
+		p.filters.inherit(prev.filters)
+	}
+	p.users.Store(1)
+	return p, nil
+}
+
+// acquirePipeline returns the current pipeline, which stays open until
+// released.
+func acquirePipeline() *pipeline {
+	for {
+		p := routing.Load()
+		// A pipeline without users is being closed and has already been
+		// replaced
+		if n := p.users.Load(); n > 0 && p.users.CompareAndSwap(n, n+1) {
+			return p
+		}
+	}
+}
+
+// release lets go of p, closing it when it has been replaced and no
+// message uses it any more.
+func (p *pipeline) release() {
+	if p.users.Add(-1) == 0 {
+		p.close()
+	}
+}
+
+// close releases the transforms and bridge sinks of a pipeline that has
+// been replaced.
+func (p *pipeline) close() {
+	p.transforms.Close()
+	closeSinks(p.bridges)
+}
+
+// watchReload reloads the routing configuration every time the process
+// receives SIGHUP, until ctx is cancelled.
+func watchReload(ctx context.Context, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := reloadConfig(path); err != nil {
+				slog.Error("Failed to reload config, keeping the current one", "error", err)
+				continue
+			}
+			slog.Info("Reloaded config", "path", path)
+		}
+	}
+}
+
+// reloadConfig re-reads the config and swaps in the topic mapping,
+// subscriptions, transforms, filters, validation rules and topic ACL. The
+// new pipeline is built before it replaces the running one in a single
+// swap, so an invalid config leaves the running one intact and no message
+// sees a mix of the two.
+// Other settings, such as connection details, still need a restart.
+func reloadConfig(path string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := checkBridgeSet(cfg.Bridges, next.Bridges); err != nil {
+		return err
+	}
+	nextPipeline, err := newPipeline(next, routing.Load())
+	if err != nil {
+		return err
+	}
+	// Messages still being processed keep the previous pipeline open
+	if prev := routing.Swap(nextPipeline); prev != nil {
+		prev.release()
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	if mqttSubscribed.Load() {
+		resubscribe(cfg.MQTT.Subscriptions, next.MQTT.Subscriptions)
+	}
+	cfg.Mapping = next.Mapping
+	cfg.Transforms = next.Transforms
+	cfg.Filters = next.Filters
+	cfg.Validation.Rules = next.Validation.Rules
+	cfg.Topics = next.Topics
+	cfg.MQTT.Subscriptions = next.MQTT.Subscriptions
+	cfg.Bridges = next.Bridges
+	return nil
+}
+
+// resubscribe brings the MQTT subscriptions from old to next. Filters that
+// are gone are unsubscribed, and new filters or ones whose QoS changed are
+// subscribed. Failures are logged so one bad filter doesn't block the rest.
+func resubscribe(old, next []Subscription) {
+	current := make(map[string]byte, len(old))
+	for _, s := range old {
+		current[s.Filter] = s.qos(cfg.MQTT.QoS)
+	}
+
+	for _, s := range next {
+		qos := s.qos(cfg.MQTT.QoS)
+		if prev, ok := current[s.Filter]; ok {
+			delete(current, s.Filter)
+			if prev == qos {
+				continue
+			}
+		}
+		if err := client.Subscribe(s.Filter, qos, receiveMessage); err != nil {
+			slog.Error("Failed to subscribe", "filter", s.Filter, "error", err)
+			continue
+		}
+		slog.Info("Subscribed to MQTT topic filter", "filter", s.Filter, "qos", qos)
+	}
+
+	for filter := range current {
+		if err := client.Unsubscribe(filter); err != nil {
+			slog.Error("Failed to unsubscribe", "filter", filter, "error", err)
+			continue
+		}
+		slog.Info("Unsubscribed from MQTT topic filter", "filter", filter)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Remote config backends for remote.type.
+const (
+	remoteConsul = "consul"
+	remoteEtcd   = "etcd"
+)
+
+// RemoteConfig loads the topic mapping and filters from a key in Consul or
+// etcd, enabled by setting Address and Key. The key holds YAML with the
+// mapping and filters sections of the config file; sections it leaves out
+// keep their local value. The connector watches the key and applies
+// changes like a SIGHUP reload, so a fleet of connectors picks up routing
+// changes from one place.
+//
+// Token is a Consul ACL token. Username and Password authenticate with
+// etcd, which is reached through its gRPC gateway.
+type RemoteConfig struct {
+	Type     string    `yaml:"type"`
+	Address  string    `yaml:"address"`
+	Key      string    `yaml:"key"`
+	Token    string    `yaml:"token"`
+	Username string    `yaml:"username"`
+	Password string    `yaml:"password"`
+	TLS      TLSConfig `yaml:"tls"`
+	// Timeout bounds reading the key, WaitTime a single watch request.
+	Timeout       time.Duration `yaml:"timeout"`
+	WaitTime      time.Duration `yaml:"wait_time"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+
+	// index is the version of the key the config was loaded from.
+	index uint64
+}
+
+func (c RemoteConfig) enabled() bool {
+	return c.Address != "" && c.Key != ""
+}
+
+func (c RemoteConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.Type != remoteConsul && c.Type != remoteEtcd {
+		return fmt.Errorf("type must be consul or etcd, got %q", c.Type)
+	}
+	if _, err := url.Parse(c.Address); err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+	if c.Timeout <= 0 || c.WaitTime <= 0 || c.RetryInterval <= 0 {
+		return errors.New("timeout, wait_time and retry_interval must be positive")
+	}
+	return nil
+}
+
+// remoteSections is the part of the config a remote backend provides.
+type remoteSections struct {
+	Mapping MappingConfig `yaml:"mapping"`
+	Filters []FilterRule  `yaml:"filters"`
+}
+
+// remoteStore reads and watches the key holding the remote config.
+type remoteStore interface {
+	// get returns the value of the key, nil if it doesn't exist, and the
+	// index it was read at.
+	get(ctx context.Context) ([]byte, uint64, error)
+	// wait blocks until the key changes after index or the backend's wait
+	// time has passed, and returns the index then current.
+	wait(ctx context.Context, index uint64) (uint64, error)
+}
+
+func newRemoteStore(c RemoteConfig) (remoteStore, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.TLS.enabled() {
+		tlsConfig, err := newTLSConfig(c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	// Watches outlive any fixed client timeout, so requests are bounded by
+	// their contexts instead
+	client := &http.Client{Transport: transport}
+	if c.Type == remoteEtcd {
+		return &etcdStore{cfg: c, http: client}, nil
+	}
+	return &consulStore{cfg: c, http: client}, nil
+}
+
+// applyRemoteConfig reads the remote config into c.
+func applyRemoteConfig(ctx context.Context, c *Config) error {
+	store, err := newRemoteStore(c.Remote)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.Remote.Timeout)
+	defer cancel()
+	value, index, err := store.get(ctx)
+	if err != nil {
+		return fmt.Errorf("reading %s key %s: %w", c.Remote.Type, c.Remote.Key, err)
+	}
+	c.Remote.index = index
+	if value == nil {
+		slog.Warn("Remote config key doesn't exist, using the local routing config", "key", c.Remote.Key)
+		return nil
+	}
+
+	if err := applyRemoteSections(c, value); err != nil {
+		return fmt.Errorf("parsing %s key %s: %w", c.Remote.Type, c.Remote.Key, err)
+	}
+	return nil
+}
+
+// applyRemoteSections replaces the sections set in the YAML data in c.
+func applyRemoteSections(c *Config, data []byte) error {
+	sections := remoteSections{Mapping: c.Mapping, Filters: c.Filters}
+	if err := yaml.Unmarshal(data, &sections); err != nil {
+		return err
+	}
+	c.Mapping, c.Filters = sections.Mapping, sections.Filters
+	return nil
+}
+
+// watchRemoteConfig reloads the config every time the remote key changes,
+// until ctx is cancelled.
+func watchRemoteConfig(ctx context.Context, path string, c RemoteConfig) {
+	store, err := newRemoteStore(c)
+	if err != nil {
+		slog.Error("Failed to watch remote config", "error", err)
+		return
+	}
+	index := c.index
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, c.WaitTime+c.Timeout)
+		next, err := store.wait(waitCtx, index)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("Failed to watch remote config, retrying", "key", c.Key, "error", err, "retry_in", c.RetryInterval)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(c.RetryInterval):
+			}
+			continue
+		}
+		if next == index {
+			continue
+		}
+		index = next
+		if err := reloadConfig(path); err != nil {
+			slog.Error("Failed to apply remote config, keeping the current one", "key", c.Key, "error", err)
+			continue
+		}
+		slog.Info("Applied remote config", "key", c.Key, "index", index)
+	}
+}
+
+// consulStore reads the key from the Consul KV store and watches it with
+// blocking queries.
+type consulStore struct {
+	cfg  RemoteConfig
+	http *http.Client
+}
+
+func (s *consulStore) get(ctx context.Context) ([]byte, uint64, error) {
+	return s.query(ctx, url.Values{"raw": {""}})
+}
+
+func (s *consulStore) wait(ctx context.Context, index uint64) (uint64, error) {
+	_, next, err := s.query(ctx, url.Values{
+		"index": {strconv.FormatUint(index, 10)},
+		"wait":  {s.cfg.WaitTime.String()},
+	})
+	if err != nil {
+		return index, err
+	}
+	// Consul resets the index, e.g. after restoring a snapshot
+	if next < index {
+		return 0, nil
+	}
+	return next, nil
+}
+
+func (s *consulStore) query(ctx context.Context, params url.Values) ([]byte, uint64, error) {
+	u := strings.TrimSuffix(s.cfg.Address, "/") + "/v1/kv/" + strings.TrimPrefix(s.cfg.Key, "/") + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", s.cfg.Token)
+	}
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, index, nil
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, 0, fmt.Errorf("consul returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if _, ok := params["raw"]; !ok {
+		return nil, index, nil
+	}
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, index, nil
+}
+
+// etcdStore reads the key from etcd through the v3 JSON gateway and
+// watches it with a watch stream.
+type etcdStore struct {
+	cfg   RemoteConfig
+	http  *http.Client
+	token string
+}
+
+// etcdHeader carries the store revision. The gateway encodes 64-bit
+// integers as strings.
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdKeyValue struct {
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+func (s *etcdStore) get(ctx context.Context) ([]byte, uint64, error) {
+	var resp struct {
+		Header etcdHeader     `json:"header"`
+		KVs    []etcdKeyValue `json:"kvs"`
+	}
+	if err := s.do(ctx, "/v3/kv/range", map[string]any{"key": []byte(s.cfg.Key)}, &resp); err != nil {
+		return nil, 0, err
+	}
+	if len(resp.KVs) == 0 {
+		return nil, uint64(resp.Header.Revision), nil
+	}
+	return resp.KVs[0].Value, uint64(resp.Header.Revision), nil
+}
+
+func (s *etcdStore) wait(ctx context.Context, index uint64) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.WaitTime)
+	defer cancel()
+	body := map[string]any{"create_request": map[string]any{
+		"key":            []byte(s.cfg.Key),
+		"start_revision": strconv.FormatUint(index+1, 10),
+	}}
+	resp, err := s.post(ctx, "/v3/watch", body)
+	if err != nil {
+		return index, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var msg struct {
+			Result struct {
+				Events []struct {
+					KV etcdKeyValue `json:"kv"`
+				} `json:"events"`
+				Canceled     bool   `json:"canceled"`
+				CancelReason string `json:"cancel_reason"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				// Nothing changed within the wait time
+				return index, nil
+			}
+			return index, err
+		}
+		if msg.Result.Canceled {
+			return index, fmt.Errorf("etcd canceled the watch: %s", msg.Result.CancelReason)
+		}
+		if n := len(msg.Result.Events); n > 0 {
+			return uint64(msg.Result.Events[n-1].KV.ModRevision), nil
+		}
+	}
+}
+
+// do posts body to path and decodes the response into out.
+func (s *etcdStore) do(ctx context.Context, path string, body, out any) error {
+	resp, err := s.post(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// post sends body to path, authenticating first if credentials are
+// configured and again once the token has expired.
+func (s *etcdStore) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	if s.cfg.Username != "" && s.token == "" {
+		if err := s.authenticate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := s.send(ctx, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && s.cfg.Username != "" {
+		resp.Body.Close()
+		if err := s.authenticate(ctx); err != nil {
+			return nil, err
+		}
+		if resp, err = s.send(ctx, path, body); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("etcd returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+func (s *etcdStore) authenticate(ctx context.Context) error {
+	resp, err := s.send(ctx, "/v3/auth/authenticate", map[string]string{"name": s.cfg.Username, "password": s.cfg.Password})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("etcd authentication returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return err
+	}
+	s.token = auth.Token
+	return nil
+}
+
+func (s *etcdStore) send(ctx context.Context, path string, body any) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(s.cfg.Address, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", s.token)
+	}
+	return s.http.Do(req)
+}
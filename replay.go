@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// replayOptions are the flags of the replay-dead-letters command.
+type replayOptions struct {
+	Topic        string
+	Subscription string
+	// Rate caps the messages replayed per second; 0 means no limit.
+	Rate        float64
+	IdleTimeout time.Duration
+	// SkipTransforms bypasses the transform chain, which has usually been
+	// applied already before a message was dead-lettered.
+	SkipTransforms bool
+}
+
+// replayDeadLetters consumes the dead-letter topic and sends every message
+// through the pipeline again, to wherever the current mapping routes its
+// original MQTT topic. It returns once no message has arrived for
+// IdleTimeout. Messages are acked on the dead-letter subscription only once
+// delivered, so failures stay there for the next attempt; in dry-run mode
+// nothing is acked.
+func replayDeadLetters(o replayOptions) error {
+	if o.Topic == "" {
+		o.Topic = cfg.DeadLetter.Topic
+	}
+	if o.Topic == "" {
+		return errors.New("no dead-letter topic configured; pass --topic")
+	}
+	if cfg.Vault.Address != "" {
+		if _, err := applyVaultSecrets(context.Background(), cfg); err != nil {
+			return fmt.Errorf("fetching credentials from Vault: %w", err)
+		}
+	}
+	if err := initPipeline(); err != nil {
+		return err
+	}
+
+	// Messages failing again must not loop back into the topic being read
+	cfg.DeadLetter.Topic = ""
+	limiter = newRateLimiter(RateLimitConfig{})
+	breaker = newCircuitBreaker(cfg.CircuitBreaker)
+
+	var err error
+	if pulsarClient, err = newClusterClient(cfg.Pulsar); err != nil {
+		return fmt.Errorf("creating Pulsar client: %w", err)
+	}
+	defer pulsarClient.Close()
+	producers = newProducerCache(cfg.Pulsar.ProducerCache)
+	defer producers.CloseAll()
+
+	consumer, err := pulsarClient.Subscribe(pulsar.ConsumerOptions{
+		Topic:                       o.Topic,
+		SubscriptionName:            o.Subscription,
+		Type:                        pulsar.Exclusive,
+		SubscriptionInitialPosition: pulsar.SubscriptionPositionEarliest,
+	})
+	if err != nil {
+		return fmt.Errorf("subscribing to %s: %w", o.Topic, err)
+	}
+	defer consumer.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var pace <-chan time.Time
+	if o.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / o.Rate))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
+	slog.Info("Replaying dead-lettered messages", "dlq_topic", o.Topic, "subscription", o.Subscription, "dry_run", dryRun)
+	replayed := 0
+	for {
+		receiveCtx, cancelReceive := context.WithTimeout(ctx, o.IdleTimeout)
+		m, err := consumer.Receive(receiveCtx)
+		cancelReceive()
+		if err != nil {
+			// Interrupted, or idle for long enough to be done
+			if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+			return fmt.Errorf("receiving from %s: %w", o.Topic, err)
+		}
+
+		msg, ok := messageFromDeadLetter(m)
+		if !ok {
+			slog.Warn("Skipping message without an MQTT topic", "message_id", m.ID().String())
+			continue
+		}
+		if !dryRun {
+			msg.ack = func() {
+				if err := consumer.Ack(m); err != nil {
+					slog.Warn("Failed to ack dead-lettered message", "message_id", m.ID().String(), "error", err)
+				}
+			}
+		}
+
+		if pace != nil {
+			select {
+			case <-pace:
+			case <-ctx.Done():
+			}
+		}
+		if o.SkipTransforms {
+			routeMessage(ctx, msg)
+			msg.releaseRouting()
+		} else {
+			handleMQTTMessage(msg)
+		}
+		replayed++
+	}
+
+	inFlight.Wait()
+	producers.FlushAll()
+	slog.Info("Finished replaying dead-lettered messages", "dlq_topic", o.Topic, "messages", replayed)
+	return nil
+}
+
+// messageFromDeadLetter rebuilds the MQTT message that was dead-lettered
+// from the properties deadLetter attached to it.
+func messageFromDeadLetter(m pulsar.Message) (*Message, bool) {
+	props := maps.Clone(m.Properties())
+	topic := props["dlq_mqtt_topic"]
+	if topic == "" {
+		return nil, false
+	}
+
+	qos, _ := strconv.Atoi(props["mqtt_qos"])
+	retained, _ := strconv.ParseBool(props["mqtt_retained"])
+	receivedAt, err := time.Parse(time.RFC3339Nano, props["mqtt_received_at"])
+	if err != nil {
+		receivedAt = m.PublishTime()
+	}
+	correlation, _ := base64.StdEncoding.DecodeString(props["mqtt_correlation_data"])
+
+	msg := &Message{
+		Topic:           topic,
+		Payload:         m.Payload(),
+		QoS:             byte(qos),
+		Retained:        retained,
+		ReceivedAt:      receivedAt,
+		ContentType:     props["mqtt_content_type"],
+		CorrelationData: correlation,
+	}
+
+	// Whatever isn't connector metadata came from MQTT 5 user properties
+	maps.DeleteFunc(props, func(k, _ string) bool {
+		return strings.HasPrefix(k, "mqtt_") || strings.HasPrefix(k, "dlq_")
+	})
+	if len(props) > 0 {
+		msg.UserProperties = props
+	}
+	return msg, true
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryConfig is the retry policy for failed Pulsar sends. MaxAttempts
+// counts the initial attempt, so 1 disables retries. Jitter is the fraction
+// (0-1) of each backoff that is randomised. Zero MaxBackoff leaves the
+// backoff uncapped.
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"`
+	BaseBackoff time.Duration `yaml:"base_backoff"`
+	MaxBackoff  time.Duration `yaml:"max_backoff"`
+	Jitter      float64       `yaml:"jitter"`
+}
+
+// backoff returns the delay before the given retry (1 for the first retry),
+// doubling from BaseBackoff up to MaxBackoff.
+func (c RetryConfig) backoff(retry int) time.Duration {
+	d := c.BaseBackoff
+	for i := 1; i < retry && (c.MaxBackoff == 0 || d < c.MaxBackoff) && d < math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if c.MaxBackoff > 0 && d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	if c.Jitter > 0 {
+		spread := float64(d) * c.Jitter
+		d = time.Duration(float64(d) - spread + rand.Float64()*2*spread)
+	}
+	return d
+}
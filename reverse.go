@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ReverseConfig configures the Pulsar to MQTT pipeline. It is disabled when
+// no routes are configured.
+type ReverseConfig struct {
+	SubscriptionName string         `yaml:"subscription_name"`
+	Routes           []ReverseRoute `yaml:"routes"`
+}
+
+// ReverseRoute consumes PulsarTopic and publishes every message to the MQTT
+// topic produced by the MQTTTopic template. Besides the {N} and {N:}
+// segment placeholders (taken from the Pulsar topic path without the
+// persistent:// scheme), the template may use {key} for the message key.
+type ReverseRoute struct {
+	PulsarTopic string `yaml:"pulsar_topic"`
+	MQTTTopic   string `yaml:"mqtt_topic"`
+	QoS         byte   `yaml:"qos"`
+	Retain      bool   `yaml:"retain"`
+}
+
+// reverseBridge runs one consumer per configured route.
+type reverseBridge struct {
+	consumers []pulsar.Consumer
+	wg        sync.WaitGroup
+}
+
+func startReverseBridge(ctx context.Context, c ReverseConfig) (*reverseBridge, error) {
+	b := &reverseBridge{}
+	for _, route := range c.Routes {
+		consumer, err := pulsarClient.Subscribe(pulsar.ConsumerOptions{
+			Topic:            route.PulsarTopic,
+			SubscriptionName: c.SubscriptionName,
+			Type:             pulsar.Shared,
+		})
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("subscribing to %s: %w", route.PulsarTopic, err)
+		}
+		b.consumers = append(b.consumers, consumer)
+
+		b.wg.Add(1)
+		go b.consume(ctx, consumer, route)
+	}
+	return b, nil
+}
+
+func (b *reverseBridge) consume(ctx context.Context, consumer pulsar.Consumer, route ReverseRoute) {
+	defer b.wg.Done()
+	for {
+		msg, err := consumer.Receive(ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				return
+			}
+			slog.Error("Failed to receive from Pulsar", "pulsar_topic", route.PulsarTopic, "error", err)
+			continue
+		}
+
+		mqttTopic := reverseTopic(route.MQTTTopic, msg)
+		if err := client.Publish(mqttTopic, route.QoS, route.Retain, msg.Payload()); err != nil {
+			slog.Error("Failed to publish to MQTT",
+				"pulsar_topic", msg.Topic(), "mqtt_topic", mqttTopic, "message_id", msg.ID().String(), "error", err)
+			consumer.Nack(msg)
+			continue
+		}
+		if err := consumer.Ack(msg); err != nil {
+			slog.Warn("Failed to ack Pulsar message", "pulsar_topic", msg.Topic(), "message_id", msg.ID().String(), "error", err)
+		}
+		messagesPublishedToMQTT.With(prometheus.Labels{"topic": route.PulsarTopic}).Inc()
+		logSampled(slog.LevelDebug, mqttTopic, "Message forwarded to MQTT", "pulsar_topic", msg.Topic(), "mqtt_topic", mqttTopic)
+	}
+}
+
+func reverseTopic(tmpl string, msg pulsar.Message) string {
+	path := msg.Topic()
+	if i := strings.Index(path, "://"); i >= 0 {
+		path = path[i+3:]
+	}
+	return expandTopicTemplate(strings.ReplaceAll(tmpl, "{key}", msg.Key()), path)
+}
+
+// Close stops all consumers. The context passed to startReverseBridge must
+// be cancelled first so the receive loops exit.
+func (b *reverseBridge) Close() {
+	for _, consumer := range b.consumers {
+		consumer.Close()
+	}
+	b.wg.Wait()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RotationConfig controls how often credentials are checked for changes.
+// The MQTT TLS files are compared by size and modification time, static
+// Vault secrets are read again, and leased Vault secrets are renewed once
+// two thirds of their lease have passed. When the MQTT credentials change
+// the connector reconnects to the broker. Pulsar picks up a changed token
+// file or Vault token the next time it authenticates.
+type RotationConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+type rotatingSubscription struct {
+	filter  string
+	qos     byte
+	handler func(*Message)
+}
+
+// rotatingConn is an mqttConn whose underlying connection can be replaced
+// while the connector runs. It keeps its own record of subscriptions so
+// they can be restored on the new connection.
+type rotatingConn struct {
+	mu            sync.RWMutex
+	conn          mqttConn
+	subscriptions []rotatingSubscription
+}
+
+func newRotatingConn(conn mqttConn) *rotatingConn {
+	return &rotatingConn{conn: conn}
+}
+
+func (r *rotatingConn) Subscribe(filter string, qos byte, handler func(*Message)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscriptions = slices.DeleteFunc(r.subscriptions, func(s rotatingSubscription) bool { return s.filter == filter })
+	r.subscriptions = append(r.subscriptions, rotatingSubscription{filter: filter, qos: qos, handler: handler})
+	return r.conn.Subscribe(filter, qos, handler)
+}
+
+func (r *rotatingConn) Unsubscribe(filter string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscriptions = slices.DeleteFunc(r.subscriptions, func(s rotatingSubscription) bool { return s.filter == filter })
+	return r.conn.Unsubscribe(filter)
+}
+
+func (r *rotatingConn) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.conn.Publish(topic, qos, retain, payload)
+}
+
+func (r *rotatingConn) IsConnected() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.conn.IsConnected()
+}
+
+func (r *rotatingConn) Disconnect() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.conn.Disconnect()
+}
+
+// reconnect opens a new connection with c, restores the subscriptions and
+// then closes the old connection. The new connection takes over the
+// session of the old one, which therefore must not reconnect; it is
+// disconnected right away. On failure the old connection stays in use.
+func (r *rotatingConn) reconnect(c MQTTConfig) error {
+	next, err := connectMQTT(c)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	old := r.conn
+	r.conn = next
+	subs := slices.Clone(r.subscriptions)
+	r.mu.Unlock()
+
+	old.Disconnect()
+	for _, s := range subs {
+		if err := next.Subscribe(s.filter, s.qos, s.handler); err != nil {
+			slog.Error("Failed to resubscribe after reconnecting", "filter", s.filter, "error", err)
+		}
+	}
+	return nil
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func statFiles(paths ...string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if fi, err := os.Stat(p); err == nil {
+			stamps[p] = fileStamp{size: fi.Size(), modTime: fi.ModTime()}
+		}
+	}
+	return stamps
+}
+
+// watchCredentials reconnects to MQTT whenever its credentials change and
+// keeps the Vault secrets fresh, until ctx is cancelled. vault is nil when
+// Vault is not used.
+func watchCredentials(ctx context.Context, c RotationConfig, vault *vaultClient) {
+	tls := cfg.MQTT.TLS
+	files := statFiles(tls.CAFile, tls.CertFile, tls.KeyFile)
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reconnect := false
+		if current := statFiles(tls.CAFile, tls.CertFile, tls.KeyFile); !stampsEqual(files, current) {
+			slog.Info("MQTT TLS files changed")
+			files = current
+			reconnect = true
+		}
+		if vault != nil {
+			changed, err := vault.refresh(ctx, cfg)
+			if err != nil {
+				slog.Error("Failed to refresh Vault secrets", "error", err)
+			}
+			if changed {
+				slog.Info("MQTT credentials in Vault changed")
+				reconnect = true
+			}
+		}
+
+		if reconnect {
+			if err := client.reconnect(cfg.MQTT); err != nil {
+				slog.Error("Failed to reconnect to MQTT with new credentials", "error", err)
+				continue
+			}
+			slog.Info("Reconnected to MQTT with new credentials")
+		}
+	}
+}
+
+func stampsEqual(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !v.modTime.Equal(w.modTime) || v.size != w.size {
+			return false
+		}
+	}
+	return true
+}
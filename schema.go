@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/hamba/avro/v2"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// SchemaConfig attaches a Pulsar schema to the producers of a mapping. For
+// json and avro, File holds the Avro record definition, which Pulsar uses
+// for both. For protobuf, File is a FileDescriptorSet and MessageType the
+// fully qualified name of the message; binary payloads are forwarded as
+// they are and JSON payloads are encoded to protobuf.
+//
+// With Registry set, json and avro definitions are instead fetched from the
+// schema registry for each mapped topic, under Subject for HTTP registries.
+type SchemaConfig struct {
+	Type        string `yaml:"type"`
+	File        string `yaml:"file"`
+	MessageType string `yaml:"message_type"`
+	Registry    bool   `yaml:"registry"`
+	Subject     string `yaml:"subject"`
+}
+
+// producerSchema is a loaded Pulsar schema plus the parsed Avro definition
+// or protobuf descriptor needed to turn JSON payloads into schema values.
+type producerSchema struct {
+	pulsar.Schema
+	avro  avro.Schema
+	proto protoreflect.MessageDescriptor
+}
+
+func loadProducerSchema(c SchemaConfig) (*producerSchema, error) {
+	if strings.EqualFold(c.Type, "protobuf") {
+		if c.MessageType == "" {
+			return nil, errors.New("protobuf schema requires message_type")
+		}
+		md, err := loadMessageDescriptor(c.File, c.MessageType)
+		if err != nil {
+			return nil, err
+		}
+		s := pulsar.NewProtoNativeSchemaWithMessage(dynamicpb.NewMessage(md), nil)
+		return &producerSchema{Schema: s, proto: md}, nil
+	}
+
+	def, err := os.ReadFile(c.File)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema file %s: %w", c.File, err)
+	}
+	s, err := parseProducerSchema(c.Type, string(def))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.File, err)
+	}
+	return s, nil
+}
+
+// parseProducerSchema builds a json or avro schema from its definition.
+func parseProducerSchema(typ, def string) (*producerSchema, error) {
+	switch strings.ToLower(typ) {
+	case "json":
+		s, err := pulsar.NewJSONSchemaWithValidation(def, nil)
+		if err != nil {
+			return nil, fmt.Errorf("parsing JSON schema: %w", err)
+		}
+		return &producerSchema{Schema: s}, nil
+	case "avro":
+		s, err := pulsar.NewAvroSchemaWithValidation(def, nil)
+		if err != nil {
+			return nil, fmt.Errorf("parsing Avro schema: %w", err)
+		}
+		return &producerSchema{Schema: s, avro: s.Codec}, nil
+	default:
+		return nil, fmt.Errorf("unsupported schema type %q", typ)
+	}
+}
+
+// encode converts a JSON payload into the wire format of the schema.
+func (s *producerSchema) encode(payload []byte) ([]byte, error) {
+	if s.proto != nil {
+		return s.encodeProto(payload)
+	}
+	var value any
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil, fmt.Errorf("payload is not valid JSON: %w", err)
+	}
+	if s.avro != nil {
+		value = coerceAvro(s.avro, value)
+	}
+	return s.Encode(value)
+}
+
+// coerceAvro converts the float64 numbers produced by encoding/json into the
+// integer and float types expected by the Avro schema.
+func coerceAvro(schema avro.Schema, v any) any {
+	switch s := schema.(type) {
+	case *avro.RecordSchema:
+		if obj, ok := v.(map[string]any); ok {
+			for _, f := range s.Fields() {
+				if fv, ok := obj[f.Name()]; ok {
+					obj[f.Name()] = coerceAvro(f.Type(), fv)
+				}
+			}
+		}
+	case *avro.ArraySchema:
+		if arr, ok := v.([]any); ok {
+			for i := range arr {
+				arr[i] = coerceAvro(s.Items(), arr[i])
+			}
+		}
+	case *avro.MapSchema:
+		if obj, ok := v.(map[string]any); ok {
+			for k := range obj {
+				obj[k] = coerceAvro(s.Values(), obj[k])
+			}
+		}
+	case *avro.UnionSchema:
+		if v == nil {
+			return nil
+		}
+		for _, t := range s.Types() {
+			if t.Type() != avro.Null {
+				return coerceAvro(t, v)
+			}
+		}
+	case *avro.PrimitiveSchema:
+		if f, ok := v.(float64); ok {
+			switch s.Type() {
+			case avro.Int:
+				return int32(f)
+			case avro.Long:
+				return int64(f)
+			case avro.Float:
+				return float32(f)
+			}
+		}
+	}
+	return v
+}
+
+// encodeProto checks a binary protobuf payload against the message type, or
+// encodes a JSON one.
+func (s *producerSchema) encodeProto(payload []byte) ([]byte, error) {
+	m := dynamicpb.NewMessage(s.proto)
+	if len(payload) > 0 && payload[0] == '{' {
+		if err := protojson.Unmarshal(payload, m); err != nil {
+			return nil, fmt.Errorf("payload does not match %s: %w", s.proto.FullName(), err)
+		}
+		return proto.Marshal(m)
+	}
+	if err := proto.Unmarshal(payload, m); err != nil {
+		return nil, fmt.Errorf("payload is not a valid %s: %w", s.proto.FullName(), err)
+	}
+	return payload, nil
+}
+
+// Schema check policies for mapping.schema_check.
+const (
+	schemaCheckOff  = "off"
+	schemaCheckWarn = "warn"
+	schemaCheckFail = "fail"
+)
+
+// registerSchemas creates the producers of rules with a schema file and a
+// fixed topic. Pulsar registers the schema on producer creation or rejects
+// it as incompatible, so clashes show at startup instead of on the first
+// send. Depending on policy they are logged or returned.
+func registerSchemas(m *topicMapper, policy string) error {
+	if policy == schemaCheckOff {
+		return nil
+	}
+	routes := append([]*mappingRoute{}, m.routes...)
+	for _, r := range m.table {
+		routes = append(routes, r)
+	}
+	if m.fallback != nil {
+		routes = append(routes, m.fallback)
+	}
+
+	for _, r := range routes {
+		topic, ok := r.staticTopic()
+		if !ok || r.schema == nil {
+			continue
+		}
+		dest := Destination{Topic: topic, route: r}
+		if _, ok := producers.get(topic); ok {
+			continue
+		}
+		producer, err := pulsarClient.CreateProducer(newProducerOptions(dest.producerConfig(), topic, dest.producerSchema()))
+		if err != nil {
+			if policy == schemaCheckFail {
+				return fmt.Errorf("registering schema %s for %s: %w", r.Schema.File, topic, err)
+			}
+			slog.Warn("Failed to register schema", "pulsar_topic", topic, "schema", r.Schema.File, "error", err)
+			continue
+		}
+		producers.add(topic, producer)
+		slog.Info("Registered schema", "pulsar_topic", topic, "schema", r.Schema.File)
+	}
+	return nil
+}
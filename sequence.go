@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// sequenceIdleTimeout is how long a topic keeps its sequence state after
+// its last send.
+const sequenceIdleTimeout = 10 * time.Minute
+
+// sequences assigns Pulsar sequence IDs when producer deduplication is
+// enabled.
+var sequences = &sequencer{topics: make(map[string]*topicSequence)}
+
+// topicSequence is the sequence state of a topic. Its send mutex is held
+// from assigning an ID until the message has been sent or given up on,
+// retries included, so a topic has one message in flight and IDs reach
+// the broker in increasing order.
+type topicSequence struct {
+	send sync.Mutex
+	next int64
+
+	// persisted is the last ID the broker had persisted for the producer
+	// when the topic was first used, or -1 when it didn't say.
+	persisted int64
+
+	// users and lastUsed are guarded by the sequencer's mutex.
+	users    int
+	lastUsed time.Time
+}
+
+// sequencer hands out increasing sequence IDs per topic. The broker
+// discards messages with an ID it has already persisted for the producer,
+// such as those the client resends after a reconnect.
+//
+// New IDs are based on the clock in microseconds, so they exceed the IDs
+// of earlier runs without knowing the broker's last one. A message keeps
+// its ID across retries. Messages replayed from the WAL are skipped when
+// the broker had already persisted the ID they were sent with before the
+// crash, since the topic's sends were serialized.
+type sequencer struct {
+	mu        sync.Mutex
+	topics    map[string]*topicSequence
+	lastSweep time.Time
+}
+
+// acquire waits until topic has no message in flight, then sets the
+// sequence ID of pmsg. It returns the ID and a function to call once the
+// message has been sent or given up on. persisted reports a message
+// replayed from the WAL that the broker already has; it must not be sent.
+func (s *sequencer) acquire(topic string, producer pulsar.Producer, msg *Message, pmsg *pulsar.ProducerMessage) (id int64, persisted bool, release func()) {
+	now := time.Now()
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) >= sequenceIdleTimeout {
+		s.sweep(now)
+	}
+	ts, ok := s.topics[topic]
+	if !ok {
+		ts = &topicSequence{persisted: producer.LastSequenceID()}
+		s.topics[topic] = ts
+	}
+	ts.users++
+	s.mu.Unlock()
+
+	ts.send.Lock()
+	release = func() {
+		ts.send.Unlock()
+		s.mu.Lock()
+		ts.users--
+		ts.lastUsed = time.Now()
+		s.mu.Unlock()
+	}
+
+	if replayed, ok := msg.sequenceIDs[topic]; ok && replayed <= ts.persisted {
+		return replayed, true, release
+	}
+	id = max(ts.next, now.UnixMicro())
+	ts.next = id + 1
+	pmsg.SequenceID = &id
+	return id, false, release
+}
+
+// sweep forgets topics idle for longer than sequenceIdleTimeout. s.mu must
+// be held.
+func (s *sequencer) sweep(now time.Time) {
+	s.lastSweep = now
+	for topic, ts := range s.topics {
+		if ts.users == 0 && now.Sub(ts.lastUsed) > sequenceIdleTimeout {
+			delete(s.topics, topic)
+		}
+	}
+}
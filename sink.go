@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var errSinkClosed = errors.New("sink closed")
+
+// Sink delivers mapped messages downstream. Produce owns the message from
+// then on: it acks it once delivered and takes care of retries and
+// failures.
+type Sink interface {
+	Produce(ctx context.Context, msg *Message, dest Destination)
+	Close()
+}
+
+// SinkConfig selects where a bridge's messages go: pulsar (the default),
+// kafka or webhook. Mapped topics are used as Kafka topic names as they
+// are, and passed along with each message to webhooks. Bridges with
+// another sink than Pulsar don't inherit mapping.default, which names
+// Pulsar topics.
+type SinkConfig struct {
+	Type    string        `yaml:"type"`
+	Kafka   KafkaConfig   `yaml:"kafka"`
+	Webhook WebhookConfig `yaml:"webhook"`
+}
+
+const (
+	sinkPulsar  = "pulsar"
+	sinkKafka   = "kafka"
+	sinkWebhook = "webhook"
+)
+
+func (c SinkConfig) validate() error {
+	switch c.Type {
+	case "", sinkPulsar:
+		return nil
+	case sinkKafka:
+		return c.Kafka.validate()
+	case sinkWebhook:
+		return c.Webhook.validate()
+	default:
+		return fmt.Errorf("unknown sink type %q", c.Type)
+	}
+}
+
+// pulsar reports whether the sink produces to Pulsar.
+func (c SinkConfig) pulsar() bool {
+	return c.Type == "" || c.Type == sinkPulsar
+}
+
+// validateTopic checks a topic template of a mapping feeding the sink.
+func (c SinkConfig) validateTopic(tmpl string) error {
+	if c.Type == sinkKafka {
+		return validateKafkaTopic(tmpl)
+	}
+	return nil
+}
+
+func newSink(c SinkConfig) (Sink, error) {
+	switch c.Type {
+	case sinkKafka:
+		return newKafkaSink(c.Kafka)
+	case sinkWebhook:
+		return newWebhookSink(c.Webhook), nil
+	default:
+		return pulsarSink{}, nil
+	}
+}
+
+// pulsarSink produces to Pulsar through the shared client and producer
+// cache, which outlive it, so closing it does nothing.
+type pulsarSink struct{}
+
+func (pulsarSink) Produce(ctx context.Context, msg *Message, dest Destination) {
+	produce(ctx, msg, dest)
+}
+
+func (pulsarSink) Close() {}
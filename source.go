@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// Source feeds messages into the pipeline from somewhere other than the
+// primary MQTT broker's subscriptions. Start begins delivering messages to
+// handler and Stop ends it, so sources follow leader election like the
+// subscriptions do. Close releases the source's connection.
+type Source interface {
+	Start(handler func(*Message)) error
+	Stop()
+	IsConnected() bool
+	Close()
+}
+
+// SourceConfig selects where a bridge's messages come from: its MQTT
+// subscriptions on the primary broker (mqtt, the default) or an AMQP 0.9.1
+// queue (amqp).
+type SourceConfig struct {
+	Type string     `yaml:"type"`
+	AMQP AMQPConfig `yaml:"amqp"`
+}
+
+const (
+	sourceMQTT = "mqtt"
+	sourceAMQP = "amqp"
+)
+
+func (c SourceConfig) validate() error {
+	switch c.Type {
+	case "", sourceMQTT:
+		return nil
+	case sourceAMQP:
+		return c.AMQP.validate()
+	default:
+		return fmt.Errorf("unknown source type %q", c.Type)
+	}
+}
+
+// bridgeSource is a source and the bridge its messages belong to, "" for
+// the default one.
+type bridgeSource struct {
+	Source
+	bridge string
+	name   string
+}
+
+// sources are the running sources, in config order: the additional MQTT
+// brokers followed by the bridges' AMQP queues. The health checks read
+// them from the metrics server while they are connected and closed.
+var sources atomic.Pointer[[]bridgeSource]
+
+// runningSources returns the running sources.
+func runningSources() []bridgeSource {
+	if s := sources.Load(); s != nil {
+		return *s
+	}
+	return nil
+}
+
+// connectSources connects every configured source. On failure the ones
+// connected so far are closed again.
+func connectSources(c *Config) error {
+	var connected []bridgeSource
+	closeConnected := func() {
+		for _, s := range connected {
+			s.Close()
+		}
+	}
+	for _, bc := range c.MQTT.brokerConfigs() {
+		conn, err := connectMQTT(bc)
+		if err != nil {
+			closeConnected()
+			return fmt.Errorf("connecting to %s: %w", bc.BrokerURL, err)
+		}
+		connected = append(connected, bridgeSource{Source: &mqttSource{cfg: bc, conn: conn}, name: bc.BrokerURL})
+		slog.Info("Connected to MQTT", "broker", bc.BrokerURL)
+	}
+	for _, b := range c.Bridges {
+		if b.Source.Type != sourceAMQP {
+			continue
+		}
+		src, err := newAMQPSource(b.Source.AMQP)
+		if err != nil {
+			closeConnected()
+			return fmt.Errorf("bridge %s: connecting to AMQP: %w", b.Name, err)
+		}
+		connected = append(connected, bridgeSource{Source: src, bridge: b.Name, name: b.Source.AMQP.Queue})
+		slog.Info("Connected to AMQP", "bridge", b.Name, "queue", b.Source.AMQP.Queue)
+	}
+	sources.Store(&connected)
+	return nil
+}
+
+func startSources() error {
+	var errs []error
+	for _, s := range runningSources() {
+		handler := receiveMessage
+		if s.bridge != "" {
+			handler = bridgeHandler(s.bridge)
+		}
+		if err := s.Start(handler); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func stopSources() {
+	for _, s := range runningSources() {
+		s.Stop()
+	}
+}
+
+func closeSources() {
+	prev := sources.Swap(nil)
+	if prev == nil {
+		return
+	}
+	for _, s := range *prev {
+		s.Close()
+	}
+}
+
+// mqttSource bridges the subscriptions of an additional MQTT broker.
+type mqttSource struct {
+	cfg  MQTTConfig
+	conn mqttConn
+}
+
+func (s *mqttSource) Start(handler func(*Message)) error {
+	for _, sub := range s.cfg.Subscriptions {
+		qos := sub.qos(s.cfg.QoS)
+		if err := s.conn.Subscribe(sub.Filter, qos, handler); err != nil {
+			return fmt.Errorf("subscribing to %s: %w", sub.Filter, err)
+		}
+		slog.Info("Subscribed to MQTT topic filter", "broker", s.cfg.BrokerURL, "filter", sub.Filter, "qos", qos)
+	}
+	return nil
+}
+
+func (s *mqttSource) Stop() {
+	for _, sub := range s.cfg.Subscriptions {
+		if err := s.conn.Unsubscribe(sub.Filter); err != nil {
+			slog.Warn("Failed to unsubscribe", "broker", s.cfg.BrokerURL, "filter", sub.Filter, "error", err)
+		}
+	}
+}
+
+func (s *mqttSource) IsConnected() bool {
+	return s.conn.IsConnected()
+}
+
+func (s *mqttSource) Close() {
+	s.conn.Disconnect()
+}
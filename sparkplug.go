@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B topics look like spBv1.0/<group>/<type>/<edge node>[/<device>].
+const sparkplugNamespace = "spBv1.0"
+
+// sparkplugDataTypes names the Sparkplug B metric data types.
+var sparkplugDataTypes = map[uint64]string{
+	1: "Int8", 2: "Int16", 3: "Int32", 4: "Int64",
+	5: "UInt8", 6: "UInt16", 7: "UInt32", 8: "UInt64",
+	9: "Float", 10: "Double", 11: "Boolean", 12: "String",
+	13: "DateTime", 14: "Text", 15: "UUID", 16: "DataSet",
+	17: "Bytes", 18: "File", 19: "Template",
+}
+
+type sparkplugMetric struct {
+	Name         string `json:"name,omitempty"`
+	Alias        uint64 `json:"alias,omitempty"`
+	Timestamp    uint64 `json:"timestamp,omitempty"`
+	DataType     string `json:"datatype,omitempty"`
+	IsHistorical bool   `json:"is_historical,omitempty"`
+	IsTransient  bool   `json:"is_transient,omitempty"`
+	IsNull       bool   `json:"is_null,omitempty"`
+	Value        any    `json:"value"`
+
+	hasAlias bool
+	dataType uint64
+	intValue uint64
+}
+
+type sparkplugPayload struct {
+	GroupID     string            `json:"group_id"`
+	MessageType string            `json:"message_type"`
+	EdgeNodeID  string            `json:"edge_node_id"`
+	DeviceID    string            `json:"device_id,omitempty"`
+	Timestamp   uint64            `json:"timestamp,omitempty"`
+	Seq         *uint64           `json:"seq,omitempty"`
+	UUID        string            `json:"uuid,omitempty"`
+	Metrics     []sparkplugMetric `json:"metrics"`
+}
+
+// sparkplugDecoder expands Sparkplug B protobuf payloads into JSON. Edge
+// nodes may send metrics by alias only after announcing the names in their
+// NBIRTH and DBIRTH messages, so the decoder remembers the aliases of every
+// edge node until it dies or is born again. Messages outside the Sparkplug
+// namespace and STATE messages, which are already JSON, pass unchanged.
+type sparkplugDecoder struct {
+	mu      sync.Mutex
+	aliases map[string]map[uint64]string // group/edge node -> alias -> name
+}
+
+func newSparkplugTransformer(TransformStep) (Transformer, error) {
+	return &sparkplugDecoder{aliases: make(map[string]map[uint64]string)}, nil
+}
+
+func (d *sparkplugDecoder) Close() {}
+
+func (d *sparkplugDecoder) Transform(msg *Message) error {
+	parts := strings.Split(msg.Topic, "/")
+	if len(parts) < 4 || parts[0] != sparkplugNamespace || parts[1] == "STATE" {
+		return nil
+	}
+
+	out := sparkplugPayload{GroupID: parts[1], MessageType: parts[2], EdgeNodeID: parts[3]}
+	if len(parts) > 4 {
+		out.DeviceID = parts[4]
+	}
+	if err := decodeSparkplugPayload(msg.Payload, &out); err != nil {
+		return fmt.Errorf("decoding Sparkplug B payload: %w", err)
+	}
+	d.resolveAliases(parts[1]+"/"+parts[3], &out)
+
+	payload, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	msg.Payload = payload
+	return nil
+}
+
+// resolveAliases records the aliases announced by birth messages, forgets
+// them on NDEATH and fills in the names of metrics sent by alias.
+func (d *sparkplugDecoder) resolveAliases(node string, p *sparkplugPayload) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch p.MessageType {
+	case "NBIRTH":
+		d.aliases[node] = make(map[uint64]string)
+	case "NDEATH":
+		delete(d.aliases, node)
+		return
+	}
+
+	table := d.aliases[node]
+	for i := range p.Metrics {
+		m := &p.Metrics[i]
+		if !m.hasAlias {
+			continue
+		}
+		switch {
+		case m.Name != "" && (p.MessageType == "NBIRTH" || p.MessageType == "DBIRTH"):
+			if table == nil {
+				table = make(map[uint64]string)
+				d.aliases[node] = table
+			}
+			table[m.Alias] = m.Name
+		case m.Name == "":
+			m.Name = table[m.Alias]
+		}
+	}
+}
+
+// decodeSparkplugPayload decodes the Sparkplug B Payload message. Data set,
+// template and extension values are not expanded and decode as null.
+func decodeSparkplugPayload(b []byte, p *sparkplugPayload) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			p.Timestamp, n = protowire.ConsumeVarint(b)
+		case num == 2 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				var m sparkplugMetric
+				if err := decodeSparkplugMetric(v, &m); err != nil {
+					return err
+				}
+				p.Metrics = append(p.Metrics, m)
+			}
+		case num == 3 && typ == protowire.VarintType:
+			var seq uint64
+			seq, n = protowire.ConsumeVarint(b)
+			p.Seq = &seq
+		case num == 4 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			p.UUID = string(v)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func decodeSparkplugMetric(b []byte, m *sparkplugMetric) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var (
+			v   uint64
+			raw []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var f uint32
+			f, n = protowire.ConsumeFixed32(b)
+			v = uint64(f)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			raw, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch num {
+		case 1:
+			m.Name = string(raw)
+		case 2:
+			m.Alias, m.hasAlias = v, true
+		case 3:
+			m.Timestamp = v
+		case 4:
+			m.dataType = v
+			m.DataType = sparkplugDataTypes[v]
+		case 5:
+			m.IsHistorical = v != 0
+		case 6:
+			m.IsTransient = v != 0
+		case 7:
+			m.IsNull = v != 0
+		case 10, 11:
+			m.intValue = v
+			m.Value = v
+		case 12:
+			m.Value = math.Float32frombits(uint32(v))
+		case 13:
+			m.Value = math.Float64frombits(v)
+		case 14:
+			m.Value = v != 0
+		case 15:
+			m.Value = string(raw)
+		case 16:
+			m.Value = raw
+		}
+	}
+
+	// Integers travel as unsigned varints; reinterpret them by data type
+	switch m.dataType {
+	case 1, 2, 3:
+		if m.Value != nil {
+			m.Value = int32(uint32(m.intValue))
+		}
+	case 4:
+		if m.Value != nil {
+			m.Value = int64(m.intValue)
+		}
+	}
+	if m.IsNull {
+		m.Value = nil
+	}
+	return nil
+}
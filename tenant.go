@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+var errTenantViolation = errors.New("destination is outside the tenant's namespace")
+
+// TenantRoute assigns the devices publishing under Match (an MQTT filter,
+// typically a prefix like customers/acme/#) to a Pulsar tenant and
+// namespace, which the {tenant} and {namespace} placeholders then expand
+// to. Once any tenant is configured, messages are isolated: those from
+// topics belonging to no tenant are not forwarded, and a message is never
+// produced outside its tenant's namespace, whatever the mapping, filters
+// or scripts say.
+type TenantRoute struct {
+	Match     string `yaml:"match"`
+	Tenant    string `yaml:"tenant"`
+	Namespace string `yaml:"namespace"`
+}
+
+// tenantFor returns the first tenant whose filter matches mqttTopic.
+func tenantFor(tenants []TenantRoute, mqttTopic string) (TenantRoute, bool) {
+	for _, t := range tenants {
+		if topicMatches(t.Match, mqttTopic) {
+			return t, true
+		}
+	}
+	return TenantRoute{}, false
+}
+
+func (t TenantRoute) expand(topic string) string {
+	return strings.NewReplacer("{tenant}", t.Tenant, "{namespace}", t.Namespace).Replace(topic)
+}
+
+// owns reports whether pulsarTopic lies in the tenant's namespace.
+func (t TenantRoute) owns(pulsarTopic string) bool {
+	if i := strings.Index(pulsarTopic, "://"); i >= 0 {
+		pulsarTopic = pulsarTopic[i+3:]
+	}
+	return strings.HasPrefix(pulsarTopic, t.Tenant+"/"+t.Namespace+"/")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TimestampConfig locates a timestamp inside a JSON payload. Format is one
+// of unix_s, unix_ms, unix_ns or rfc3339; Field is a dotted path.
+type TimestampConfig struct {
+	Field  string `yaml:"field"`
+	Format string `yaml:"format"`
+}
+
+func (c TimestampConfig) validate() error {
+	switch c.Format {
+	case "", "unix_s", "unix_ms", "unix_ns", "rfc3339":
+		return nil
+	default:
+		return fmt.Errorf("unknown timestamp format %q", c.Format)
+	}
+}
+
+// extract reads the timestamp from payload. The second return value is
+// false when the field is missing or cannot be parsed.
+func (c TimestampConfig) extract(payload []byte) (time.Time, bool) {
+	if c.Field == "" {
+		return time.Time{}, false
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		return time.Time{}, false
+	}
+	parent, key, ok := lookupPath(obj, c.Field)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	switch v := parent[key].(type) {
+	case float64:
+		switch c.Format {
+		case "", "unix_ms":
+			return time.UnixMilli(int64(v)), true
+		case "unix_s":
+			return time.Unix(0, int64(v*float64(time.Second))), true
+		case "unix_ns":
+			return time.Unix(0, int64(v)), true
+		}
+	case string:
+		if c.Format == "rfc3339" || c.Format == "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			return t, err == nil
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TopicACLConfig decides which MQTT topics are bridged at all. Messages on a
+// topic matching a Deny filter, e.g. $SYS/# or debug/#, are counted and
+// dropped on arrival, before they take up a worker or a producer.
+//
+// In Strict mode, for bridging a shared broker, only topics matching an
+// Allow filter are bridged and everything else is dropped. Deny still wins
+// over Allow.
+type TopicACLConfig struct {
+	Deny   []string `yaml:"deny"`
+	Allow  []string `yaml:"allow"`
+	Strict bool     `yaml:"strict"`
+}
+
+type topicACL struct {
+	deny  []string
+	allow []string
+}
+
+func newTopicACL(c TopicACLConfig) (*topicACL, error) {
+	for i, filter := range c.Deny {
+		if filter == "" {
+			return nil, fmt.Errorf("deny filter %d is empty", i)
+		}
+	}
+	for i, filter := range c.Allow {
+		if filter == "" {
+			return nil, fmt.Errorf("allow filter %d is empty", i)
+		}
+	}
+	a := &topicACL{deny: c.Deny}
+	if c.Strict {
+		if len(c.Allow) == 0 {
+			return nil, errors.New("strict mode requires allow filters")
+		}
+		a.allow = c.Allow
+	}
+	return a, nil
+}
+
+// Check returns the drop reason for messages on topic, or "" if they may be
+// bridged.
+func (a *topicACL) Check(topic string) string {
+	for _, filter := range a.deny {
+		if topicMatches(filter, topic) {
+			return dropBlocked
+		}
+	}
+	if a.allow == nil {
+		return ""
+	}
+	for _, filter := range a.allow {
+		if topicMatches(filter, topic) {
+			return ""
+		}
+	}
+	return dropNotAllowed
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// otherTopic is the label value of topics beyond the cardinality cap.
+const otherTopic = "other"
+
+var (
+	mqttBytesReceived = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mqtt_bytes_received",
+			Help: "Number of payload bytes received from the MQTT broker",
+		},
+		[]string{"topic"},
+	)
+	bytesProduced = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bytes_produced",
+			Help: "Number of payload bytes produced to the destination topic",
+		},
+		[]string{"topic"},
+	)
+
+	mqttTopicLabels = &topicLabeler{seen: make(map[string]struct{})}
+	destTopicLabels = &topicLabeler{seen: make(map[string]struct{})}
+)
+
+// topicLabeler caps the number of distinct topic label values at
+// metrics.max_topic_labels. The first topics seen keep their own label;
+// the long tail is aggregated into "other".
+type topicLabeler struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func (l *topicLabeler) label(topic string) string {
+	limit := cfg.Metrics.MaxTopicLabels
+	if limit <= 0 {
+		return topic
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[topic]; ok {
+		return topic
+	}
+	if len(l.seen) >= limit {
+		return otherTopic
+	}
+	l.seen[topic] = struct{}{}
+	return topic
+}
+
+// countReceived counts a message received from MQTT.
+func countReceived(msg *Message) {
+	labels := prometheus.Labels{"topic": mqttTopicLabels.label(msg.Topic)}
+	mqttMessagesReceived.With(labels).Inc()
+	mqttBytesReceived.With(labels).Add(float64(len(msg.Payload)))
+}
+
+// countBytesProduced counts the payload bytes produced to topic.
+func countBytesProduced(topic string, size int) {
+	bytesProduced.With(prometheus.Labels{"topic": destTopicLabels.label(topic)}).Add(float64(size))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// cborDecMode decodes CBOR maps with string keys, matching what JSON can
+// represent.
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+}.DecMode()
+
+// newCBORTransformer transcodes CBOR payloads to JSON. Byte strings become
+// base64 strings.
+func newCBORTransformer(TransformStep) (Transformer, error) {
+	return TransformerFunc(func(msg *Message) error {
+		var v any
+		if err := cborDecMode.Unmarshal(msg.Payload, &v); err != nil {
+			return fmt.Errorf("payload is not valid CBOR: %w", err)
+		}
+		return setJSONPayload(msg, v)
+	}), nil
+}
+
+// newMsgpackTransformer transcodes MessagePack payloads to JSON.
+func newMsgpackTransformer(TransformStep) (Transformer, error) {
+	return TransformerFunc(func(msg *Message) error {
+		var v any
+		if err := msgpack.Unmarshal(msg.Payload, &v); err != nil {
+			return fmt.Errorf("payload is not valid MessagePack: %w", err)
+		}
+		return setJSONPayload(msg, v)
+	}), nil
+}
+
+// newBase64Transformer decodes base64 payloads, standard or URL-safe and
+// with or without padding. With Field set the payload is a JSON object and
+// the decoded string field replaces it.
+func newBase64Transformer(step TransformStep) (Transformer, error) {
+	return decodeTransformer(step, func(s []byte) ([]byte, error) {
+		s = bytes.TrimRight(bytes.TrimSpace(s), "=")
+		enc := base64.RawStdEncoding
+		if bytes.ContainsAny(s, "-_") {
+			enc = base64.RawURLEncoding
+		}
+		out := make([]byte, enc.DecodedLen(len(s)))
+		n, err := enc.Decode(out, s)
+		if err != nil {
+			return nil, fmt.Errorf("payload is not valid base64: %w", err)
+		}
+		return out[:n], nil
+	}), nil
+}
+
+// newHexTransformer decodes hex payloads, or the hex string Field of a
+// JSON payload.
+func newHexTransformer(step TransformStep) (Transformer, error) {
+	return decodeTransformer(step, func(s []byte) ([]byte, error) {
+		s = bytes.TrimSpace(s)
+		out := make([]byte, hex.DecodedLen(len(s)))
+		n, err := hex.Decode(out, s)
+		if err != nil {
+			return nil, fmt.Errorf("payload is not valid hex: %w", err)
+		}
+		return out[:n], nil
+	}), nil
+}
+
+func decodeTransformer(step TransformStep, decode func([]byte) ([]byte, error)) Transformer {
+	return TransformerFunc(func(msg *Message) error {
+		encoded := msg.Payload
+		if step.Field != "" {
+			var obj map[string]any
+			if err := json.Unmarshal(msg.Payload, &obj); err != nil {
+				return fmt.Errorf("payload is not a JSON object: %w", err)
+			}
+			parent, key, ok := lookupPath(obj, step.Field)
+			if !ok {
+				return fmt.Errorf("field %s is missing", step.Field)
+			}
+			s, ok := parent[key].(string)
+			if !ok {
+				return fmt.Errorf("field %s is not a string", step.Field)
+			}
+			encoded = []byte(s)
+		}
+		payload, err := decode(encoded)
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+		return nil
+	})
+}
+
+func setJSONPayload(msg *Message, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("payload cannot be represented as JSON: %w", err)
+	}
+	msg.Payload = payload
+	return nil
+}
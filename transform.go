@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errDropMessage can be returned by a Transformer to discard a message
+// without treating it as a failure.
+var errDropMessage = errors.New("message dropped by transformer")
+
+// Transformer modifies a message between MQTT receipt and the Pulsar send.
+type Transformer interface {
+	Transform(msg *Message) error
+	// Close releases the transformer's resources once its pipeline has
+	// been replaced.
+	Close()
+}
+
+// TransformerFunc adapts a function to the Transformer interface.
+type TransformerFunc func(msg *Message) error
+
+func (f TransformerFunc) Transform(msg *Message) error {
+	return f(msg)
+}
+
+func (f TransformerFunc) Close() {}
+
+// TransformRule applies Steps, in order, to messages whose MQTT topic
+// matches the Match filter.
+type TransformRule struct {
+	Match string          `yaml:"match"`
+	Steps []TransformStep `yaml:"steps"`
+}
+
+// TransformStep configures a single transformer. Which fields are used
+// depends on Type.
+type TransformStep struct {
+	Type string `yaml:"type"`
+
+	// drop_fields
+	Fields []string `yaml:"fields"`
+	// rename_keys: old key -> new key
+	Mapping map[string]string `yaml:"mapping"`
+	// convert_units: Field = Field*Scale + Offset; base64_decode and
+	// hex_decode: the JSON string field to decode instead of the payload
+	Field  string  `yaml:"field"`
+	Scale  float64 `yaml:"scale"`
+	Offset float64 `yaml:"offset"`
+	// wasm: path to the WebAssembly module
+	Module string `yaml:"module"`
+	// lua: the script source
+	Script string `yaml:"script"`
+	// envelope: the gateway ID recorded in the envelope
+	GatewayID string `yaml:"gateway_id"`
+	// protobuf_to_json: the FileDescriptorSet file and the fully qualified
+	// name of the payload's message type
+	Descriptor  string `yaml:"descriptor"`
+	MessageType string `yaml:"message_type"`
+	// gunzip: the maximum decompressed size; gzip: the compression level
+	MaxBytes int `yaml:"max_bytes"`
+	Level    int `yaml:"level"`
+}
+
+// transformerFactories holds the constructors for every built-in
+// transformer type, keyed by the type name used in the config.
+var transformerFactories = map[string]func(TransformStep) (Transformer, error){
+	"drop_fields":      newDropFieldsTransformer,
+	"rename_keys":      newRenameKeysTransformer,
+	"convert_units":    newConvertUnitsTransformer,
+	"sparkplug_b":      newSparkplugTransformer,
+	"cbor_to_json":     newCBORTransformer,
+	"msgpack_to_json":  newMsgpackTransformer,
+	"wasm":             newWASMTransformer,
+	"lua":              newLuaTransformer,
+	"envelope":         newEnvelopeTransformer,
+	"protobuf_to_json": newProtobufTransformer,
+	"gunzip":           newGunzipTransformer,
+	"gzip":             newGzipTransformer,
+	"base64_decode":    newBase64Transformer,
+	"hex_decode":       newHexTransformer,
+}
+
+type transformChain struct {
+	match        string
+	transformers []Transformer
+}
+
+// transformPipeline selects the chain of the first rule matching a topic.
+type transformPipeline struct {
+	chains []transformChain
+}
+
+func newTransformPipeline(rules []TransformRule) (*transformPipeline, error) {
+	p := &transformPipeline{}
+	for i, rule := range rules {
+		if rule.Match == "" {
+			return nil, fmt.Errorf("transform rule %d: match is required", i)
+		}
+		chain := transformChain{match: rule.Match}
+		for j, step := range rule.Steps {
+			factory, ok := transformerFactories[step.Type]
+			if !ok {
+				return nil, fmt.Errorf("transform rule %s step %d: unknown type %q", rule.Match, j, step.Type)
+			}
+			t, err := factory(step)
+			if err != nil {
+				chain.close()
+				p.Close()
+				return nil, fmt.Errorf("transform rule %s step %d: %w", rule.Match, j, err)
+			}
+			chain.transformers = append(chain.transformers, t)
+		}
+		p.chains = append(p.chains, chain)
+	}
+	return p, nil
+}
+
+func (c transformChain) close() {
+	for _, t := range c.transformers {
+		t.Close()
+	}
+}
+
+// Close closes every transformer of the pipeline. Callers must no longer
+// apply it.
+func (p *transformPipeline) Close() {
+	if p == nil {
+		return
+	}
+	for _, chain := range p.chains {
+		chain.close()
+	}
+}
+
+// Apply runs the matching chain, if any, over msg.
+func (p *transformPipeline) Apply(msg *Message) error {
+	for _, chain := range p.chains {
+		if !topicMatches(chain.match, msg.Topic) {
+			continue
+		}
+		for _, t := range chain.transformers {
+			if err := t.Transform(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// jsonTransformer adapts a function operating on a decoded JSON object.
+func jsonTransformer(fn func(obj map[string]any) error) Transformer {
+	return TransformerFunc(func(msg *Message) error {
+		var obj map[string]any
+		if err := json.Unmarshal(msg.Payload, &obj); err != nil {
+			return fmt.Errorf("payload is not a JSON object: %w", err)
+		}
+		if err := fn(obj); err != nil {
+			return err
+		}
+		payload, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+		return nil
+	})
+}
+
+// lookupPath resolves a dotted path to the object holding its last element.
+func lookupPath(obj map[string]any, path string) (map[string]any, string, bool) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := obj[part].(map[string]any)
+		if !ok {
+			return nil, "", false
+		}
+		obj = next
+	}
+	return obj, parts[len(parts)-1], true
+}
+
+func newDropFieldsTransformer(step TransformStep) (Transformer, error) {
+	if len(step.Fields) == 0 {
+		return nil, errors.New("drop_fields requires fields")
+	}
+	return jsonTransformer(func(obj map[string]any) error {
+		for _, field := range step.Fields {
+			if parent, key, ok := lookupPath(obj, field); ok {
+				delete(parent, key)
+			}
+		}
+		return nil
+	}), nil
+}
+
+func newRenameKeysTransformer(step TransformStep) (Transformer, error) {
+	if len(step.Mapping) == 0 {
+		return nil, errors.New("rename_keys requires mapping")
+	}
+	return jsonTransformer(func(obj map[string]any) error {
+		for from, to := range step.Mapping {
+			parent, key, ok := lookupPath(obj, from)
+			if !ok {
+				continue
+			}
+			if v, exists := parent[key]; exists {
+				delete(parent, key)
+				parent[to] = v
+			}
+		}
+		return nil
+	}), nil
+}
+
+func newConvertUnitsTransformer(step TransformStep) (Transformer, error) {
+	if step.Field == "" {
+		return nil, errors.New("convert_units requires field")
+	}
+	scale := step.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return jsonTransformer(func(obj map[string]any) error {
+		parent, key, ok := lookupPath(obj, step.Field)
+		if !ok {
+			return nil
+		}
+		switch v := parent[key].(type) {
+		case float64:
+			parent[key] = v*scale + step.Offset
+		case nil:
+		default:
+			return fmt.Errorf("field %s is not a number", step.Field)
+		}
+		return nil
+	}), nil
+}
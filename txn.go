@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TransactionConfig enables exactly-once delivery of QoS 1 and 2 messages.
+// Messages are produced in batches inside a Pulsar transaction and only
+// acked to the MQTT broker once the transaction has committed. A batch is
+// committed when it holds BatchSize messages or BatchTimeout has passed
+// since its first message. Timeout is the transaction timeout on the broker.
+type TransactionConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	BatchSize    int           `yaml:"batch_size"`
+	BatchTimeout time.Duration `yaml:"batch_timeout"`
+	Timeout      time.Duration `yaml:"timeout"`
+}
+
+func (c TransactionConfig) validate(manualAck bool) error {
+	if !c.Enabled {
+		return nil
+	}
+	if !manualAck {
+		return errors.New("transactions require mqtt.manual_ack")
+	}
+	if c.BatchSize < 1 {
+		return fmt.Errorf("batch_size must be at least 1, got %d", c.BatchSize)
+	}
+	if c.BatchTimeout <= 0 {
+		return fmt.Errorf("batch_timeout must be positive, got %s", c.BatchTimeout)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive, got %s", c.Timeout)
+	}
+	return nil
+}
+
+type txnEntry struct {
+	ctx         context.Context
+	span        trace.Span
+	producer    pulsar.Producer
+	pmsg        *pulsar.ProducerMessage
+	msg         *Message
+	pulsarTopic string
+}
+
+// txnBatcher groups messages into Pulsar transactions. A single goroutine
+// owns the current batch, so batches are committed one after the other.
+type txnBatcher struct {
+	cfg     TransactionConfig
+	entries chan txnEntry
+	done    chan struct{}
+}
+
+func newTxnBatcher(c TransactionConfig) *txnBatcher {
+	b := &txnBatcher{
+		cfg:     c,
+		entries: make(chan txnEntry),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Add queues a message for the current transaction. The caller must have
+// counted it as in flight.
+func (b *txnBatcher) Add(e txnEntry) {
+	b.entries <- e
+}
+
+// Close commits the pending batch and stops the batcher. No messages may be
+// added afterwards.
+func (b *txnBatcher) Close() {
+	close(b.entries)
+	<-b.done
+}
+
+func (b *txnBatcher) run() {
+	defer close(b.done)
+
+	var batch []txnEntry
+	timer := time.NewTimer(b.cfg.BatchTimeout)
+	timer.Stop()
+
+	for {
+		select {
+		case e, ok := <-b.entries:
+			if !ok {
+				b.commit(batch)
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(b.cfg.BatchTimeout)
+			}
+			batch = append(batch, e)
+			if len(batch) < b.cfg.BatchSize {
+				continue
+			}
+			timer.Stop()
+		case <-timer.C:
+		}
+		b.commit(batch)
+		batch = nil
+	}
+}
+
+// commit produces a batch inside one transaction. The MQTT messages are
+// acked only after the commit succeeds; otherwise the transaction is aborted
+// and every message takes the send failure path.
+func (b *txnBatcher) commit(batch []txnEntry) {
+	if len(batch) == 0 {
+		return
+	}
+
+	err := b.produce(batch)
+	for _, e := range batch {
+		if err != nil {
+			sendFailures.With(prometheus.Labels{"topic": e.pulsarTopic}).Inc()
+			handleSendFailure(e.ctx, e.msg, e.pulsarTopic, err)
+		} else {
+			e.msg.Ack()
+			messagesProduced.With(prometheus.Labels{"topic": e.pulsarTopic}).Inc()
+			countBytesProduced(e.pulsarTopic, len(e.pmsg.Payload))
+			countBridge(e.msg, "produced")
+			throughput.record(e.pulsarTopic)
+			observeLatency(e.msg, e.pulsarTopic)
+		}
+		e.span.End()
+		messagesInFlight.Dec()
+		inFlight.Done()
+	}
+}
+
+func (b *txnBatcher) produce(batch []txnEntry) error {
+	ctx := context.Background()
+	txn, err := pulsarClient.NewTransaction(b.cfg.Timeout)
+	if err != nil {
+		slog.Error("Failed to open Pulsar transaction", "messages", len(batch), "error", err)
+		breaker.Failure()
+		return err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, e := range batch {
+		e.pmsg.Transaction = txn
+		wg.Add(1)
+		e.producer.SendAsync(e.ctx, e.pmsg, func(_ pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+			defer wg.Done()
+			if err != nil {
+				pulsarSendErrors.With(prometheus.Labels{"topic": e.pulsarTopic}).Inc()
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = txn.Commit(ctx)
+		if firstErr == nil {
+			setPulsarHealthy(true)
+			breaker.Success()
+			return nil
+		}
+	}
+
+	setPulsarHealthy(false)
+	breaker.Failure()
+	slog.Error("Failed to produce transaction, aborting", "messages", len(batch), "error", firstErr)
+	if err := txn.Abort(ctx); err != nil {
+		slog.Error("Failed to abort Pulsar transaction", "error", err)
+	}
+	// The messages are handed to the failure path without the aborted
+	// transaction attached.
+	for _, e := range batch {
+		e.pmsg.Transaction = nil
+	}
+	return firstErr
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// ValidationConfig attaches JSON Schemas to MQTT topic patterns. Messages
+// failing validation never reach their Pulsar topic; they are published to
+// QuarantineTopic when set and dropped otherwise.
+type ValidationConfig struct {
+	QuarantineTopic string           `yaml:"quarantine_topic"`
+	Rules           []ValidationRule `yaml:"rules"`
+}
+
+type ValidationRule struct {
+	Match  string `yaml:"match"`
+	Schema string `yaml:"schema"`
+}
+
+type compiledValidationRule struct {
+	match  string
+	schema *jsonschema.Schema
+}
+
+type payloadValidator struct {
+	rules []compiledValidationRule
+}
+
+func newPayloadValidator(c ValidationConfig) (*payloadValidator, error) {
+	compiler := jsonschema.NewCompiler()
+	v := &payloadValidator{}
+	for i, r := range c.Rules {
+		if r.Match == "" || r.Schema == "" {
+			return nil, fmt.Errorf("validation rule %d: match and schema are required", i)
+		}
+		schema, err := compiler.Compile(r.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("validation rule %s: %w", r.Match, err)
+		}
+		v.rules = append(v.rules, compiledValidationRule{match: r.Match, schema: schema})
+	}
+	return v, nil
+}
+
+// Validate checks the payload against the schema of the first rule
+// matching the topic. It returns the matched pattern alongside any error.
+func (v *payloadValidator) Validate(msg *Message) (string, error) {
+	for _, r := range v.rules {
+		if !topicMatches(r.match, msg.Topic) {
+			continue
+		}
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(msg.Payload))
+		if err != nil {
+			return r.match, fmt.Errorf("payload is not valid JSON: %w", err)
+		}
+		return r.match, r.schema.Validate(doc)
+	}
+	return "", nil
+}
+
+// quarantine publishes an invalid message to the quarantine topic, or just
+// acks it when no quarantine topic is configured.
+func quarantine(ctx context.Context, msg *Message, cause error) {
+	if cfg.Validation.QuarantineTopic == "" {
+		dropMessage(msg, dropInvalid)
+		return
+	}
+
+	if dryRun {
+		logDryRun(msg, cfg.Validation.QuarantineTopic, "", len(msg.Payload))
+		return
+	}
+
+	producer, ok := getOrCreateProducer(cfg.Validation.QuarantineTopic, cfg.Pulsar.Producer, nil)
+	if !ok {
+		slog.Error("Failed to get quarantine producer, dropping message",
+			"mqtt_topic", msg.Topic, "quarantine_topic", cfg.Validation.QuarantineTopic)
+		return
+	}
+
+	props := messageProperties(msg)
+	props["quarantine_mqtt_topic"] = msg.Topic
+	props["quarantine_error"] = cause.Error()
+	props["quarantine_at"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	producer.SendAsync(ctx, &pulsar.ProducerMessage{
+		Payload:    msg.Payload,
+		Properties: props,
+	}, func(_ pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+		if err != nil {
+			slog.Error("Failed to quarantine message",
+				"mqtt_topic", msg.Topic, "quarantine_topic", cfg.Validation.QuarantineTopic, "error", err)
+			return
+		}
+		messagesQuarantined.With(prometheus.Labels{"topic": cfg.Validation.QuarantineTopic}).Inc()
+		msg.Ack()
+	})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultConfig fetches credentials from HashiCorp Vault at startup. Paths
+// are full API paths below /v1, so both KV v2 secrets (secret/data/<name>)
+// and dynamic secrets engines (e.g. rabbitmq/creds/<role>) work.
+//
+// The connector logs in with Token when set, and otherwise with the
+// Kubernetes auth method using the pod's service account token.
+type VaultConfig struct {
+	Address    string                `yaml:"address"`
+	Namespace  string                `yaml:"namespace"`
+	Token      string                `yaml:"token"`
+	TLS        TLSConfig             `yaml:"tls"`
+	Kubernetes VaultKubernetesConfig `yaml:"kubernetes"`
+
+	MQTT   VaultSecretConfig `yaml:"mqtt"`
+	Pulsar VaultSecretConfig `yaml:"pulsar"`
+}
+
+// VaultKubernetesConfig configures the Kubernetes auth method.
+type VaultKubernetesConfig struct {
+	Role      string `yaml:"role"`
+	MountPath string `yaml:"mount_path"`
+	TokenFile string `yaml:"token_file"`
+}
+
+// VaultSecretConfig names a secret and the keys holding each credential.
+// The MQTT secret provides UsernameKey and PasswordKey, the Pulsar secret
+// TokenKey.
+type VaultSecretConfig struct {
+	Path        string `yaml:"path"`
+	UsernameKey string `yaml:"username_key"`
+	PasswordKey string `yaml:"password_key"`
+	TokenKey    string `yaml:"token_key"`
+}
+
+// vaultSecret is a secret read from Vault. LeaseDuration is zero for
+// static secrets.
+type vaultSecret struct {
+	Data          map[string]any
+	LeaseID       string
+	LeaseDuration time.Duration
+	Renewable     bool
+}
+
+func (s *vaultSecret) get(key string) (string, error) {
+	v, ok := s.Data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("key %q missing or not a string", key)
+	}
+	return v, nil
+}
+
+type vaultClient struct {
+	cfg   VaultConfig
+	http  *http.Client
+	token string
+
+	// The secrets in use, with when they were fetched or last renewed.
+	mqtt, pulsar               *vaultSecret
+	mqttFetched, pulsarFetched time.Time
+
+	mu          sync.RWMutex
+	pulsarToken string
+}
+
+func newVaultClient(c VaultConfig) (*vaultClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.TLS.enabled() {
+		tlsConfig, err := newTLSConfig(c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &vaultClient{
+		cfg:   c,
+		http:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		token: c.Token,
+	}, nil
+}
+
+// login obtains a token through the Kubernetes auth method unless a token
+// has been configured.
+func (v *vaultClient) login(ctx context.Context) error {
+	if v.cfg.Token != "" {
+		v.token = v.cfg.Token
+		return nil
+	}
+	if v.cfg.Kubernetes.Role == "" {
+		return errors.New("either token or kubernetes.role is required")
+	}
+	jwt, err := os.ReadFile(v.cfg.Kubernetes.TokenFile)
+	if err != nil {
+		return fmt.Errorf("reading service account token: %w", err)
+	}
+
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role": v.cfg.Kubernetes.Role, "jwt": strings.TrimSpace(string(jwt))}
+	if err := v.do(ctx, http.MethodPost, "auth/"+v.cfg.Kubernetes.MountPath+"/login", body, &resp); err != nil {
+		return fmt.Errorf("kubernetes login: %w", err)
+	}
+	v.token = resp.Auth.ClientToken
+	return nil
+}
+
+// read fetches the secret at path, unwrapping the KV v2 envelope.
+func (v *vaultClient) read(ctx context.Context, path string) (*vaultSecret, error) {
+	var resp struct {
+		LeaseID       string         `json:"lease_id"`
+		LeaseDuration int            `json:"lease_duration"`
+		Renewable     bool           `json:"renewable"`
+		Data          map[string]any `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = inner
+	}
+	return &vaultSecret{
+		Data:          data,
+		LeaseID:       resp.LeaseID,
+		LeaseDuration: time.Duration(resp.LeaseDuration) * time.Second,
+		Renewable:     resp.Renewable,
+	}, nil
+}
+
+func (v *vaultClient) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(v.cfg.Address, "/")+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	if v.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.Namespace)
+	}
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("vault returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// renew extends the lease of a dynamic secret.
+func (v *vaultClient) renew(ctx context.Context, s *vaultSecret) error {
+	var resp struct {
+		LeaseDuration int `json:"lease_duration"`
+	}
+	if err := v.do(ctx, http.MethodPut, "sys/leases/renew", map[string]string{"lease_id": s.LeaseID}, &resp); err != nil {
+		return err
+	}
+	s.LeaseDuration = time.Duration(resp.LeaseDuration) * time.Second
+	return nil
+}
+
+// readRetrying reads a secret, logging in again once if the read fails, as
+// the Vault token may have expired.
+func (v *vaultClient) readRetrying(ctx context.Context, path string) (*vaultSecret, error) {
+	secret, err := v.read(ctx, path)
+	if err == nil {
+		return secret, nil
+	}
+	if loginErr := v.login(ctx); loginErr != nil {
+		return nil, errors.Join(err, loginErr)
+	}
+	return v.read(ctx, path)
+}
+
+// due reports whether a secret fetched at fetched should be renewed or
+// read again. Static secrets are read on every check.
+func due(s *vaultSecret, fetched time.Time) bool {
+	return s.LeaseDuration == 0 || time.Since(fetched) >= s.LeaseDuration*2/3
+}
+
+// refreshSecret renews a leased secret, or reads it again when it has no
+// lease or the renewal fails. It returns the secret now in effect.
+func (v *vaultClient) refreshSecret(ctx context.Context, path string, s *vaultSecret) (*vaultSecret, error) {
+	if s.Renewable && s.LeaseID != "" {
+		err := v.renew(ctx, s)
+		if err == nil {
+			return s, nil
+		}
+		slog.Warn("Failed to renew Vault lease, reading the secret again", "path", path, "error", err)
+	}
+	return v.readRetrying(ctx, path)
+}
+
+// loadMQTT reads the MQTT credentials into c.
+func (v *vaultClient) loadMQTT(s *vaultSecret, c *Config) error {
+	username, err := s.get(c.Vault.MQTT.UsernameKey)
+	if err != nil {
+		return fmt.Errorf("mqtt secret: %w", err)
+	}
+	password, err := s.get(c.Vault.MQTT.PasswordKey)
+	if err != nil {
+		return fmt.Errorf("mqtt secret: %w", err)
+	}
+	c.MQTT.Username, c.MQTT.Password = username, password
+	return nil
+}
+
+// loadPulsar makes the Pulsar token in s the current one.
+func (v *vaultClient) loadPulsar(s *vaultSecret, c *Config) error {
+	token, err := s.get(c.Vault.Pulsar.TokenKey)
+	if err != nil {
+		return fmt.Errorf("pulsar secret: %w", err)
+	}
+	v.mu.Lock()
+	v.pulsarToken = token
+	v.mu.Unlock()
+	return nil
+}
+
+// currentPulsarToken supplies the Pulsar client with the latest token.
+func (v *vaultClient) currentPulsarToken() (string, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.pulsarToken, nil
+}
+
+// refresh renews or re-reads the secrets that are due. It reports whether
+// the MQTT credentials in c changed.
+func (v *vaultClient) refresh(ctx context.Context, c *Config) (bool, error) {
+	var errs []error
+	mqttChanged := false
+
+	if v.mqtt != nil && due(v.mqtt, v.mqttFetched) {
+		secret, err := v.refreshSecret(ctx, c.Vault.MQTT.Path, v.mqtt)
+		if err == nil {
+			username, password := c.MQTT.Username, c.MQTT.Password
+			if err = v.loadMQTT(secret, c); err == nil {
+				v.mqtt, v.mqttFetched = secret, time.Now()
+				mqttChanged = username != c.MQTT.Username || password != c.MQTT.Password
+			}
+		}
+		errs = append(errs, err)
+	}
+	if v.pulsar != nil && due(v.pulsar, v.pulsarFetched) {
+		secret, err := v.refreshSecret(ctx, c.Vault.Pulsar.Path, v.pulsar)
+		if err == nil {
+			if err = v.loadPulsar(secret, c); err == nil {
+				v.pulsar, v.pulsarFetched = secret, time.Now()
+			}
+		}
+		errs = append(errs, err)
+	}
+	return mqttChanged, errors.Join(errs...)
+}
+
+// applyVaultSecrets replaces the MQTT and Pulsar credentials in c with the
+// ones stored in Vault. The returned client keeps them fresh.
+func applyVaultSecrets(ctx context.Context, c *Config) (*vaultClient, error) {
+	v, err := newVaultClient(c.Vault)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.login(ctx); err != nil {
+		return nil, err
+	}
+
+	if p := c.Vault.MQTT.Path; p != "" {
+		if v.mqtt, err = v.read(ctx, p); err != nil {
+			return nil, err
+		}
+		if err := v.loadMQTT(v.mqtt, c); err != nil {
+			return nil, err
+		}
+		v.mqttFetched = time.Now()
+	}
+	if p := c.Vault.Pulsar.Path; p != "" {
+		if v.pulsar, err = v.read(ctx, p); err != nil {
+			return nil, err
+		}
+		if err := v.loadPulsar(v.pulsar, c); err != nil {
+			return nil, err
+		}
+		v.pulsarFetched = time.Now()
+		c.Pulsar.Auth.tokenSupplier = v.currentPulsarToken
+	}
+	return v, nil
+}
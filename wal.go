@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const walSuffix = ".wal"
+
+// WALConfig configures the write-ahead log, enabled by setting Dir. Every
+// accepted message is logged before processing and marked done once it is
+// acked, i.e. produced, buffered or deliberately dropped. Messages still
+// open when the process dies are replayed on the next start, so even QoS 0
+// messages survive a crash. Sync fsyncs every write, which also survives
+// power loss but costs throughput.
+type WALConfig struct {
+	Dir  string `yaml:"dir"`
+	Sync bool   `yaml:"sync"`
+}
+
+var (
+	walPending = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "wal_pending_messages",
+			Help: "Number of messages in the write-ahead log that have not been acked yet",
+		},
+		func() float64 {
+			if wal == nil {
+				return 0
+			}
+			return float64(wal.Len())
+		},
+	)
+	walReplayed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "wal_messages_replayed",
+			Help: "Number of messages replayed from the write-ahead log on startup",
+		},
+	)
+
+	wal *writeAheadLog
+)
+
+// walRecord is either a logged message or, with Done set, the marker that
+// the message with the same Seq has been acked, or, with SequenceID set,
+// the Pulsar sequence ID it was sent to PulsarTopic with.
+type walRecord struct {
+	Seq             uint64            `json:"seq"`
+	Done            bool              `json:"done,omitempty"`
+	PulsarTopic     string            `json:"pulsar_topic,omitempty"`
+	SequenceID      int64             `json:"sequence_id,omitempty"`
+	Topic           string            `json:"topic,omitempty"`
+	Payload         []byte            `json:"payload,omitempty"`
+	QoS             byte              `json:"qos,omitempty"`
+	Retained        bool              `json:"retained,omitempty"`
+	ReceivedAt      time.Time         `json:"received_at,omitzero"`
+	ContentType     string            `json:"content_type,omitempty"`
+	CorrelationData []byte            `json:"correlation_data,omitempty"`
+	UserProperties  map[string]string `json:"user_properties,omitempty"`
+	Bridge          string            `json:"bridge,omitempty"`
+
+	sequenceIDs map[string]int64
+}
+
+func (r *walRecord) message() *Message {
+	return &Message{
+		Topic:           r.Topic,
+		Payload:         r.Payload,
+		QoS:             r.QoS,
+		Retained:        r.Retained,
+		ReceivedAt:      r.ReceivedAt,
+		ContentType:     r.ContentType,
+		CorrelationData: r.CorrelationData,
+		UserProperties:  r.UserProperties,
+		bridge:          r.Bridge,
+		sequenceIDs:     r.sequenceIDs,
+	}
+}
+
+// walSegment counts the messages logged in a segment file that are still
+// open.
+type walSegment struct {
+	name string
+	open int
+}
+
+// writeAheadLog appends records to segment files like the disk buffer.
+// Done markers go to the current segment, so segments are only removed
+// oldest first, once none of their messages is open: a removed marker
+// never refers to a message that is still logged.
+type writeAheadLog struct {
+	cfg WALConfig
+
+	mu       sync.Mutex
+	seq      uint64
+	current  *os.File
+	size     int64
+	segments []*walSegment
+	// pending maps each open message to its segment.
+	pending map[uint64]*walSegment
+	// previous is the number of segments, at the front of segments, left
+	// by the previous run.
+	previous int
+}
+
+// openWAL opens the log in c.Dir and returns the messages left open by the
+// previous run. Their segments are kept until replayWAL has logged the
+// messages again.
+func openWAL(c WALConfig) (*writeAheadLog, []*walRecord, error) {
+	if err := os.MkdirAll(c.Dir, 0o750); err != nil {
+		return nil, nil, fmt.Errorf("creating WAL dir %s: %w", c.Dir, err)
+	}
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), walSuffix) {
+			names = append(names, filepath.Join(c.Dir, e.Name()))
+		}
+	}
+	sort.Strings(names)
+
+	open := make(map[uint64]*walRecord)
+	var order []uint64
+	var lastSeq uint64
+	for _, name := range names {
+		if err := readWALSegment(name, func(r *walRecord) {
+			lastSeq = max(lastSeq, r.Seq)
+			if r.Done {
+				delete(open, r.Seq)
+				return
+			}
+			if r.PulsarTopic != "" {
+				if m, ok := open[r.Seq]; ok {
+					if m.sequenceIDs == nil {
+						m.sequenceIDs = make(map[string]int64)
+					}
+					m.sequenceIDs[r.PulsarTopic] = r.SequenceID
+				}
+				return
+			}
+			open[r.Seq] = r
+			order = append(order, r.Seq)
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+	var unacked []*walRecord
+	for _, seq := range order {
+		if r, ok := open[seq]; ok {
+			unacked = append(unacked, r)
+		}
+	}
+
+	// Sequence numbers continue, so markers of this run never match
+	// messages of the previous one
+	w := &writeAheadLog{cfg: c, seq: lastSeq, pending: make(map[uint64]*walSegment)}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.rotate(); err != nil {
+		return nil, nil, err
+	}
+	// Hold on to the previous run's segments until released
+	var previous []*walSegment
+	for _, name := range names {
+		previous = append(previous, &walSegment{name: name, open: 1})
+	}
+	w.segments = append(previous, w.segments...)
+	w.previous = len(previous)
+	return w, unacked, nil
+}
+
+func readWALSegment(name string, fn func(*walRecord)) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Warn("Truncated record in WAL segment", "segment", name, "error", err)
+			}
+			return nil
+		}
+		// A length beyond any segment is a torn or corrupt header, not a
+		// record to allocate for
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxSegmentSize {
+			slog.Warn("Truncated record in WAL segment", "segment", name, "error", fmt.Errorf("record length %d exceeds the segment size", size))
+			return nil
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			slog.Warn("Truncated record in WAL segment", "segment", name, "error", err)
+			return nil
+		}
+		var rec walRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			slog.Error("Skipping corrupt WAL record", "segment", name, "error", err)
+			continue
+		}
+		fn(&rec)
+	}
+}
+
+// Append logs msg and hooks its ack to mark it done.
+func (w *writeAheadLog) Append(msg *Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.seq++
+	seq := w.seq
+	if err := w.write(&walRecord{
+		Seq:             seq,
+		Topic:           msg.Topic,
+		Payload:         msg.Payload,
+		QoS:             msg.QoS,
+		Retained:        msg.Retained,
+		ReceivedAt:      msg.ReceivedAt,
+		ContentType:     msg.ContentType,
+		CorrelationData: msg.CorrelationData,
+		UserProperties:  msg.UserProperties,
+		Bridge:          msg.bridge,
+	}); err != nil {
+		return err
+	}
+	seg := w.segments[len(w.segments)-1]
+	seg.open++
+	w.pending[seq] = seg
+	msg.walSeq = seq
+
+	ack := msg.ack
+	msg.ack = func() {
+		w.done(seq)
+		if ack != nil {
+			ack()
+		}
+	}
+	return nil
+}
+
+// done marks the message seq as acked.
+func (w *writeAheadLog) done(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seg, ok := w.pending[seq]
+	if !ok {
+		return
+	}
+	delete(w.pending, seq)
+	seg.open--
+	if w.current == nil {
+		// Acked after shutdown closed the log
+		return
+	}
+	if err := w.write(&walRecord{Seq: seq, Done: true}); err != nil {
+		slog.Error("Failed to write to the WAL", "error", err)
+	}
+}
+
+// sent records that the open message seq was sent to topic with the
+// Pulsar sequence ID id.
+func (w *writeAheadLog) sent(seq uint64, topic string, id int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.pending[seq]; !ok || w.current == nil {
+		return
+	}
+	if err := w.write(&walRecord{Seq: seq, PulsarTopic: topic, SequenceID: id}); err != nil {
+		slog.Error("Failed to write to the WAL", "error", err)
+	}
+}
+
+// write appends r to the current segment, rotating it when it is full.
+// Callers must hold mu.
+func (w *writeAheadLog) write(r *walRecord) error {
+	if w.current == nil {
+		return errors.New("WAL is closed")
+	}
+	if w.size >= maxSegmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	// Replay treats longer records as corruption
+	if len(data) > maxSegmentSize {
+		return fmt.Errorf("record of %d bytes exceeds the WAL segment size", len(data))
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := w.current.Write(append(header[:], data...)); err != nil {
+		return err
+	}
+	w.size += int64(len(data) + 4)
+	if w.cfg.Sync {
+		return w.current.Sync()
+	}
+	return nil
+}
+
+// rotate starts a new segment and removes the oldest ones that hold no
+// open message. Callers must hold mu.
+func (w *writeAheadLog) rotate() error {
+	if w.current != nil {
+		if err := w.current.Close(); err != nil {
+			return err
+		}
+	}
+	if err := w.compact(); err != nil {
+		return err
+	}
+
+	name := filepath.Join(w.cfg.Dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), walSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	w.current = f
+	w.size = 0
+	w.segments = append(w.segments, &walSegment{name: name})
+	return nil
+}
+
+// compact removes the oldest segments that hold no open message. Callers
+// must hold mu.
+func (w *writeAheadLog) compact() error {
+	for len(w.segments) > 1 && w.segments[0].open == 0 {
+		if err := os.Remove(w.segments[0].name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		w.segments = w.segments[1:]
+	}
+	return nil
+}
+
+// release removes the previous run's segments.
+func (w *writeAheadLog) release() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, seg := range w.segments[:w.previous] {
+		seg.open = 0
+	}
+	w.previous = 0
+	return w.compact()
+}
+
+// Len returns the number of open messages.
+func (w *writeAheadLog) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+func (w *writeAheadLog) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.current == nil {
+		return nil
+	}
+	err := w.current.Close()
+	w.current = nil
+	return err
+}
+
+// replayWAL submits the messages left open by the previous run. They are
+// logged again, so the old segments can go.
+func replayWAL(unacked []*walRecord) {
+	for _, r := range unacked {
+		msg := r.message()
+		if err := wal.Append(msg); err != nil {
+			slog.Error("Failed to write to the WAL", "mqtt_topic", msg.Topic, "error", err)
+		}
+		walReplayed.Inc()
+		pool.Submit(msg)
+	}
+	if err := wal.release(); err != nil {
+		slog.Error("Failed to remove replayed WAL segments", "error", err)
+	}
+	if len(unacked) > 0 {
+		slog.Info("Replayed messages from the WAL", "count", len(unacked))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReadWALSegmentFraming(t *testing.T) {
+	record := func(seq uint64) []byte {
+		data, _ := json.Marshal(walRecord{Seq: seq, Topic: "t"})
+		return frame(data)
+	}
+	tests := []struct {
+		name    string
+		segment [][]byte
+		want    []uint64
+	}{
+		{"empty", nil, nil},
+		{"clean", [][]byte{record(1), record(2)}, []uint64{1, 2}},
+		{"truncated header", [][]byte{record(1), {0, 0, 1}}, []uint64{1}},
+		{"truncated record", [][]byte{record(1), record(2)[:8]}, []uint64{1}},
+		{"length beyond segment size", [][]byte{record(1), {0x7f, 0xff, 0xff, 0xff}, record(2)}, []uint64{1}},
+		{"corrupt record is skipped", [][]byte{record(1), frame([]byte("{")), record(2)}, []uint64{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "segment"+walSuffix)
+			if err := os.WriteFile(name, slices.Concat(tt.segment...), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var got []uint64
+			if err := readWALSegment(name, func(r *walRecord) { got = append(got, r.Seq) }); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("read %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWALReopen(t *testing.T) {
+	dir := t.TempDir()
+	w, unacked, err := openWAL(WALConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unacked) != 0 {
+		t.Fatalf("new WAL has %d unacked messages", len(unacked))
+	}
+	var msgs []*Message
+	for _, topic := range []string{"a", "b", "c"} {
+		msg := &Message{Topic: topic, Payload: []byte(topic)}
+		if err := w.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	msgs[1].Ack()
+	w.sent(msgs[2].walSeq, "persistent://public/default/c", 42)
+	if got := w.Len(); got != 2 {
+		t.Errorf("Len() = %d, want 2", got)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, unacked, err = openWAL(WALConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var topics []string
+	for _, r := range unacked {
+		topics = append(topics, r.Topic)
+	}
+	if !slices.Equal(topics, []string{"a", "c"}) {
+		t.Fatalf("unacked = %v, want [a c]", topics)
+	}
+	if id := unacked[1].message().sequenceIDs["persistent://public/default/c"]; id != 42 {
+		t.Errorf("sequence ID = %d, want 42", id)
+	}
+	if w.seq != msgs[2].walSeq {
+		t.Errorf("sequence numbers restart at %d, want them to continue from %d", w.seq, msgs[2].walSeq)
+	}
+}
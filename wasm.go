@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// newWASMTransformer runs the payload through a WebAssembly module loaded
+// from step.Module. The module must export its memory and two functions:
+//
+//	alloc(size i32) i32             reserve size bytes for the input payload
+//	transform(ptr i32, len i32) i64 transform the payload at ptr
+//
+// transform returns the output location packed as ptr<<32 | len, or 0 to
+// drop the message. A trap fails the message. WASI is available, so modules
+// built by TinyGo or Rust's wasm32-wasi target work as reactors.
+func newWASMTransformer(step TransformStep) (Transformer, error) {
+	if step.Module == "" {
+		return nil, errors.New("wasm requires module")
+	}
+	code, err := os.ReadFile(step.Module)
+	if err != nil {
+		return nil, fmt.Errorf("reading wasm module: %w", err)
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("compiling wasm module %s: %w", step.Module, err)
+	}
+	for _, name := range []string{"alloc", "transform"} {
+		if _, ok := compiled.ExportedFunctions()[name]; !ok {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("wasm module %s does not export %s", step.Module, name)
+		}
+	}
+
+	t := &wasmTransformer{
+		path:      step.Module,
+		runtime:   runtime,
+		compiled:  compiled,
+		instances: make(chan api.Module, max(cfg.Processing.Workers, 1)),
+	}
+	// Instantiate once up front so a module failing to start is a config
+	// error rather than a failure on every message
+	inst, err := t.instantiate(ctx)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	t.instances <- inst
+	return t, nil
+}
+
+// wasmTransformer keeps idle module instances, at most one per worker,
+// since an instance can't be called from more than one worker at a time.
+type wasmTransformer struct {
+	path      string
+	runtime   wazero.Runtime
+	compiled  wazero.CompiledModule
+	instances chan api.Module
+
+	// mu is held for reading by calls and for writing by Close, so the
+	// runtime isn't closed under a running call.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func (t *wasmTransformer) instantiate(ctx context.Context) (api.Module, error) {
+	// Instances are anonymous so the same module can be instantiated
+	// repeatedly
+	mod, err := t.runtime.InstantiateModule(ctx, t.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, fmt.Errorf("instantiating wasm module %s: %w", t.path, err)
+	}
+	return mod, nil
+}
+
+func (t *wasmTransformer) Transform(msg *Message) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return fmt.Errorf("wasm module %s was unloaded by a reload", t.path)
+	}
+
+	ctx := context.Background()
+	var mod api.Module
+	select {
+	case mod = <-t.instances:
+	default:
+		var err error
+		if mod, err = t.instantiate(ctx); err != nil {
+			return err
+		}
+	}
+
+	payload, err := t.call(ctx, mod, msg.Payload)
+	if err != nil {
+		// A trapped instance may be left in any state, so don't reuse it
+		mod.Close(ctx)
+		return fmt.Errorf("wasm module %s: %w", t.path, err)
+	}
+	select {
+	case t.instances <- mod:
+	default:
+		mod.Close(ctx)
+	}
+
+	if payload == nil {
+		return errDropMessage
+	}
+	msg.Payload = payload
+	return nil
+}
+
+// Close closes the idle instances and the runtime once running calls are
+// done.
+func (t *wasmTransformer) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	ctx := context.Background()
+	for {
+		select {
+		case mod := <-t.instances:
+			mod.Close(ctx)
+		default:
+			if err := t.runtime.Close(ctx); err != nil {
+				slog.Warn("Failed to close wasm runtime", "module", t.path, "error", err)
+			}
+			return
+		}
+	}
+}
+
+// call copies in into the instance's memory, runs transform and copies the
+// result out. It returns nil if the module dropped the message.
+func (t *wasmTransformer) call(ctx context.Context, mod api.Module, in []byte) ([]byte, error) {
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(res[0])
+	if !mod.Memory().Write(ptr, in) {
+		return nil, fmt.Errorf("alloc returned out of range pointer %d", ptr)
+	}
+
+	res, err = mod.ExportedFunction("transform").Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	if res[0] == 0 {
+		return nil, nil
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	out, ok := mod.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, fmt.Errorf("transform returned out of range result %d+%d", outPtr, outLen)
+	}
+	// out aliases the instance's memory, which the next call overwrites
+	return append([]byte(nil), out...), nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WebhookConfig configures the webhook sink, which POSTs messages to URL as
+// a JSON array of up to BatchSize (default 1) entries, waiting at most
+// BatchTimeout (default 1s) for a batch to fill. Each entry carries the
+// mapped topic, key, message properties and the payload, embedded when it
+// is JSON and base64 encoded otherwise. Network errors, 429 and 5xx
+// responses are retried according to retry; other responses fail the batch.
+// Failed messages are counted as send_failed and left unacked.
+type WebhookConfig struct {
+	URL          string            `yaml:"url"`
+	Headers      map[string]string `yaml:"headers"`
+	BatchSize    int               `yaml:"batch_size"`
+	BatchTimeout time.Duration     `yaml:"batch_timeout"`
+	Timeout      time.Duration     `yaml:"timeout"`
+}
+
+func (c WebhookConfig) validate() error {
+	if c.URL == "" {
+		return errors.New("webhook.url is required")
+	}
+	if c.BatchSize < 0 || c.BatchTimeout < 0 || c.Timeout < 0 {
+		return errors.New("webhook batch_size, batch_timeout and timeout must not be negative")
+	}
+	return nil
+}
+
+type webhookEntry struct {
+	Topic         string            `json:"topic"`
+	Key           string            `json:"key,omitempty"`
+	Properties    map[string]string `json:"properties"`
+	Payload       json.RawMessage   `json:"payload,omitempty"`
+	PayloadBase64 []byte            `json:"payload_base64,omitempty"`
+}
+
+type webhookPending struct {
+	entry webhookEntry
+	span  trace.Span
+	msg   *Message
+}
+
+// webhookSink batches messages on a single goroutine, so batches are sent
+// one at a time.
+type webhookSink struct {
+	c      WebhookConfig
+	client *http.Client
+	done   chan struct{}
+
+	// mu keeps Close from closing pending while Produce sends on it
+	mu      sync.RWMutex
+	closed  bool
+	pending chan webhookPending
+}
+
+func newWebhookSink(c WebhookConfig) *webhookSink {
+	if c.BatchSize <= 0 {
+		c.BatchSize = 1
+	}
+	if c.BatchTimeout == 0 {
+		c.BatchTimeout = time.Second
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	s := &webhookSink{
+		c:       c,
+		client:  &http.Client{Timeout: c.Timeout},
+		pending: make(chan webhookPending, c.BatchSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookSink) Produce(ctx context.Context, msg *Message, dest Destination) {
+	_, span := tracer.Start(ctx, "send-to-webhook", trace.WithAttributes(attribute.String("webhook.topic", dest.Topic)))
+
+	payload, err := dest.encodePayload(msg.Payload)
+	if err != nil {
+		logSampled(slog.LevelWarn, msg.Topic, "Payload does not match the producer schema", "mqtt_topic", msg.Topic, "webhook_topic", dest.Topic, "error", err)
+		messagesInvalid.With(prometheus.Labels{"rule": dest.route.name()}).Inc()
+		quarantine(ctx, msg, err)
+		span.End()
+		return
+	}
+
+	entry := webhookEntry{Topic: dest.Topic, Key: dest.messageKey(msg), Properties: messageProperties(msg)}
+	if dryRun {
+		logDryRun(msg, dest.Topic, entry.Key, len(payload))
+		span.End()
+		return
+	}
+	if json.Valid(payload) {
+		entry.Payload = payload
+	} else {
+		entry.PayloadBase64 = payload
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		// Replaced by a reload while the message was being processed
+		slog.Error("Failed to send message", "mqtt_topic", msg.Topic, "webhook_topic", dest.Topic, "error", errSinkClosed)
+		sendFailures.With(prometheus.Labels{"topic": dest.Topic}).Inc()
+		messagesDropped.With(prometheus.Labels{"reason": dropSendFailed}).Inc()
+		span.End()
+		return
+	}
+	messagesInFlight.Inc()
+	inFlight.Add(1)
+	s.pending <- webhookPending{entry: entry, span: span, msg: msg}
+}
+
+// run collects batches until the sink is closed, then sends what is left.
+func (s *webhookSink) run() {
+	defer close(s.done)
+	var batch []webhookPending
+	timer := time.NewTimer(s.c.BatchTimeout)
+	timer.Stop()
+	for {
+		select {
+		case p, ok := <-s.pending:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(s.c.BatchTimeout)
+			}
+			batch = append(batch, p)
+			if len(batch) < s.c.BatchSize {
+				continue
+			}
+			timer.Stop()
+		case <-timer.C:
+		}
+		s.flush(batch)
+		batch = nil
+	}
+}
+
+func (s *webhookSink) flush(batch []webhookPending) {
+	if len(batch) == 0 {
+		return
+	}
+	entries := make([]webhookEntry, len(batch))
+	for i, p := range batch {
+		entries[i] = p.entry
+	}
+	body, err := json.Marshal(entries)
+	if err == nil {
+		err = s.post(body)
+	}
+
+	for _, p := range batch {
+		messagesInFlight.Dec()
+		labels := prometheus.Labels{"topic": p.entry.Topic}
+		if err != nil {
+			slog.Error("Failed to send message", "mqtt_topic", p.msg.Topic, "webhook_topic", p.entry.Topic, "error", err)
+			sendFailures.With(labels).Inc()
+			// Not acked: with manual acknowledgement the broker redelivers it
+			messagesDropped.With(prometheus.Labels{"reason": dropSendFailed}).Inc()
+			countBridge(p.msg, "dropped")
+		} else {
+			p.msg.Ack()
+			messagesProduced.With(labels).Inc()
+			countBytesProduced(p.entry.Topic, len(p.msg.Payload))
+			countBridge(p.msg, "produced")
+			throughput.record(p.entry.Topic)
+			observeLatency(p.msg, p.entry.Topic)
+		}
+		p.span.End()
+		inFlight.Done()
+	}
+}
+
+// post sends body, retrying failures that may be temporary.
+func (s *webhookSink) post(body []byte) error {
+	for attempt := 1; ; attempt++ {
+		retry, err := s.send(body)
+		if err == nil || !retry || attempt >= cfg.Retry.MaxAttempts {
+			return err
+		}
+		delay := cfg.Retry.backoff(attempt)
+		slog.Warn("Failed to call webhook, retrying", "url", s.c.URL, "attempt", attempt, "backoff", delay, "error", err)
+		time.Sleep(delay)
+	}
+}
+
+// send makes a single request and reports whether a failure is worth
+// retrying.
+func (s *webhookSink) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.c.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.c.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook responded %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+}
+
+// Close sends the pending batch and stops the sink.
+func (s *webhookSink) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.pending)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
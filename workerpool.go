@@ -0,0 +1,213 @@
+package main
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// workerPool processes inbound messages on a fixed number of goroutines,
+// decoupling the MQTT callback from Pulsar sends. By default Submit blocks
+// once the queue is full, which pushes backpressure onto the MQTT client.
+//
+// With a shard key, each worker has a queue of its own and messages with
+// the same key always go to the same worker, so they are sent in the order
+// received. Otherwise all workers share one queue.
+//
+// What Submit does when a queue is full depends on the overflow policy:
+// block waits for room, drop_newest drops the submitted message and
+// drop_oldest makes room by dropping the longest queued one.
+type workerPool struct {
+	queues   []chan *Message
+	shardKey func(*Message) string
+	overflow string
+	handler  func(*Message)
+	wg       sync.WaitGroup
+	// blocked counts Submit calls waiting for room in a queue.
+	blocked atomic.Int64
+	// progress is when a worker last finished a message, in Unix
+	// nanoseconds.
+	progress atomic.Int64
+
+	mu      sync.Mutex
+	resumed *sync.Cond
+	paused  bool
+
+	// closeMu keeps Submit from sending on the closed jobs channel.
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+// Overflow policies for processing.overflow.
+const (
+	overflowBlock      = "block"
+	overflowDropNewest = "drop_newest"
+	overflowDropOldest = "drop_oldest"
+)
+
+// newWorkerPool creates a pool as configured by c. With key dispatch the
+// queue size is split between the workers' queues.
+func newWorkerPool(c ProcessingConfig, handler func(*Message)) *workerPool {
+	workers, queueSize, shardKey := c.Workers, c.QueueSize, c.shardKey()
+	p := &workerPool{
+		shardKey: shardKey,
+		overflow: c.Overflow,
+		handler:  handler,
+	}
+	p.resumed = sync.NewCond(&p.mu)
+	p.progress.Store(time.Now().UnixNano())
+	if shardKey == nil {
+		p.queues = []chan *Message{make(chan *Message, queueSize)}
+	} else {
+		for range workers {
+			p.queues = append(p.queues, make(chan *Message, (queueSize+workers-1)/workers))
+		}
+	}
+	for i := range workers {
+		p.wg.Add(1)
+		go p.run(p.queues[i%len(p.queues)])
+	}
+	return p
+}
+
+func (p *workerPool) run(jobs chan *Message) {
+	defer p.wg.Done()
+	for msg := range jobs {
+		p.waitWhilePaused()
+		p.handler(msg)
+		p.progress.Store(time.Now().UnixNano())
+	}
+}
+
+func (p *workerPool) waitWhilePaused() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.paused {
+		p.resumed.Wait()
+	}
+}
+
+// Pause stops workers from picking up new messages. Messages keep queueing
+// until the queue is full, after which Submit blocks.
+func (p *workerPool) Pause() {
+	p.mu.Lock()
+	p.paused = true
+	p.mu.Unlock()
+}
+
+// Resume lets paused workers continue.
+func (p *workerPool) Resume() {
+	p.mu.Lock()
+	p.paused = false
+	p.mu.Unlock()
+	p.resumed.Broadcast()
+}
+
+// Paused reports whether the pool is paused.
+func (p *workerPool) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// Submit queues a message for processing. Messages submitted after Stop
+// are discarded without being acked, so the broker redelivers them.
+func (p *workerPool) Submit(msg *Message) {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		slog.Debug("Discarding message received during shutdown", "mqtt_topic", msg.Topic)
+		msg.releaseRouting()
+		return
+	}
+	q := p.queueFor(msg)
+	select {
+	case q <- msg:
+		return
+	default:
+	}
+
+	switch p.overflow {
+	case overflowDropNewest:
+		queueOverflows.With(prometheus.Labels{"outcome": "dropped_newest"}).Inc()
+		msg.releaseRouting()
+		dropMessage(msg, dropQueueFull)
+	case overflowDropOldest:
+		for {
+			select {
+			case q <- msg:
+				return
+			case oldest := <-q:
+				queueOverflows.With(prometheus.Labels{"outcome": "dropped_oldest"}).Inc()
+				oldest.releaseRouting()
+				dropMessage(oldest, dropQueueFull)
+			}
+		}
+	default:
+		queueOverflows.With(prometheus.Labels{"outcome": "blocked"}).Inc()
+		p.blocked.Add(1)
+		defer p.blocked.Add(-1)
+		q <- msg
+	}
+}
+
+func (p *workerPool) queueFor(msg *Message) chan *Message {
+	if len(p.queues) == 1 {
+		return p.queues[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(p.shardKey(msg)))
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+// Blocked reports whether a Submit is waiting for room, i.e. the MQTT
+// client is held up until the workers catch up.
+func (p *workerPool) Blocked() bool {
+	return p.blocked.Load() > 0
+}
+
+// Len returns the number of queued messages.
+func (p *workerPool) Len() int {
+	n := 0
+	for _, q := range p.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// Stalled reports whether messages are queued but no worker has finished
+// one for longer than timeout, e.g. because all are stuck on a send. A
+// paused pool isn't stalled.
+func (p *workerPool) Stalled(timeout time.Duration) bool {
+	if p.Len() == 0 || p.Paused() {
+		return false
+	}
+	return time.Since(time.Unix(0, p.progress.Load())) > timeout
+}
+
+// Full reports whether a queue has reached its capacity.
+func (p *workerPool) Full() bool {
+	for _, q := range p.queues {
+		if cap(q) > 0 && len(q) == cap(q) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop stops accepting messages and waits until every queued message has
+// been handed to the handler.
+func (p *workerPool) Stop() {
+	p.Resume()
+	p.closeMu.Lock()
+	p.closed = true
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.closeMu.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// queued returns the topics waiting in the pool's single queue.
+func queued(p *workerPool) []string {
+	var topics []string
+	for len(p.queues[0]) > 0 {
+		topics = append(topics, (<-p.queues[0]).Topic)
+	}
+	return topics
+}
+
+func TestWorkerPoolOverflow(t *testing.T) {
+	tests := []struct {
+		overflow    string
+		wantQueued  []string
+		wantDropped []string
+	}{
+		{overflowDropNewest, []string{"a", "b"}, []string{"c", "d"}},
+		{overflowDropOldest, []string{"c", "d"}, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.overflow, func(t *testing.T) {
+			// Without workers nothing leaves the queue
+			p := newWorkerPool(ProcessingConfig{QueueSize: 2, Dispatch: dispatchShared, Overflow: tt.overflow}, nil)
+			var dropped []string
+			for _, topic := range []string{"a", "b", "c", "d"} {
+				p.Submit(&Message{Topic: topic, ack: func() { dropped = append(dropped, topic) }})
+			}
+			if got := queued(p); !slices.Equal(got, tt.wantQueued) {
+				t.Errorf("queued = %v, want %v", got, tt.wantQueued)
+			}
+			if !slices.Equal(dropped, tt.wantDropped) {
+				t.Errorf("dropped = %v, want %v", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolOverflowBlock(t *testing.T) {
+	p := newWorkerPool(ProcessingConfig{QueueSize: 1, Dispatch: dispatchShared, Overflow: overflowBlock}, nil)
+	p.Submit(&Message{Topic: "a"})
+
+	done := make(chan struct{})
+	go func() {
+		p.Submit(&Message{Topic: "b"})
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for p.blocked.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Submit did not block on a full queue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if topic := (<-p.queues[0]).Topic; topic != "a" {
+		t.Errorf("first message = %s, want a", topic)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Submit still blocked after room was made")
+	}
+	if got := queued(p); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("queued = %v, want [b]", got)
+	}
+}
+
+func TestWorkerPoolShardKey(t *testing.T) {
+	p := newWorkerPool(ProcessingConfig{Workers: 4, QueueSize: 8, Dispatch: dispatchKey}, func(*Message) {})
+	defer p.Stop()
+	for _, topic := range []string{"device/1", "device/2", "device/3"} {
+		want := p.queueFor(&Message{Topic: topic})
+		for range 3 {
+			if got := p.queueFor(&Message{Topic: topic}); got != want {
+				t.Fatalf("%s went to different queues", topic)
+			}
+		}
+	}
+}